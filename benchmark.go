@@ -39,7 +39,9 @@ func main() {
 
 	firstInGroup := groupMember == ""
 	if !firstInGroup {
-		ring.JoinGroup(groupMember)
+		if err := ring.JoinGroup(groupMember); err != nil {
+			log.Fatal("joining:", err)
+		}
 		logger.Log("JOIN", "Gossiping new member to the group")
 	} else {
 		ring.FirstMember(hostPort)
@@ -57,13 +59,15 @@ func main() {
 	TESTCASES := 100000
 
 	for i := 0; i < TESTCASES; i++ {
-		k := rand.Intn(1000000)
+		k := rand.Intn(ring.KeySpace())
 		start := time.Now()
 		ring.Lookup(k, 0)
 		elapsed := time.Now().Sub(start)
 		fmt.Println("ELAPSED\t", elapsed.Seconds())
 	}
-	ring.LeaveGroup()
+	if err := ring.LeaveGroup(); err != nil {
+		fmt.Println("Leaving:", err)
+	}
 }
 
 func getHostPort(port string) (hostPort string) {
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"../data"
+	"../ring"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+  Talks to the ring without joining it. The client learns where keys live from
+  the machines it is given, keeps that view, and sends every request straight
+  to the machine that coordinates the key. It never listens for anything, so
+  nobody gossips about it and it never shows up in anyone's Usertable.
+
+  When a machine sends us on to a newer one, or can't be reached, the view is
+  fetched again. With Chord nobody knows the whole ring, so the view is only
+  the machines we've run into, and the machine we ask sends us on to the owner.
+
+  The requests themselves are the ring's, see ring/session.go, the client is
+  only the Router that says where keys live.
+*/
+
+//How often to ask a coordinator whether a transaction it runs has ended
+const txnPollInterval = 100 * time.Millisecond
+
+type Client struct {
+	*ring.Session
+
+	//Shows up as the caller in the command logs of the machines we talk to
+	Name string
+
+	seeds     []string
+	locations []data.LocationStore
+	chord     bool
+	hasher    data.Hasher
+	lock      sync.Mutex
+}
+
+// A client of the ring the seeds belong to. Fails if none of them answers
+func New(seeds []string) (*Client, error) {
+	client := &Client{
+		Name:  "client",
+		seeds: seeds,
+	}
+	client.Session = ring.NewSession(client)
+	if err := client.Refresh(); err != nil {
+		return nil, err
+	}
+	if err := client.fetchHasher(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Hash the way the ring does, so words end up on the same keys
+func (self *Client) fetchHasher() (err error) {
+	for _, address := range self.knownMachines() {
+		var config ring.Config
+		if err = ring.Call(address, "Ring.GetConfig", 0, &config); err != nil {
+			continue
+		}
+		self.hasher, err = data.NewHasher(config.HashFunction, config.KeySpace)
+		return err
+	}
+	return err
+}
+
+// Where a word goes on the ring
+func (self *Client) Hash(s string) int {
+	return self.hasher.Hash(s)
+}
+
+/*
+  Ring view
+*/
+
+// Fetch the view from the first machine that answers, machines we know of first, then the seeds
+func (self *Client) Refresh() error {
+	return self.refresh(context.Background())
+}
+
+func (self *Client) refresh(ctx context.Context) error {
+	err := errors.New("no machines to ask")
+	for _, address := range self.knownMachines() {
+		if err = self.refreshFrom(ctx, address); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (self *Client) refreshFrom(ctx context.Context, address string) error {
+	var view ring.RingView
+	if err := ring.CallContext(ctx, address, "Ring.GetRingView", 0, &view); err != nil {
+		return err
+	}
+	if len(view.Locations) == 0 {
+		return ring.NewOpError("", 0, address, ring.ErrUnavailable)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.chord = view.Chord
+	if !view.Chord {
+		self.locations = view.Locations
+	} else {
+		//Keep what we knew, the machine only told us about its neighbours
+		for _, location := range self.locations {
+			if !containsKey(view.Locations, location.Key) {
+				view.Locations = append(view.Locations, location)
+			}
+		}
+		self.locations = view.Locations
+	}
+	sort.Slice(self.locations, func(i, j int) bool {
+		return data.CompareKeys(self.locations[i].Key, self.locations[j].Key) < 0
+	})
+	return nil
+}
+
+func containsKey(locations []data.LocationStore, key int) bool {
+	for _, location := range locations {
+		if location.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Every machine in the view, then the seeds we started from
+func (self *Client) knownMachines() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	seen := make(map[string]bool)
+	machines := make([]string, 0, len(self.locations)+len(self.seeds))
+	for _, location := range self.locations {
+		if !seen[location.Value] {
+			seen[location.Value] = true
+			machines = append(machines, location.Value)
+		}
+	}
+	for _, seed := range self.seeds {
+		if !seen[seed] {
+			seen[seed] = true
+			machines = append(machines, seed)
+		}
+	}
+	return machines
+}
+
+// The first machine at or after the key, going round past the largest key
+func (self *Client) Coordinator(key int) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.locations) == 0 {
+		return ""
+	}
+	i := sort.Search(len(self.locations), func(i int) bool {
+		return data.CompareKeys(self.locations[i].Key, key) >= 0
+	})
+	if i == len(self.locations) {
+		i = 0
+	}
+	return self.locations[i].Value
+}
+
+// A machine sent us on to member, what it knows is newer than our view
+func (self *Client) Follow(ctx context.Context, member *data.GroupMember) {
+	self.refreshFrom(ctx, member.Address)
+}
+
+func (self *Client) Reload(ctx context.Context) error {
+	return self.refresh(ctx)
+}
+
+func (self *Client) Caller() string {
+	return self.Name
+}
+
+// The machines in our view, in order
+func (self *Client) Locations() []data.LocationStore {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]data.LocationStore{}, self.locations...)
+}
+
+/*
+  Transactions, see ring/transaction.go
+*/
+
+func (self *Client) Commit(txn *ring.Transaction, consistency int) error {
+	return self.CommitContext(context.Background(), txn, consistency)
+}
+
+/*
+  Have the coordinator of the first key run the transaction, any machine can.
+  If we lose its answer only it knows how the transaction ended, we ask it
+  until it says or ctx is done, then the outcome is unknown.
+*/
+func (self *Client) CommitContext(ctx context.Context, txn *ring.Transaction, consistency int) error {
+	if len(txn.Writes) == 0 {
+		return nil
+	}
+	request := &ring.TxnRequest{Transaction: *txn, Consistency: consistency, Caller: self.Name}
+	key := txn.Writes[0].Item.Key
+	address := self.Coordinator(key)
+	for attempt := 0; ; attempt++ {
+		if deadline, ok := ctx.Deadline(); ok {
+			request.Timeout = time.Until(deadline)
+		}
+		var result ring.TxnResult
+		err := ring.CallContext(ctx, address, "Ring.CommitTransaction", request, &result)
+		if err == nil {
+			return nil
+		}
+		//The coordinator decided, or never got the transaction
+		if result.Error != nil || ring.Retryable("Ring.CommitTransaction", err) {
+			//The machine may have left, another one can run it
+			if result.Error == nil && attempt == 0 && ctx.Err() == nil && self.refresh(ctx) == nil {
+				address = self.Coordinator(key)
+				continue
+			}
+			return ring.NewOpError("commit", key, address, err)
+		}
+		if err = self.txnOutcome(ctx, address, txn.Id, err); err != nil {
+			return ring.NewOpError("commit", key, address, err)
+		}
+		return nil
+	}
+}
+
+// How the transaction the coordinator at address ran ended, lost is why we don't know
+func (self *Client) txnOutcome(ctx context.Context, address string, id string, lost error) error {
+	for ctx.Err() == nil {
+		var status int
+		if err := ring.CallContext(ctx, address, "Ring.TxnStatus", id, &status); err != nil {
+			break
+		}
+		switch status {
+		case ring.TxnCommitted:
+			return nil
+		case ring.TxnAborted:
+			return ring.ErrAborted
+		}
+		select {
+		case <-time.After(txnPollInterval):
+		case <-ctx.Done():
+		}
+	}
+	return &ring.OpError{Err: ring.ErrUnknownOutcome, Cause: lost}
+}
+
+/*
+  Watching keys, see ring/watch.go
+*/
+
+// Changes to keys from low up to but not including high, from the token on if there is one. The channel is closed once ctx is done
+func (self *Client) Watch(ctx context.Context, low, high int, token string) (<-chan ring.WatchEvent, error) {
+	cursor := ring.NewWatchCursor(low, high)
+	if token != "" {
+		var err error
+		if cursor, err = ring.ParseWatchToken(token); err != nil {
+			return nil, err
+		}
+	}
+	return ring.RunWatch(ctx, cursor, self.watchOwners(cursor)), nil
+}
+
+func (self *Client) WatchKey(ctx context.Context, key int, token string) (<-chan ring.WatchEvent, error) {
+	return self.Watch(ctx, key, key+1, token)
+}
+
+// Ask whichever machine answers first who coordinates the range, we may not know all of them
+func (self *Client) watchOwners(cursor ring.WatchCursor) func(ctx context.Context) ([]string, error) {
+	request := &ring.WatchRequest{Low: cursor.Low, High: cursor.High}
+	return func(ctx context.Context) ([]string, error) {
+		err := ring.ErrUnavailable
+		for _, address := range self.knownMachines() {
+			var owners []string
+			if err = ring.CallContext(ctx, address, "Ring.WatchOwners", request, &owners); err == nil {
+				return owners, nil
+			}
+		}
+		return nil, err
+	}
+}
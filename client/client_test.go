@@ -0,0 +1,222 @@
+package client
+
+import (
+	"../data"
+	"../ring"
+	"context"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"testing"
+)
+
+func testClient(seeds []string, locations ...data.LocationStore) *Client {
+	return &Client{Name: "client", seeds: seeds, locations: locations}
+}
+
+// Keys go to the first machine at or after them, round past the largest one to the smallest
+func TestCoordinator(t *testing.T) {
+	client := testClient(nil,
+		data.LocationStore{Key: -20, Value: "a:1"},
+		data.LocationStore{Key: 10, Value: "b:1"},
+		data.LocationStore{Key: 30, Value: "c:1"},
+	)
+	tests := []struct {
+		key     int
+		address string
+	}{
+		{-100, "a:1"},
+		{-20, "a:1"},
+		{-19, "b:1"},
+		{0, "b:1"},
+		{10, "b:1"},
+		{11, "c:1"},
+		{30, "c:1"},
+		{31, "a:1"},
+		{1 << 40, "a:1"},
+	}
+	for _, test := range tests {
+		if address := client.Coordinator(test.key); address != test.address {
+			t.Errorf("key %d: got %q, want %q", test.key, address, test.address)
+		}
+	}
+
+	if address := testClient(nil).Coordinator(5); address != "" {
+		t.Errorf("client without a view sends key 5 to %q", address)
+	}
+}
+
+// The machines in the view come first, each once, then the seeds we don't know from it
+func TestKnownMachines(t *testing.T) {
+	tests := []struct {
+		seeds     []string
+		locations []data.LocationStore
+		want      []string
+	}{
+		{[]string{"s:1", "s:2"}, nil, []string{"s:1", "s:2"}},
+		{[]string{"s:1"}, []data.LocationStore{{Key: 1, Value: "a:1"}, {Key: 2, Value: "b:1"}}, []string{"a:1", "b:1", "s:1"}},
+		{[]string{"b:1", "s:1"}, []data.LocationStore{{Key: 1, Value: "a:1"}, {Key: 2, Value: "b:1"}, {Key: 3, Value: "a:1"}}, []string{"a:1", "b:1", "s:1"}},
+		{nil, nil, []string{}},
+	}
+	for _, test := range tests {
+		got := testClient(test.seeds, test.locations...).knownMachines()
+		if len(got) != len(test.want) {
+			t.Errorf("%v: got %v, want %v", test.locations, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%v: got %v, want %v", test.locations, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+/*
+  A machine of the ring that only knows what the test tells it: the view it
+  hands out, and whether lookups are its to answer or go to another machine
+*/
+type stubRing struct {
+	address string
+	view    ring.RingView
+	owner   *data.GroupMember
+	lookups int
+	lock    sync.Mutex
+}
+
+func (self *stubRing) GetRingView(unused int, view *ring.RingView) error {
+	*view = self.view
+	return nil
+}
+
+func (self *stubRing) GetDataConsistent(request *data.ConsistentOpArgs, response *ring.RpcResult) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lookups++
+	if self.owner != nil {
+		response.Member = self.owner
+		return nil
+	}
+	response.Success = 1
+	response.Data = *data.NewDataStore(request.DataStore.Key, []byte(self.address))
+	return nil
+}
+
+func (self *stubRing) lookupCount() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.lookups
+}
+
+// Serve stub as "Ring" on a port of its own, the way the ring's machines serve RPC
+func startStub(t *testing.T) *stubRing {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	stub := &stubRing{address: listener.Addr().String()}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Ring", stub); err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, server)
+	return stub
+}
+
+// A machine whose view is out of date sends us on, we ask the one it named and take its view
+func TestFollowRedirect(t *testing.T) {
+	stale, owner := startStub(t), startStub(t)
+	stale.view = ring.RingView{Locations: []data.LocationStore{{Key: 100, Value: stale.address}}}
+	stale.owner = data.NewGroupMember(50, owner.address, 0, 0)
+	owner.view = ring.RingView{Locations: []data.LocationStore{{Key: 100, Value: stale.address}, {Key: 50, Value: owner.address}}}
+
+	client := testClient([]string{stale.address}, stale.view.Locations...)
+	client.Session = ring.NewSession(client)
+
+	item, err := client.Lookup(40, 1)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if string(item.Value) != owner.address {
+		t.Errorf("lookup answered by %q, want %q", item.Value, owner.address)
+	}
+	if stale.lookupCount() != 1 || owner.lookupCount() != 1 {
+		t.Errorf("%d lookups sent to the stale machine and %d to the owner, want 1 each", stale.lookupCount(), owner.lookupCount())
+	}
+
+	//The view is the owner's now, so the next lookup goes straight to it
+	want := []data.LocationStore{{Key: 50, Value: owner.address}, {Key: 100, Value: stale.address}}
+	if got := client.Locations(); !sameLocations(got, want) {
+		t.Errorf("view after the redirect is %v, want %v", got, want)
+	}
+	if address := client.Coordinator(40); address != owner.address {
+		t.Errorf("key 40 goes to %q after the redirect, want %q", address, owner.address)
+	}
+	if _, err := client.Lookup(40, 1); err != nil {
+		t.Fatalf("second lookup: %v", err)
+	}
+	if stale.lookupCount() != 1 {
+		t.Errorf("second lookup went to the stale machine")
+	}
+}
+
+// A Chord machine only tells us about its neighbours, what we knew before is kept. A full view replaces it all
+var viewCases = []struct {
+	name   string
+	before []data.LocationStore
+	view   ring.RingView
+	want   []data.LocationStore
+	chord  bool
+}{
+	{
+		"chord merge",
+		[]data.LocationStore{{Key: 10, Value: "x:1"}, {Key: 20, Value: "y:1"}},
+		ring.RingView{Chord: true, Locations: []data.LocationStore{{Key: 30, Value: "z:1"}, {Key: 20, Value: "y:1"}}},
+		[]data.LocationStore{{Key: 10, Value: "x:1"}, {Key: 20, Value: "y:1"}, {Key: 30, Value: "z:1"}},
+		true,
+	},
+	{
+		"chord from nothing",
+		nil,
+		ring.RingView{Chord: true, Locations: []data.LocationStore{{Key: 30, Value: "z:1"}, {Key: -5, Value: "w:1"}}},
+		[]data.LocationStore{{Key: -5, Value: "w:1"}, {Key: 30, Value: "z:1"}},
+		true,
+	},
+	{
+		"full view",
+		[]data.LocationStore{{Key: 10, Value: "x:1"}, {Key: 20, Value: "y:1"}},
+		ring.RingView{Locations: []data.LocationStore{{Key: 30, Value: "z:1"}, {Key: 20, Value: "y:1"}}},
+		[]data.LocationStore{{Key: 20, Value: "y:1"}, {Key: 30, Value: "z:1"}},
+		false,
+	},
+}
+
+func TestRefreshFrom(t *testing.T) {
+	stub := startStub(t)
+	for _, c := range viewCases {
+		stub.view = c.view
+		client := testClient(nil, c.before...)
+		if err := client.refreshFrom(context.Background(), stub.address); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got := client.Locations(); !sameLocations(got, c.want) || client.chord != c.chord {
+			t.Errorf("%s: got %v chord %v, want %v chord %v", c.name, got, client.chord, c.want, c.chord)
+		}
+	}
+}
+
+func sameLocations(a, b []data.LocationStore) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
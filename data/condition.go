@@ -0,0 +1,65 @@
+package data
+
+import "bytes"
+
+/*
+  What a key has to hold for a conditional write to go ahead. The coordinator
+  checks it against its copy and writes in the same step, so nothing else can
+  be written to the key in between.
+*/
+
+const (
+	IfAbsent  = iota // the key doesn't exist, or was removed
+	IfVersion        // the key holds exactly the versions the clock, a context from a read, describes
+	IfValue          // the key holds a single live version with the value
+)
+
+type Condition struct {
+	Kind  int
+	Clock VectorClock
+	Value []byte
+}
+
+func NewAbsentCondition() *Condition {
+	return &Condition{Kind: IfAbsent}
+}
+
+func NewVersionCondition(clock VectorClock) *Condition {
+	return &Condition{Kind: IfVersion, Clock: clock}
+}
+
+func NewValueCondition(value []byte) *Condition {
+	return &Condition{Kind: IfValue, Value: value}
+}
+
+// Whether the condition holds for what is stored under the key, found is false if nothing is
+func (self *Condition) Holds(existing *DataStore, found bool) bool {
+	switch self.Kind {
+	case IfAbsent:
+		return !found || existing.IsDeleted()
+	case IfVersion:
+		if !found || existing.IsDeleted() {
+			return false
+		}
+		return existing.Context().Compare(self.Clock) == Equal
+	case IfValue:
+		if !found {
+			return false
+		}
+		live := existing.Live()
+		return len(live) == 1 && bytes.Equal(live[0].Value, self.Value)
+	}
+	return false
+}
+
+func (self *Condition) String() string {
+	switch self.Kind {
+	case IfAbsent:
+		return "if absent"
+	case IfVersion:
+		return "if version " + self.Clock.String()
+	case IfValue:
+		return "if value " + Printable(self.Value)
+	}
+	return "unknown condition"
+}
@@ -0,0 +1,47 @@
+package data
+
+import "testing"
+
+var (
+	heldValue   = DataStore{Key: 1, Version: Version{Value: []byte("a"), Clock: VectorClock{"x:1": 1}}}
+	heldRemoved = DataStore{Key: 1, Version: NewTombstone(VectorClock{"x:1": 2})}
+	heldBoth    = DataStore{Key: 1, Version: heldValue.Version, Siblings: []Version{{Value: []byte("b"), Clock: VectorClock{"y:1": 1}}}}
+	heldTwice   = DataStore{Key: 1, Version: heldValue.Version, Siblings: []Version{{Value: []byte("a"), Clock: VectorClock{"y:1": 1}}}}
+)
+
+var conditionCases = []struct {
+	name      string
+	condition *Condition
+	existing  DataStore
+	found     bool
+	holds     bool
+}{
+	{"absent, nothing there", NewAbsentCondition(), DataStore{}, false, true},
+	{"absent, removed", NewAbsentCondition(), heldRemoved, true, true},
+	{"absent, held", NewAbsentCondition(), heldValue, true, false},
+
+	{"version, same clock", NewVersionCondition(VectorClock{"x:1": 1}), heldValue, true, true},
+	{"version, older clock", NewVersionCondition(VectorClock{}), heldValue, true, false},
+	{"version, newer clock", NewVersionCondition(VectorClock{"x:1": 2}), heldValue, true, false},
+	{"version, every sibling seen", NewVersionCondition(VectorClock{"x:1": 1, "y:1": 1}), heldBoth, true, true},
+	{"version, one sibling seen", NewVersionCondition(VectorClock{"x:1": 1}), heldBoth, true, false},
+	{"version, nothing there", NewVersionCondition(VectorClock{}), DataStore{}, false, false},
+	{"version, removed", NewVersionCondition(VectorClock{"x:1": 2}), heldRemoved, true, false},
+
+	{"value, same", NewValueCondition([]byte("a")), heldValue, true, true},
+	{"value, different", NewValueCondition([]byte("b")), heldValue, true, false},
+	{"value, siblings", NewValueCondition([]byte("a")), heldBoth, true, false},
+	{"value, same twice", NewValueCondition([]byte("a")), heldTwice, true, false},
+	{"value, nothing there", NewValueCondition(nil), DataStore{}, false, false},
+	{"value, removed", NewValueCondition(nil), heldRemoved, true, false},
+
+	{"unknown kind", &Condition{Kind: 7}, heldValue, true, false},
+}
+
+func TestConditionHolds(t *testing.T) {
+	for _, c := range conditionCases {
+		if holds := c.condition.Holds(&c.existing, c.found); holds != c.holds {
+			t.Errorf("%s: holds %v, want %v", c.name, holds, c.holds)
+		}
+	}
+}
@@ -1,8 +1,17 @@
 package data
 
+import "time"
+
 type ConsistentOpArgs struct {
 	Consistency int
 	DataStore   *DataStore
+	Caller      string
+
+	//How long the caller waits for the answer, no limit if zero
+	Timeout time.Duration
+
+	//Only write if the key holds this, for conditional writes
+	Condition *Condition
 }
 
 func NewConsistentDataStore(data *DataStore, consistency int) *ConsistentOpArgs {
@@ -1,12 +1,20 @@
 package data
 
-//Value should be changed to be generic
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//A key with its latest version, plus any versions written concurrently with it.
 type DataStore struct {
-	Key   int
-	Value string
+	Key int
+	Version
+	Siblings []Version
 }
 
-func NewDataStore(key int, value string) *DataStore {
+func NewDataStore(key int, value []byte) *DataStore {
 	store := new(DataStore)
 	store.Key = key
 	store.Value = value
@@ -14,5 +22,110 @@ func NewDataStore(key int, value string) *DataStore {
 }
 
 func NilDataStore() DataStore {
-	return *NewDataStore(-1, "")
+	return *NewDataStore(-1, nil)
+}
+
+// All the versions we hold for the key
+func (self *DataStore) Versions() []Version {
+	return append([]Version{self.Version}, self.Siblings...)
+}
+
+// Keep only the given versions, the first one becomes the main version
+func (self *DataStore) SetVersions(versions []Version) {
+	if len(versions) == 0 {
+		self.Version = Version{}
+		self.Siblings = nil
+		return
+	}
+	self.Version = versions[0]
+	self.Siblings = append([]Version{}, versions[1:]...)
+}
+
+// Combine with the versions of the same key held somewhere else
+func (self *DataStore) Merge(other *DataStore) {
+	self.SetVersions(Reconcile(append(self.Versions(), other.Versions()...)))
+}
+
+// What a client has to send back with its next write to replace all the versions it saw
+func (self *DataStore) Context() VectorClock {
+	clock := NewVectorClock()
+	for _, version := range self.Versions() {
+		clock = clock.Merge(version.Clock)
+	}
+	return clock
+}
+
+// Whether both hold exactly the same versions
+func SameVersions(a, b *DataStore) bool {
+	versionsA, versionsB := Reconcile(a.Versions()), Reconcile(b.Versions())
+	if len(versionsA) != len(versionsB) {
+		return false
+	}
+	for i := range versionsA {
+		a, b := versionsA[i], versionsB[i]
+		if a.Clock.Compare(b.Clock) != Equal || !bytes.Equal(a.Value, b.Value) || a.Deleted != b.Deleted {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *DataStore) HasSiblings() bool {
+	return len(self.Siblings) > 0
+}
+
+// The versions that weren't removed and haven't expired
+func (self *DataStore) Live() []Version {
+	now := time.Now()
+	live := make([]Version, 0, len(self.Siblings)+1)
+	for _, version := range self.Versions() {
+		if !version.Deleted && !version.Expired(now) {
+			live = append(live, version)
+		}
+	}
+	return live
+}
+
+// Whether only tombstones and expired values are left, the key is gone for readers
+func (self *DataStore) IsDeleted() bool {
+	return len(self.Live()) == 0
+}
+
+// Whether every value of the key expired, and nothing removed it yet
+func (self *DataStore) Expired() bool {
+	now := time.Now()
+	expired := false
+	for _, version := range self.Versions() {
+		if version.Deleted {
+			continue
+		}
+		if !version.Expired(now) {
+			return false
+		}
+		expired = true
+	}
+	return expired
+}
+
+// When the most recent of the tombstones was written, or the latest value expired
+func (self *DataStore) DeletedSince() time.Time {
+	var latest time.Time
+	now := time.Now()
+	for _, version := range self.Versions() {
+		if version.Deleted && version.DeletedAt.After(latest) {
+			latest = version.DeletedAt
+		}
+		if version.Expired(now) && version.Meta.Expires.After(latest) {
+			latest = version.Meta.Expires
+		}
+	}
+	return latest
+}
+
+func (self DataStore) String() string {
+	versions := make([]string, 0, len(self.Siblings)+1)
+	for _, version := range self.Versions() {
+		versions = append(versions, version.String())
+	}
+	return fmt.Sprintf("%d: %s", self.Key, strings.Join(versions, ", "))
 }
@@ -13,6 +13,25 @@ type GroupMember struct {
 	Id                  int
 	Address             string
 	Heartbeat, Movement int
+
+	//What the failure detector thinks of the machine, the machine bumps its incarnation to refute a suspicion
+	State       int
+	Incarnation int
+}
+
+const (
+	Alive = iota
+	Suspect
+	Dead
+)
+
+var stateNames = []string{"alive", "suspect", "dead"}
+
+func StateName(state int) string {
+	if state < 0 || state >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[state]
 }
 
 // Initialize a new group member
@@ -34,3 +53,22 @@ func (self *GroupMember) SetHeartBeat(heartbeat int) {
 	//log.Println("INFO",fmt.Sprintf("Heartbeat of %s: %d --> %d", self.Address, self.Heartbeat, heartbeat))
 	self.Heartbeat = heartbeat
 }
+
+/*
+  Whether what we heard about a machine is newer than what we know. A higher
+  incarnation wins, at the same incarnation declaring a machine dead or
+  suspecting it wins over thinking it alive. Only the machine itself comes back from the dead, with an
+  incarnation newer than the one it died with, which a machine joining again
+  takes.
+*/
+func (self *GroupMember) Overrides(other *GroupMember) bool {
+	switch {
+	case other.State == Dead:
+		return self.State != Dead && self.Incarnation > other.Incarnation
+	case self.State == Dead:
+		return self.Incarnation >= other.Incarnation
+	case self.State == Suspect && other.State == Alive:
+		return self.Incarnation >= other.Incarnation
+	}
+	return self.Incarnation > other.Incarnation
+}
@@ -1,12 +1,100 @@
 package data
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
 	"math"
 )
 
+/*
+  Hashing of keys and machines onto the ring. Every member of the ring has to
+  use the same Hasher with the same key space, otherwise they won't agree on
+  who owns a key.
+*/
+
+const (
+	DefaultHashFunction = "sha1"
+	DefaultKeySpace     = math.MaxInt64
+)
+
+// Maps a string to a position on the ring, between 0 and KeySpace() - 1
+type Hasher interface {
+	Hash(s string) int
+	KeySpace() int
+}
+
+// Returns the hasher with the given name over a key space of the given size
+func NewHasher(name string, keySpace int) (Hasher, error) {
+	if keySpace <= 0 {
+		return nil, errors.New("key space must be positive")
+	}
+	switch name {
+	case "sha1":
+		return &SHA1Hasher{keySpace}, nil
+	case "sha256":
+		return &SHA256Hasher{keySpace}, nil
+	case "fnv":
+		return &FNVHasher{keySpace}, nil
+	case "fold":
+		return &FoldHasher{keySpace}, nil
+	}
+	return nil, errors.New("unknown hash function " + name)
+}
+
+// Cryptographic hash, SHA-1 truncated to 64 bits
+type SHA1Hasher struct {
+	Space int
+}
+
+func (self *SHA1Hasher) Hash(s string) int {
+	sum := sha1.Sum([]byte(s))
+	return reduce(binary.BigEndian.Uint64(sum[:8]), self.Space)
+}
+
+func (self *SHA1Hasher) KeySpace() int {
+	return self.Space
+}
+
+// Cryptographic hash, SHA-256 truncated to 64 bits
+type SHA256Hasher struct {
+	Space int
+}
+
+func (self *SHA256Hasher) Hash(s string) int {
+	sum := sha256.Sum256([]byte(s))
+	return reduce(binary.BigEndian.Uint64(sum[:8]), self.Space)
+}
+
+func (self *SHA256Hasher) KeySpace() int {
+	return self.Space
+}
+
+// Fast non-cryptographic hash, 64 bit FNV-1a
+type FNVHasher struct {
+	Space int
+}
+
+func (self *FNVHasher) Hash(s string) int {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return reduce(h.Sum64(), self.Space)
+}
+
+func (self *FNVHasher) KeySpace() int {
+	return self.Space
+}
+
 //http://research.cs.vt.edu/AVresearch/hashing/strings.php
-//Takes a string and returns a number between 0 - 1 millions
-func Hasher(s string) (value int) {
+//The original folding hash, kept for clusters that still hash keys this way.
+//Collides easily, don't use it for anything new.
+type FoldHasher struct {
+	Space int
+}
+
+func (self *FoldHasher) Hash(s string) int {
 
 	intLength := len(s) / 4
 	sum := 0
@@ -21,15 +109,34 @@ func Hasher(s string) (value int) {
 		}
 	}
 
-  if len(s) % 4 != 0 {
-    c = s[intLength*4 : ]
-    mult = 1
+	if len(s)%4 != 0 {
+		c = s[intLength*4:]
+		mult = 1
 
-    for k := 0; k < len(c); k++ {
-      sum += int(c[k]) * int(mult)
-      mult *= 256
-    }
-  }
+		for k := 0; k < len(c); k++ {
+			sum += int(c[k]) * int(mult)
+			mult *= 256
+		}
+	}
+
+	return (int)(math.Abs(float64(sum % self.Space)))
+}
+
+func (self *FoldHasher) KeySpace() int {
+	return self.Space
+}
+
+func reduce(sum uint64, space int) int {
+	return int(sum % uint64(space))
+}
 
-	return (int)(math.Abs(float64(sum % 1000000)))
+// Orders two keys without the overflow a plain subtraction has on a large key space
+func CompareKeys(a, b int) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
 }
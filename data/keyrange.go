@@ -0,0 +1,25 @@
+package data
+
+// A stretch of the ring going clockwise from Start (exclusive) to End (inclusive).
+// Wraps around past the largest key when Start >= End, and Start == End is the whole ring.
+type KeyRange struct {
+	Start int
+	End   int
+}
+
+func NewKeyRange(start, end int) *KeyRange {
+	keyRange := new(KeyRange)
+	keyRange.Start = start
+	keyRange.End = end
+	return keyRange
+}
+
+func (self *KeyRange) Contains(key int) bool {
+	if self.Start == self.End {
+		return true
+	}
+	if self.Start < self.End {
+		return key > self.Start && key <= self.End
+	}
+	return key > self.Start || key <= self.End
+}
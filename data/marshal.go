@@ -1,62 +1,271 @@
 package data
 
 import (
-	"../logger"
-	"bytes"
 	"encoding/binary"
-	"fmt"
-	"strconv"
-	"strings"
+	"errors"
+	"hash/crc32"
 )
 
 /*
   This will be responsible for the data conversion. It allows us to take an object like
   GroupMember and change it to an array of bytes to send over UDP. Then, on the other end,
   it should convert these bytes back into the original object.
+
+  Every datagram looks like this, all integers big endian:
+
+    magic    2 bytes   0x4D4B ("MK")
+    version  1 byte    WireVersion
+    type     1 byte    MessageGossip, MessagePing, MessagePingReq, MessageAck or MessagePushPull
+    fields   each one a 2 byte length followed by that many bytes
+    crc      4 bytes   CRC-32 (IEEE) of everything before it
+
+  Integer fields are 8 bytes, strings are their bytes. The first field of every
+  message is the port the sender listens on, the rest depend on the type:
+
+    gossip    sequence number, then one field per member
+    pushpull  exchange number, then one field per member
+    ping      sequence number
+    pingreq   sequence number, address of the machine to ping
+    ack       sequence number
+
+  A member is itself a list of fields: id, address, heartbeat, movement, state
+  and incarnation. Decoders ignore member fields they don't know about, so new
+  ones can be added at the end without a new version.
+
+  Gossip carries as many members as fit in the sender's MTU, a push-pull
+  exchange asks the receiver to answer with gossip of its whole table.
 */
 
 const (
-	delim = "$$$"
+	wireMagic   = 0x4D4B
+	WireVersion = 2
+
+	headerSize   = 4
+	checksumSize = 4
+)
+
+const (
+	MessageGossip = iota + 1
+	MessagePing
+	MessagePingReq
+	MessageAck
+	MessagePushPull
+)
+
+var (
+	ErrTruncated    = errors.New("truncated packet")
+	ErrBadMagic     = errors.New("not a ring packet")
+	ErrBadVersion   = errors.New("unsupported protocol version")
+	ErrBadChecksum  = errors.New("checksum mismatch")
+	ErrUnknownType  = errors.New("unknown message type")
+	ErrMissingField = errors.New("missing field")
 )
 
-// Serialize a GroupMember for transmission over UDP
+// A datagram between two machines
+type Message struct {
+	Type    int
+	Port    string
+	Members []*GroupMember
+	Seq     int
+	Target  string
+}
+
+/*
+  Fields
+*/
+
+func appendField(buf []byte, field []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(field)))
+	return append(buf, field...)
+}
+
+func appendInt(buf []byte, value int) []byte {
+	return appendField(buf, binary.BigEndian.AppendUint64(nil, uint64(value)))
+}
+
+func appendString(buf []byte, value string) []byte {
+	return appendField(buf, []byte(value))
+}
+
+// Reads fields one after the other, remembering the first thing that went wrong
+type fieldReader struct {
+	buf []byte
+	err error
+}
+
+func (self *fieldReader) next() []byte {
+	if self.err != nil {
+		return nil
+	}
+	if len(self.buf) == 0 {
+		self.err = ErrMissingField
+		return nil
+	}
+	if len(self.buf) < 2 {
+		self.err = ErrTruncated
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(self.buf))
+	if len(self.buf) < 2+length {
+		self.err = ErrTruncated
+		return nil
+	}
+	field := self.buf[2 : 2+length]
+	self.buf = self.buf[2+length:]
+	return field
+}
+
+func (self *fieldReader) int() int {
+	field := self.next()
+	if self.err != nil {
+		return 0
+	}
+	if len(field) != 8 {
+		self.err = ErrTruncated
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(field))
+}
+
+func (self *fieldReader) string() string {
+	return string(self.next())
+}
+
+/*
+  Members
+*/
 
-func Marshal(member *GroupMember) (serialized string) {
+// Serialize a GroupMember, nil becomes an empty slice
+func Marshal(member *GroupMember) []byte {
 	if member == nil {
-		return "NIL"
+		return []byte{}
+	}
+
+	buf := make([]byte, 0, 64+len(member.Address))
+	buf = appendInt(buf, member.Id)
+	buf = appendString(buf, member.Address)
+	buf = appendInt(buf, member.Heartbeat)
+	buf = appendInt(buf, member.Movement)
+	buf = appendInt(buf, member.State)
+	buf = appendInt(buf, member.Incarnation)
+	return buf
+}
+
+// Deserialize a GroupMember, an empty slice is nil
+func Unmarshal(serialized []byte) (*GroupMember, error) {
+	if len(serialized) == 0 {
+		return nil, nil
 	}
 
-	buf := new(bytes.Buffer)
-	serialized = fmt.Sprintf("%d%s%s%s%d%s%d", member.Id, delim, member.Address, delim, member.Heartbeat, delim, member.Movement)
-	byteSerialized := []byte(serialized)
-	err := binary.Write(buf, binary.LittleEndian, byteSerialized)
-	if err != nil {
-		fmt.Println("binary.Write failed:", err)
+	reader := &fieldReader{buf: serialized}
+	member := new(GroupMember)
+	member.Id = reader.int()
+	member.Address = reader.string()
+	member.Heartbeat = reader.int()
+	member.Movement = reader.int()
+	member.State = reader.int()
+	member.Incarnation = reader.int()
+	if reader.err != nil {
+		return nil, reader.err
 	}
-	logger.Log("MARSHAL", fmt.Sprintf("<%s, %d> ---> %s", member.Id, member.Heartbeat, serialized))
-	//log.Printf("<%s, %d> ---> %s", member.Id, member.Heartbeat, serialized)
-	return string(buf.Bytes())
+	return member, nil
 }
 
-// Deserialize a transmitted GroupMember
-func Unmarshal(serialized string) (member *GroupMember) {
+/*
+  Datagrams
+*/
+
+func EncodeMessage(msg *Message) []byte {
+	buf := make([]byte, headerSize, 128)
+	binary.BigEndian.PutUint16(buf, wireMagic)
+	buf[2] = WireVersion
+	buf[3] = byte(msg.Type)
 
-	if serialized == "NIL" {
-		return nil
+	buf = appendString(buf, msg.Port)
+	switch msg.Type {
+	case MessageGossip, MessagePushPull:
+		buf = appendInt(buf, msg.Seq)
+		for _, member := range msg.Members {
+			buf = appendField(buf, Marshal(member))
+		}
+	case MessagePing, MessageAck:
+		buf = appendInt(buf, msg.Seq)
+	case MessagePingReq:
+		buf = appendInt(buf, msg.Seq)
+		buf = appendString(buf, msg.Target)
+	}
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// Check and decode a datagram, anything that isn't exactly what we sent is rejected
+func DecodeMessage(packet []byte) (*Message, error) {
+	if len(packet) < headerSize+checksumSize {
+		return nil, ErrTruncated
+	}
+	if binary.BigEndian.Uint16(packet) != wireMagic {
+		return nil, ErrBadMagic
+	}
+	if packet[2] != WireVersion {
+		return nil, ErrBadVersion
+	}
+	body, checksum := packet[:len(packet)-checksumSize], packet[len(packet)-checksumSize:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(checksum) {
+		return nil, ErrBadChecksum
 	}
 
-	byteSerialized := []byte(serialized)
-	buf := bytes.NewBuffer(byteSerialized)
-	err := binary.Read(buf, binary.LittleEndian, &byteSerialized)
-	if err != nil {
-		fmt.Println("binary.Read failed:", err)
+	msg := &Message{Type: int(packet[3])}
+	reader := &fieldReader{buf: body[headerSize:]}
+	msg.Port = reader.string()
+	switch msg.Type {
+	case MessageGossip, MessagePushPull:
+		msg.Seq = reader.int()
+		for reader.err == nil && len(reader.buf) > 0 {
+			member, err := Unmarshal(reader.next())
+			if err != nil {
+				return nil, err
+			}
+			if member != nil {
+				msg.Members = append(msg.Members, member)
+			}
+		}
+	case MessagePing, MessageAck:
+		msg.Seq = reader.int()
+	case MessagePingReq:
+		msg.Seq = reader.int()
+		msg.Target = reader.string()
+	default:
+		return nil, ErrUnknownType
+	}
+	if reader.err != nil {
+		return nil, reader.err
 	}
-	serialized = string(byteSerialized)
-	fields := strings.SplitN(serialized, delim, 4)
-	id, address, hbs, mve := fields[0], fields[1], fields[2], fields[3]
-	hb, _ := strconv.Atoi(hbs)
-	ids, _ := strconv.Atoi(id)
-	mvs, _ := strconv.Atoi(mve)
-	return NewGroupMember(ids, address, hb, mvs)
+	return msg, nil
+}
+
+/*
+  Split the members over as few datagrams of the given type as possible, none
+  of them larger than mtu unless a single member doesn't fit on its own. There
+  is always at least one datagram, a push-pull has to go out even when we know
+  nobody.
+*/
+func PackMembers(msgType int, port string, seq int, members []*GroupMember, mtu int) [][]byte {
+	empty := len(EncodeMessage(&Message{Type: msgType, Port: port, Seq: seq}))
 
+	packets := make([][]byte, 0, 1)
+	batch := make([]*GroupMember, 0, len(members))
+	size := empty
+	for _, member := range members {
+		memberSize := 2 + len(Marshal(member))
+		if len(batch) > 0 && size+memberSize > mtu {
+			packets = append(packets, EncodeMessage(&Message{Type: msgType, Port: port, Seq: seq, Members: batch}))
+			batch = make([]*GroupMember, 0, len(members))
+			size = empty
+		}
+		batch = append(batch, member)
+		size += memberSize
+	}
+	if len(batch) > 0 || len(packets) == 0 {
+		packets = append(packets, EncodeMessage(&Message{Type: msgType, Port: port, Seq: seq, Members: batch}))
+	}
+	return packets
 }
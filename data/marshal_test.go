@@ -0,0 +1,173 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"testing"
+)
+
+var testMembers = []*GroupMember{
+	NewGroupMember(0, "", 0, 0),
+	NewGroupMember(4271642308460732410, "127.0.0.1:5555", 12, 2),
+	NewGroupMember(-1, "10.0.0.7:4567", 0, 1),
+	NewGroupMember(-204, "[::1]:80", -3, 3),
+	{Id: 42, Address: "host:1", Heartbeat: 1, Movement: 2, State: Suspect, Incarnation: 7},
+	{Id: 9223372036854775807, Address: "$$$|%|<PORT>", State: Dead, Incarnation: 1 << 40},
+}
+
+var testMessages = []*Message{
+	{Type: MessageGossip, Port: "5555", Members: testMembers[1:2]},
+	{Type: MessageGossip, Port: "5555", Seq: 2, Members: testMembers},
+	{Type: MessageGossip, Port: ""},
+	{Type: MessagePushPull, Port: "5556", Seq: 9, Members: testMembers[3:]},
+	{Type: MessagePing, Port: "5556", Seq: 1},
+	{Type: MessageAck, Port: "5557", Seq: 1 << 50},
+	{Type: MessagePingReq, Port: "5558", Seq: 3, Target: "127.0.0.1:5559"},
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	for _, member := range testMembers {
+		decoded, err := Unmarshal(Marshal(member))
+		if err != nil {
+			t.Fatalf("%+v: %v", member, err)
+		}
+		if !reflect.DeepEqual(decoded, member) {
+			t.Errorf("got %+v, want %+v", decoded, member)
+		}
+	}
+
+	decoded, err := Unmarshal(Marshal(nil))
+	if decoded != nil || err != nil {
+		t.Errorf("nil member came back as %+v, %v", decoded, err)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, msg := range testMessages {
+		decoded, err := DecodeMessage(EncodeMessage(msg))
+		if err != nil {
+			t.Fatalf("%+v: %v", msg, err)
+		}
+		if !reflect.DeepEqual(decoded, msg) {
+			t.Errorf("got %+v, want %+v", decoded, msg)
+		}
+	}
+}
+
+// Fix the checksum of a packet we changed on purpose, so the decoder looks further
+func resign(packet []byte) []byte {
+	body := packet[:len(packet)-checksumSize]
+	return binary.BigEndian.AppendUint32(append([]byte{}, body...), crc32.ChecksumIEEE(body))
+}
+
+func TestDecodeRejectsBadPackets(t *testing.T) {
+	good := EncodeMessage(testMessages[0])
+
+	badMagic := append([]byte{}, good...)
+	badMagic[0] = 'X'
+	badVersion := append([]byte{}, good...)
+	badVersion[2] = WireVersion + 1
+	flipped := append([]byte{}, good...)
+	flipped[len(flipped)/2] ^= 0x10
+	unknownType := append([]byte{}, good...)
+	unknownType[3] = 99
+	noFields := EncodeMessage(&Message{Type: MessagePing})[:headerSize]
+
+	cases := []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{"empty", nil, ErrTruncated},
+		{"short", good[:5], ErrTruncated},
+		{"old text format", []byte("5555<PORT>GOSSIP|%|1$$$127.0.0.1:5555$$$0$$$2"), ErrBadMagic},
+		{"bad magic", badMagic, ErrBadMagic},
+		{"bad version", badVersion, ErrBadVersion},
+		{"flipped bit", flipped, ErrBadChecksum},
+		{"cut short", good[:len(good)-1], ErrBadChecksum},
+		{"unknown type", resign(unknownType), ErrUnknownType},
+		{"missing fields", resign(append(noFields, 0, 0, 0, 0)), ErrMissingField},
+		{"field past the end", resign(append(append([]byte{}, good[:headerSize]...), 0xff, 0xff, 0, 0, 0, 0)), ErrTruncated},
+	}
+	for _, c := range cases {
+		msg, err := DecodeMessage(c.packet)
+		if err != c.err {
+			t.Errorf("%s: got %+v, %v, want %v", c.name, msg, err, c.err)
+		}
+	}
+}
+
+func TestPackMembers(t *testing.T) {
+	members := make([]*GroupMember, 0, 200)
+	for i := 0; i < 200; i++ {
+		members = append(members, NewGroupMember(i*7919, "10.0.0."+string(rune('0'+i%10))+":4567", i, 2))
+	}
+
+	for _, mtu := range []int{1, 100, 512, 1400, 65507} {
+		packets := PackMembers(MessageGossip, "4567", 0, members, mtu)
+		unpacked := make([]*GroupMember, 0, len(members))
+		for _, packet := range packets {
+			msg, err := DecodeMessage(packet)
+			if err != nil {
+				t.Fatalf("mtu %d: %v", mtu, err)
+			}
+			if len(packet) > mtu && len(msg.Members) > 1 {
+				t.Errorf("mtu %d: %d byte packet with %d members", mtu, len(packet), len(msg.Members))
+			}
+			unpacked = append(unpacked, msg.Members...)
+		}
+		if !reflect.DeepEqual(unpacked, members) {
+			t.Errorf("mtu %d: members did not survive packing into %d packets", mtu, len(packets))
+		}
+		if mtu == 1400 && len(packets) > len(members)/20 {
+			t.Errorf("mtu %d: %d packets for %d members", mtu, len(packets), len(members))
+		}
+	}
+
+	packets := PackMembers(MessagePushPull, "4567", 3, nil, 1400)
+	if len(packets) != 1 {
+		t.Fatalf("push-pull without members should still go out, got %d packets", len(packets))
+	}
+	if msg, err := DecodeMessage(packets[0]); err != nil || msg.Type != MessagePushPull || msg.Seq != 3 {
+		t.Errorf("got %+v, %v", msg, err)
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, member := range testMembers {
+		f.Add(Marshal(member))
+	}
+	f.Fuzz(func(t *testing.T, serialized []byte) {
+		member, err := Unmarshal(serialized)
+		if err != nil || member == nil {
+			return
+		}
+		//Whatever we accept has to survive another round trip
+		again, err := Unmarshal(Marshal(member))
+		if err != nil || !reflect.DeepEqual(again, member) {
+			t.Errorf("%+v came back as %+v, %v", member, again, err)
+		}
+	})
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, msg := range testMessages {
+		f.Add(EncodeMessage(msg))
+	}
+	f.Add([]byte("5555<PORT>GOSSIP|%|NIL"))
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		msg, err := DecodeMessage(packet)
+		if err != nil {
+			return
+		}
+		again, err := DecodeMessage(EncodeMessage(msg))
+		if err != nil || !reflect.DeepEqual(again, msg) {
+			t.Errorf("%+v came back as %+v, %v", msg, again, err)
+		}
+		if !bytes.Equal(EncodeMessage(again), EncodeMessage(msg)) {
+			t.Errorf("%+v encodes differently after a round trip", msg)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package data
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+  What we know about a value besides its bytes. Clients choose the content type,
+  flags and how long the value lives, the coordinator of a write fills in the
+  rest. Expires is the coordinator's time, so every copy expires at once.
+*/
+type Metadata struct {
+	ContentType string
+	Flags       uint32
+	Created     time.Time
+	Modified    time.Time
+	Size        int
+
+	//Zero lives forever
+	TTL     time.Duration
+	Expires time.Time
+}
+
+func (self Metadata) String() string {
+	contentType := self.ContentType
+	if contentType == "" {
+		contentType = "unknown type"
+	}
+	description := fmt.Sprintf("%s, %d bytes, flags %d, created %s, modified %s", contentType, self.Size, self.Flags,
+		self.Created.Format(time.RFC3339), self.Modified.Format(time.RFC3339))
+	if !self.Expires.IsZero() {
+		description += ", expires " + self.Expires.Format(time.RFC3339)
+	}
+	return description
+}
+
+// The value as text if it is text, in hex otherwise
+func Printable(value []byte) string {
+	if !utf8.Valid(value) {
+		return "0x" + hex.EncodeToString(value)
+	}
+	for _, r := range string(value) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return "0x" + hex.EncodeToString(value)
+		}
+	}
+	return string(value)
+}
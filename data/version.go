@@ -0,0 +1,161 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+  Versioning of values. Every write made by a coordinator gets a vector clock
+  with one counter per coordinating machine. Comparing clocks tells us if one
+  write happened after another, or if they were concurrent and both have to be
+  kept until a client resolves them.
+*/
+
+const (
+	Before = iota
+	Equal
+	After
+	Concurrent
+)
+
+type VectorClock map[string]int
+
+func NewVectorClock() VectorClock {
+	return make(VectorClock)
+}
+
+func (self VectorClock) Copy() VectorClock {
+	clock := NewVectorClock()
+	for node, counter := range self {
+		clock[node] = counter
+	}
+	return clock
+}
+
+// Copy of the clock with the given machine's counter moved forward
+func (self VectorClock) Increment(node string) VectorClock {
+	clock := self.Copy()
+	clock[node]++
+	return clock
+}
+
+// The smallest clock that descends from both
+func (self VectorClock) Merge(other VectorClock) VectorClock {
+	clock := self.Copy()
+	for node, counter := range other {
+		if counter > clock[node] {
+			clock[node] = counter
+		}
+	}
+	return clock
+}
+
+// Whether self happened Before, After, Concurrent with or is Equal to other
+func (self VectorClock) Compare(other VectorClock) int {
+	less, greater := false, false
+	for node, counter := range self {
+		if counter > other[node] {
+			greater = true
+		} else if counter < other[node] {
+			less = true
+		}
+	}
+	for node, counter := range other {
+		if _, ok := self[node]; !ok && counter > 0 {
+			less = true
+		}
+	}
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	}
+	return Equal
+}
+
+// Whether everything other has seen, self has seen as well
+func (self VectorClock) Descends(other VectorClock) bool {
+	order := self.Compare(other)
+	return order == After || order == Equal
+}
+
+func (self VectorClock) String() string {
+	nodes := make([]string, 0, len(self))
+	for node := range self {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	counters := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		counters = append(counters, fmt.Sprintf("%s:%d", node, self[node]))
+	}
+	return "[" + strings.Join(counters, " ") + "]"
+}
+
+/*
+  One value of a key together with the clock of the write that produced it.
+  Removing a key writes a tombstone: a version without a value that replaces
+  the versions the remove has seen, like any other write would.
+*/
+type Version struct {
+	Value     []byte
+	Meta      Metadata
+	Clock     VectorClock
+	Deleted   bool
+	DeletedAt time.Time
+}
+
+func NewTombstone(clock VectorClock) Version {
+	return Version{Clock: clock, Deleted: true, DeletedAt: time.Now()}
+}
+
+// Whether the value's time to live ran out by now
+func (self *Version) Expired(now time.Time) bool {
+	return !self.Deleted && !self.Meta.Expires.IsZero() && !now.Before(self.Meta.Expires)
+}
+
+func (self *Version) String() string {
+	if self.Deleted {
+		return "<deleted> " + self.Clock.String()
+	}
+	return Printable(self.Value) + " " + self.Clock.String()
+}
+
+/*
+  Drops every version another one descends from, leaving only the latest
+  versions that are concurrent with each other. The result is in a fixed order
+  so every replica picks the same version to show first.
+*/
+func Reconcile(versions []Version) []Version {
+	latest := make([]Version, 0, len(versions))
+	for i, version := range versions {
+		obsolete := false
+		for j, other := range versions {
+			if i == j {
+				continue
+			}
+			order := version.Clock.Compare(other.Clock)
+			if order == Before || (order == Equal && j < i) {
+				obsolete = true
+				break
+			}
+		}
+		if !obsolete {
+			latest = append(latest, version)
+		}
+	}
+	sort.Sort(byClock(latest))
+	return latest
+}
+
+type byClock []Version
+
+func (a byClock) Len() int           { return len(a) }
+func (a byClock) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byClock) Less(i, j int) bool { return a[i].Clock.String() < a[j].Clock.String() }
@@ -4,66 +4,51 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
   "bufio"
   "strings"
+  "./client"
   "./data"
   "./ring"
-  "./logger"
 )
 
 func main() {
   var (
     dataFile string
-		listenPort     string
 		groupMember    string
   )
 
-	flag.StringVar(&listenPort, "l", "4567", "port to bind for UDP listener")
-	flag.StringVar(&groupMember, "g", "", "address of an existing group member")
+	flag.StringVar(&groupMember, "g", "", "addresses of machines in the ring, comma separated")
   flag.StringVar(&dataFile, "d", "", "The ##-delimited file to initialize the dictionary definitions from")
   flag.Parse()
 
-
-  // Copy-pasted from myks.go
-  //
-	hostPort := getHostPort(listenPort)
-
-	//Add itself to the usertable - join
-	ring, err := ring.NewMember(hostPort, 0)
-
-  ring.ClientMember(hostPort)
-  ring.FirstMember(groupMember)
-
-	go ring.Gossip()
-
-	//UDP
-	go ring.ReceiveDatagrams(false)
-
+	//Talk to the ring without joining it
+	dictionary, err := client.New(strings.Split(groupMember, ","))
 	if err != nil {
-		fmt.Println("Ring addition failed:", err)
-		logger.Log("FAILURE", "Ring could not be created")
+		log.Fatal("connecting:", err)
 	}
 
-
   // Initialize the cluster with the data
   if dataFile != "" {
     log.Printf("Loading data from %s", dataFile)
-    loadDataFile(dataFile, ring)
+    if err := loadDataFile(dataFile, dictionary); err != nil {
+      log.Fatal("loading data:", err)
+    }
   }
 
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		query := strings.TrimSpace(scanner.Text())
-    key := data.Hasher(query)
-    ring.Lookup(key, 0)
-
 		if query == "leave" {
-			fmt.Println("Leaving Group")
-			ring.LeaveGroup()
 			goto Done
 		}
+
+    key := dictionary.Hash(query)
+    if item, err := dictionary.Lookup(key, 0); err != nil {
+      fmt.Println(err)
+    } else {
+      ring.PrintItem(item)
+    }
 	}
 Done:
 	if err := scanner.Err(); err != nil {
@@ -74,39 +59,47 @@ Done:
 }
 
 
-func loadDataFile(path string, serverRing *ring.Ring) error {
+// Words sent to the ring at once while loading
+const loadBatchSize = 500
+
+func loadDataFile(path string, dictionary *client.Client) error {
   file, err := os.Open(path)
   if err != nil {
     return err
   }
   defer file.Close()
 
+  batch := make([]data.DataStore, 0, loadBatchSize)
+  words := make(map[int]string)
+  flush := func() {
+    for _, result := range dictionary.MultiPut(batch, 0) {
+      if result.Err != nil {
+        log.Println(words[result.Key], result.Err)
+      }
+    }
+    log.Printf("Inserted %d words", len(batch))
+    batch = batch[:0]
+  }
+
   scanner := bufio.NewScanner(file)
   for scanner.Scan() {
 		kv := strings.SplitN(scanner.Text(), "##", 2)
+    if len(kv) != 2 {
+      continue
+    }
     word, def := kv[0], kv[1]
-    key := data.Hasher(word)
-
-    log.Printf("Inserting %s (%s)", word, key)
-    serverRing.Insert(key, def, 0)
+    key := dictionary.Hash(word)
+    words[key] = word
+
+    item := data.NewDataStore(key, []byte(def))
+    item.Meta = data.Metadata{ContentType: "text/plain"}
+    batch = append(batch, *item)
+    if len(batch) == loadBatchSize {
+      flush()
+    }
+  }
+  if len(batch) > 0 {
+    flush()
   }
   return scanner.Err()
 }
-
-
-
-
-func getHostPort(port string) (hostPort string) {
-	name, err := os.Hostname()
-	if err != nil {
-		fmt.Printf("Oops: %v\n", err)
-		return
-	}
-	addrs, err := net.LookupHost(name)
-	if err != nil {
-		fmt.Printf("Oops: %v\n", err)
-		return
-	}
-	hostPort = net.JoinHostPort(addrs[0], port)
-	return hostPort
-}
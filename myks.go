@@ -1,14 +1,23 @@
 package main
 
 import (
+	"./client"
+	"./data"
 	"./logger"
 	"./ring"
 	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -22,41 +31,90 @@ func main() {
 		listenPort     string
 		groupMember    string
 		faultTolerance int
-		client         int
+		clientMode     int
+		hashFunction   string
+		keySpace       int
+		virtualNodes   int
+		chord          bool
+		tombstoneGrace time.Duration
+		dataDir        string
+		fsync          string
+		mtu            int
+		replicas       int
+		timeout        time.Duration
 	)
 
 	flag.StringVar(&listenPort, "l", "4567", "port to bind for UDP listener")
-	flag.IntVar(&client, "c", 0, "Use 1 if you are a client")
-	flag.StringVar(&groupMember, "g", "", "address of an existing group member")
+	flag.IntVar(&clientMode, "c", 0, "Use 1 to talk to the ring given by -g (comma separated addresses) without joining it")
+	flag.StringVar(&groupMember, "g", "", "address of an existing group member, or with -c 1 the addresses of machines in the ring, comma separated")
 	flag.IntVar(&faultTolerance, "f", 0, "Use fault tolerance")
+	flag.StringVar(&hashFunction, "hash", data.DefaultHashFunction, "hash function of a new ring: sha1, sha256, fnv or fold")
+	flag.IntVar(&keySpace, "keyspace", data.DefaultKeySpace, "number of positions on a new ring")
+	flag.IntVar(&virtualNodes, "vnodes", ring.DefaultVirtualNodes, "positions each machine takes on a new ring")
+	flag.BoolVar(&chord, "chord", false, "route with chord finger tables on a new ring instead of gossiping the whole table")
+	flag.DurationVar(&tombstoneGrace, "grace", time.Hour, "how long removed keys are remembered on a new ring")
+	flag.StringVar(&dataDir, "data", "", "directory to keep this machine's data in across restarts, kept in memory only if empty")
+	flag.StringVar(&fsync, "fsync", "batched", "when the write-ahead log is synced to disk: always, batched or never")
+	flag.IntVar(&replicas, "replicas", ring.DefaultReplicas, "machines holding a copy of each key on a new ring")
+	flag.IntVar(&mtu, "mtu", 1400, "largest gossip datagram this machine sends, in bytes")
+	flag.DurationVar(&timeout, "timeout", 0, "how long a command may take before it gives up, no limit if 0")
 	flag.Parse()
 
+	//Clients only talk to the ring, they don't become part of it
+	if clientMode == 1 {
+		if groupMember == "" {
+			fmt.Println("There are no servers for you")
+			return
+		}
+		kv, err := client.New(strings.Split(groupMember, ","))
+		if err != nil {
+			log.Fatal("connecting:", err)
+		}
+		runCommands(kv, nil, timeout)
+		return
+	}
+
 	log.Println("Start server on port", listenPort)
 	log.Println("Fault Tolernace", faultTolerance)
 
 	hostPort := getHostPort(listenPort)
-	fmt.Println(client)
 	//logger.Log("INFO", "Start Server on Port"+listenPort)
 
+	//Only used when starting a new ring, joiners take the settings of the ring
+	config := &ring.Config{HashFunction: hashFunction, KeySpace: keySpace, VirtualNodes: virtualNodes, Chord: chord,
+		TombstoneGrace: tombstoneGrace, Replicas: replicas}
+
+	policy, err := ring.ParseSyncPolicy(fsync)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if mtu < 1 || mtu > ring.MaxDatagram {
+		log.Fatal("mtu has to be between 1 and ", ring.MaxDatagram)
+	}
+
 	//Add itself to the usertable - join
 	ring, err := ring.NewMember(hostPort, faultTolerance)
+	if err != nil {
+		log.Fatal("creating member:", err)
+	}
+	ring.MTU = mtu
+
+	if dataDir != "" {
+		if err := ring.OpenStorage(dataDir, policy); err != nil {
+			log.Fatal("opening data directory:", err)
+		}
+		defer ring.Storage.Close()
+	}
 
 	firstInGroup := groupMember == ""
 	if !firstInGroup {
-		if client == 1 {
-			fmt.Println("YEs")
-			ring.ClientMember(hostPort)
-			ring.FirstMember(groupMember)
-		} else {
-
-			ring.JoinGroup(groupMember)
-			logger.Log("JOIN", "Gossiping new member to the group")
-
+		if err := ring.JoinGroup(groupMember); err != nil {
+			log.Fatal("joining:", err)
 		}
+		logger.Log("JOIN", "Gossiping new member to the group")
 	} else {
-		if client == 1 {
-			fmt.Println("There are no servers for you")
-			return
+		if err := ring.Configure(config); err != nil {
+			log.Fatal("configuring ring:", err)
 		}
 		ring.FirstMember(hostPort)
 	}
@@ -65,12 +123,38 @@ func main() {
 	//UDP
 	go ring.ReceiveDatagrams(firstInGroup)
 
-	if err != nil {
-		fmt.Println("Ring addition failed:", err)
-		logger.Log("FAILURE", "Ring could not be created")
-	}
+	runCommands(ring, ring, timeout)
+}
+
+// The operations clients and members of the ring both have
+type keyValueStore interface {
+	InsertContext(ctx context.Context, key int, val []byte, meta data.Metadata, consistency int) error
+	UpdateContext(ctx context.Context, key int, val []byte, meta data.Metadata, consistency int) error
+	RemoveContext(ctx context.Context, key int, consistency int) error
+	LookupContext(ctx context.Context, key int, consistency int) (data.DataStore, error)
+	ScanContext(ctx context.Context, cursor ring.ScanCursor, limit, consistency int) (ring.ScanPage, error)
+	MultiGetContext(ctx context.Context, keys []int, consistency int) []ring.MultiResult
+	MultiPutContext(ctx context.Context, items []data.DataStore, consistency int) []ring.MultiResult
+	MultiDeleteContext(ctx context.Context, keys []int, consistency int) []ring.MultiResult
+	PutIfAbsentContext(ctx context.Context, key int, val []byte, meta data.Metadata, consistency int) (data.DataStore, error)
+	CompareAndSwapContext(ctx context.Context, key int, expected data.VectorClock, val []byte, meta data.Metadata, consistency int) (data.DataStore, error)
+	CompareAndSwapValueContext(ctx context.Context, key int, expected []byte, val []byte, meta data.Metadata, consistency int) (data.DataStore, error)
+	DeleteIfVersionContext(ctx context.Context, key int, expected data.VectorClock, consistency int) (data.DataStore, error)
+	Seen(key int) data.VectorClock
+	Watch(ctx context.Context, low, high int, token string) (<-chan ring.WatchEvent, error)
+	CommitContext(ctx context.Context, txn *ring.Transaction, consistency int) error
+}
 
+// Commands about the machine itself, a client has nothing to show for them
+var memberCommands = map[string]bool{
+	"leave": true, "show": true, "history": true, "replicas": true, "namespace": true,
+}
+
+// Run the commands typed on stdin, node is nil for a client. Each one gets timeout to finish, if there is one
+func runCommands(kv keyValueStore, node *ring.Ring, timeout time.Duration) {
 	scanner := bufio.NewScanner(os.Stdin)
+	watches := make([]context.CancelFunc, 0)
+	var txn *ring.Transaction
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		words := strings.SplitN(line, " ", 4)
@@ -93,27 +177,247 @@ func main() {
 		}
 
 
+		if len(words) < 2 {
+			continue
+		}
+		if node == nil && memberCommands[words[1]] {
+			fmt.Println("Only machines in the ring can", words[1])
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), timeout)
+		}
+
 		switch words[1] {
 		case "insert":
-			ring.Insert(ikey, val, consistency)
+			report(kv.InsertContext(ctx, ikey, []byte(val), data.Metadata{ContentType: "text/plain"}, consistency))
 		case "update":
-			ring.Update(ikey, val, consistency)
+			report(kv.UpdateContext(ctx, ikey, []byte(val), data.Metadata{ContentType: "text/plain"}, consistency))
+		case "insertttl", "updatettl":
+			//consistency insertttl key duration text
+			fields := strings.SplitN(val, " ", 2)
+			ttl, err := time.ParseDuration(fields[0])
+			if err != nil || ttl <= 0 || len(fields) != 2 {
+				fmt.Println("Usage: 0 insertttl|updatettl 'key' 'duration' 'text', e.g. 30s")
+				break
+			}
+			meta := data.Metadata{ContentType: "text/plain", TTL: ttl}
+			if words[1] == "insertttl" {
+				report(kv.InsertContext(ctx, ikey, []byte(fields[1]), meta, consistency))
+			} else {
+				report(kv.UpdateContext(ctx, ikey, []byte(fields[1]), meta, consistency))
+			}
+		case "insertfile", "updatefile":
+			value, meta, err := readValueFile(val)
+			if err != nil {
+				fmt.Println("Could not read", val, err)
+			} else if words[1] == "insertfile" {
+				report(kv.InsertContext(ctx, ikey, value, meta, consistency))
+			} else {
+				report(kv.UpdateContext(ctx, ikey, value, meta, consistency))
+			}
+		case "inserthex", "updatehex":
+			value, err := hex.DecodeString(val)
+			if err != nil {
+				fmt.Println("Not a hex value:", err)
+			} else if words[1] == "inserthex" {
+				report(kv.InsertContext(ctx, ikey, value, data.Metadata{ContentType: "application/octet-stream"}, consistency))
+			} else {
+				report(kv.UpdateContext(ctx, ikey, value, data.Metadata{ContentType: "application/octet-stream"}, consistency))
+			}
 		case "remove":
-			ring.Remove(ikey, consistency)
+			report(kv.RemoveContext(ctx, ikey, consistency))
 		case "lookup":
 			start := time.Now()
-			ring.Lookup(ikey, consistency)
+			item, err := kv.LookupContext(ctx, ikey, consistency)
 			elapsed := time.Now().Sub(start)
+			if err != nil {
+				report(err)
+			} else {
+				ring.PrintItem(item)
+			}
 			fmt.Println("ELAPSED TIME:", elapsed)
+		case "lookupfile":
+			//Only a tombstone may be left, or the value may have expired since
+			if item, err := kv.LookupContext(ctx, ikey, consistency); err != nil {
+				report(err)
+			} else if live := item.Live(); len(live) == 0 {
+				report(ring.NewOpError("lookup", ikey, "", ring.ErrNotFound))
+			} else if err := ioutil.WriteFile(val, live[0].Value, 0644); err != nil {
+				fmt.Println("Could not write", val, err)
+			} else {
+				fmt.Println("Wrote", len(live[0].Value), "bytes to", val)
+			}
+		case "scan", "rscan", "scannext":
+			//consistency scan start end limit, or scannext token limit
+			fields := strings.Fields(line)
+			var cursor ring.ScanCursor
+			var start, end, limit int
+			var err error
+			if words[1] == "scannext" && len(fields) == 4 {
+				cursor, err = ring.ParseScanToken(fields[2])
+				_, scanErr := fmt.Sscan(fields[3], &limit)
+				if err == nil {
+					err = scanErr
+				}
+			} else if words[1] != "scannext" && len(fields) == 5 {
+				_, err = fmt.Sscan(strings.Join(fields[2:], " "), &start, &end, &limit)
+				cursor = ring.NewScanCursor(start, end, words[1] == "rscan")
+			} else {
+				fmt.Println("Usage: 0 scan|rscan 'start' 'end' 'limit', or 0 scannext 'token' 'limit'")
+				break
+			}
+			if err != nil {
+				fmt.Println("Not a scan:", err)
+				break
+			}
+			page, err := kv.ScanContext(ctx, cursor, limit, consistency)
+			for _, item := range page.Items {
+				ring.PrintItem(item)
+			}
+			report(err)
+			if page.Token != "" {
+				fmt.Println("Next page:", page.Token)
+			} else {
+				fmt.Println("End of range,", len(page.Items), "keys")
+			}
+		case "mget", "mdelete":
+			//consistency mget key key ...
+			keys := make([]int, 0)
+			for _, field := range strings.Fields(line)[2:] {
+				key, err := strconv.Atoi(field)
+				if err != nil {
+					fmt.Println("Not a key:", field)
+					continue
+				}
+				keys = append(keys, key)
+			}
+			var results []ring.MultiResult
+			if words[1] == "mget" {
+				results = kv.MultiGetContext(ctx, keys, consistency)
+			} else {
+				results = kv.MultiDeleteContext(ctx, keys, consistency)
+			}
+			printResults(results, words[1] == "mget")
+		case "mput":
+			//consistency mput key value key value ...
+			fields := strings.Fields(line)[2:]
+			items := make([]data.DataStore, 0, len(fields)/2)
+			for i := 0; i+1 < len(fields); i += 2 {
+				key, err := strconv.Atoi(fields[i])
+				if err != nil {
+					fmt.Println("Not a key:", fields[i])
+					continue
+				}
+				item := data.NewDataStore(key, []byte(fields[i+1]))
+				item.Meta = data.Metadata{ContentType: "text/plain"}
+				items = append(items, *item)
+			}
+			printResults(kv.MultiPutContext(ctx, items, consistency), false)
+		case "putifabsent":
+			printConditional(kv.PutIfAbsentContext(ctx, ikey, []byte(val), data.Metadata{ContentType: "text/plain"}, consistency))
+		case "cas":
+			//consistency cas key old new
+			values := strings.SplitN(val, " ", 2)
+			if len(values) != 2 {
+				fmt.Println("Usage: 0 cas 'key' 'old' 'new'")
+				break
+			}
+			printConditional(kv.CompareAndSwapValueContext(ctx, ikey, []byte(values[0]), []byte(values[1]), data.Metadata{ContentType: "text/plain"}, consistency))
+		case "casv":
+			printConditional(kv.CompareAndSwapContext(ctx, ikey, kv.Seen(ikey), []byte(val), data.Metadata{ContentType: "text/plain"}, consistency))
+		case "deleteif":
+			printConditional(kv.DeleteIfVersionContext(ctx, ikey, kv.Seen(ikey), consistency))
+		case "watch", "watchfrom":
+			//consistency watch key, consistency watch low high, or consistency watchfrom token
+			fields := strings.Fields(line)[2:]
+			low, high, token := ikey, ikey+1, ""
+			var err error
+			if words[1] == "watchfrom" && len(fields) == 1 {
+				token = fields[0]
+			} else if words[1] == "watch" && len(fields) == 2 {
+				high, err = strconv.Atoi(fields[1])
+			} else if words[1] != "watch" || len(fields) != 1 {
+				fmt.Println("Usage: 0 watch 'key', 0 watch 'start' 'end' or 0 watchfrom 'token'")
+				break
+			}
+			if err != nil {
+				fmt.Println("Not a key:", err)
+				break
+			}
+			//The watch outlives the command, unwatch stops it
+			watchCtx, stop := context.WithCancel(context.Background())
+			events, err := kv.Watch(watchCtx, low, high, token)
+			if err != nil {
+				stop()
+				report(err)
+				break
+			}
+			watches = append(watches, stop)
+			go printWatch(events)
+		case "unwatch":
+			for _, stop := range watches {
+				stop()
+			}
+			watches = watches[:0]
+		case "begin":
+			txn = ring.NewTransaction()
+			fmt.Println("Transaction", txn.Id)
+		case "tput", "tdelete":
+			if txn == nil {
+				fmt.Println("No transaction, begin one first")
+			} else if words[1] == "tput" {
+				txn.Put(ikey, []byte(val), data.Metadata{ContentType: "text/plain"})
+			} else {
+				txn.Delete(ikey)
+			}
+		case "commit":
+			if txn == nil {
+				fmt.Println("No transaction, begin one first")
+				break
+			}
+			if err := kv.CommitContext(ctx, txn, consistency); err != nil {
+				report(err)
+			} else {
+				fmt.Println("Committed", len(txn.Writes), "writes")
+			}
+			txn = nil
+		case "discard":
+			txn = nil
 		case "leave":
 			fmt.Println("Leaving Group")
-			ring.LeaveGroup()
+			report(node.LeaveGroupContext(ctx))
+			cancel()
 			goto Done
 		case "show":
-			ring.PrintMembers()
-			ring.PrintData()
-      ring.CmdLog.Print()
+			node.PrintMembers()
+			node.PrintReplication()
+			node.PrintData()
+			node.CmdLog.Print()
+			node.PrintHints()
+			node.PrintTransactions()
+			ring.PrintConnections()
+		case "history":
+			node.PrintKeyHistory(ikey)
+		case "replicas":
+			if err := node.SetReplicas(ikey); err != nil {
+				fmt.Println("Could not change replication:", err)
+			}
+		case "namespace":
+			//consistency namespace name start end copies, 0 copies removes it
+			fields := strings.Fields(line)
+			var start, end, copies int
+			if len(fields) != 6 {
+				fmt.Println("Usage: 0 namespace 'name' 'start' 'end' 'copies'")
+			} else if _, err := fmt.Sscan(strings.Join(fields[3:], " "), &start, &end, &copies); err != nil {
+				fmt.Println("Not a namespace:", err)
+			} else if err := node.SetNamespace(fields[2], data.KeyRange{start, end}, copies); err != nil {
+				fmt.Println("Could not change replication:", err)
+			}
 		}
+		cancel()
 	}
 Done:
 	if err := scanner.Err(); err != nil {
@@ -122,6 +426,66 @@ Done:
 
 }
 
+//Every change as it comes, and where to pick up once the watch is stopped
+func printWatch(events <-chan ring.WatchEvent) {
+	cursor := ""
+	for event := range events {
+		fmt.Println("WATCH", event)
+		cursor = event.Cursor
+	}
+	if cursor != "" {
+		fmt.Println("Watch stopped, resume with: watchfrom", cursor)
+	} else {
+		fmt.Println("Watch stopped")
+	}
+}
+
+//How every key of a batch turned out
+func printResults(results []ring.MultiResult, values bool) {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Println(result.Err)
+		} else if values {
+			ring.PrintItem(result.Data)
+		}
+	}
+	fmt.Println(len(results)-failed, "of", len(results), "keys done")
+}
+
+//A failed condition shows what the key holds instead
+func printConditional(item data.DataStore, err error) {
+	report(err)
+	if errors.Is(err, ring.ErrConditionFailed) {
+		if item.IsDeleted() {
+			fmt.Println("The key holds nothing")
+		} else {
+			ring.PrintItem(item)
+		}
+	}
+}
+
+//Operations only tell us something when they fail
+func report(err error) {
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+//The contents of a file to store, typed after its extension or its first bytes
+func readValueFile(path string) ([]byte, data.Metadata, error) {
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, data.Metadata{}, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(value)
+	}
+	return value, data.Metadata{ContentType: contentType}, nil
+}
+
 func getHostPort(port string) (hostPort string) {
 
 	name, err := os.Hostname()
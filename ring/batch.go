@@ -0,0 +1,499 @@
+package ring
+
+import (
+	"../data"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+  Operations on many keys at once. The keys are grouped by the machine that
+  coordinates them and every machine gets one request with all of its keys,
+  all of them at the same time. The coordinator writes its keys and sends them
+  on to the other replicas in one batch per replica, or reads them with one
+  request per replica. Every key gets its own result, a key that failed doesn't
+  fail the others.
+*/
+
+// How a key of a batch turned out
+type MultiResult struct {
+	Key  int
+	Data data.DataStore
+	Err  error
+}
+
+type BatchRequest struct {
+	Items       []data.DataStore
+	Consistency int
+	Caller      string
+	Timeout     time.Duration
+}
+
+type BatchResult struct {
+	Results []KeyResult
+}
+
+type KeyResult struct {
+	Key    int
+	Data   data.DataStore
+	Error  *RpcError
+	Member *data.GroupMember
+}
+
+/*
+  Sending batches
+*/
+
+/*
+  Send every item to the machine route gives for its key, one request per
+  machine. Keys a machine sends us on from are sent again to where it says,
+  after learn has been told about the machine.
+*/
+func sendBatch(ctx context.Context, op, function string, items []data.DataStore, consistency int, caller string,
+	route func(key int) string, learn func(member *data.GroupMember)) []MultiResult {
+	results := make([]MultiResult, len(items))
+	pending := make([]int, len(items))
+	for i := range items {
+		results[i].Key = items[i].Key
+		pending[i] = i
+	}
+
+	for round := 0; len(pending) > 0 && round <= maxRedirects; round++ {
+		groups := make(map[string][]int)
+		for _, i := range pending {
+			address := route(items[i].Key)
+			groups[address] = append(groups[address], i)
+		}
+
+		redirected := make([]int, 0)
+		newer := make([]*data.GroupMember, 0)
+		var lock sync.Mutex
+		var wait sync.WaitGroup
+		for address, indices := range groups {
+			wait.Add(1)
+			go func(address string, indices []int) {
+				defer wait.Done()
+				request := &BatchRequest{Items: make([]data.DataStore, 0, len(indices)), Consistency: consistency, Caller: caller}
+				for _, i := range indices {
+					request.Items = append(request.Items, items[i])
+				}
+				if deadline, ok := ctx.Deadline(); ok {
+					request.Timeout = time.Until(deadline)
+				}
+				var result BatchResult
+				err := callMachineContext(ctx, address, function, request, &result)
+				if err == nil && len(result.Results) != len(indices) {
+					err = fmt.Errorf("%d results for %d keys", len(result.Results), len(indices))
+				}
+
+				lock.Lock()
+				defer lock.Unlock()
+				for j, i := range indices {
+					key := items[i].Key
+					if err != nil {
+						results[i].Err = NewOpError(op, key, address, err)
+						continue
+					}
+					answer := result.Results[j]
+					if answer.Member != nil {
+						redirected = append(redirected, i)
+						newer = append(newer, answer.Member)
+						continue
+					}
+					results[i].Data = answer.Data
+					results[i].Err = nil
+					if answer.Error != nil {
+						results[i].Err = NewOpError(op, key, address, answer.Error.Unpack())
+					}
+				}
+			}(address, indices)
+		}
+		wait.Wait()
+
+		for _, member := range newer {
+			learn(member)
+		}
+		pending = redirected
+	}
+	for _, i := range pending {
+		results[i].Err = NewOpError(op, items[i].Key, "", ErrRedirectLoop)
+	}
+	return results
+}
+
+// Send the items to their coordinators, and the ones that couldn't be reached again once the router looked again
+func (self *Session) runBatch(ctx context.Context, op, function string, items []data.DataStore, consistency int) []MultiResult {
+	learn := func(member *data.GroupMember) {
+		self.router.Follow(ctx, member)
+	}
+	caller := self.router.Caller()
+	results := sendBatch(ctx, op, function, items, consistency, caller, self.router.Coordinator, learn)
+
+	retry := make([]int, 0)
+	for i, result := range results {
+		if Retryable(function, result.Err) {
+			retry = append(retry, i)
+		}
+	}
+	if len(retry) == 0 || ctx.Err() != nil || self.router.Reload(ctx) != nil {
+		return results
+	}
+	again := make([]data.DataStore, len(retry))
+	for j, i := range retry {
+		again[j] = items[i]
+	}
+	for j, result := range sendBatch(ctx, op, function, again, consistency, caller, self.router.Coordinator, learn) {
+		results[retry[j]] = result
+	}
+	return results
+}
+
+// The keys as items to send, with nothing but the key set
+func keyItems(keys []int) []data.DataStore {
+	items := make([]data.DataStore, len(keys))
+	for i, key := range keys {
+		items[i] = *data.NewDataStore(key, nil)
+	}
+	return items
+}
+
+//Every version of each key, remembering their context for the next Update
+func (self *Session) MultiGet(keys []int, consistency int) []MultiResult {
+	return self.MultiGetContext(context.Background(), keys, consistency)
+}
+
+func (self *Session) MultiGetContext(ctx context.Context, keys []int, consistency int) []MultiResult {
+	results := self.runBatch(ctx, "lookup", "Ring.MultiGetData", keyItems(keys), consistency)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, result := range results {
+		if result.Err == nil {
+			self.contexts[result.Key] = result.Data.Context()
+		}
+	}
+	return results
+}
+
+/*
+  Write each item whether or not its key exists. An item without a clock
+  replaces the versions seen by our last Lookup of its key, one with a clock
+  the versions that clock describes.
+*/
+func (self *Session) MultiPut(items []data.DataStore, consistency int) []MultiResult {
+	return self.MultiPutContext(context.Background(), items, consistency)
+}
+
+func (self *Session) MultiPutContext(ctx context.Context, items []data.DataStore, consistency int) []MultiResult {
+	sent := make([]data.DataStore, len(items))
+	self.lock.Lock()
+	for i, item := range items {
+		sent[i] = item
+		if len(item.Clock) == 0 {
+			sent[i].Clock = self.contexts[item.Key]
+		}
+	}
+	self.lock.Unlock()
+	results := self.runBatch(ctx, "put", "Ring.MultiPutData", sent, consistency)
+	for i, result := range results {
+		if result.Err == nil {
+			self.rememberWrite(&result.Data, sent[i].Value, sent[i].Clock)
+		}
+	}
+	return results
+}
+
+func (self *Session) MultiDelete(keys []int, consistency int) []MultiResult {
+	return self.MultiDeleteContext(context.Background(), keys, consistency)
+}
+
+func (self *Session) MultiDeleteContext(ctx context.Context, keys []int, consistency int) []MultiResult {
+	return self.runBatch(ctx, "remove", "Ring.MultiDeleteData", keyItems(keys), consistency)
+}
+
+/*
+  Coordinating batches, exposed over RPC
+*/
+
+// Where to send a key we don't coordinate, or why nobody can have it
+func (self *Ring) redirect(key int, result *KeyResult) {
+	result.Member = self.getMember(self.getMachineForKey(key).Value)
+	if result.Member == nil {
+		result.Error = NewRpcError(ErrUnavailable)
+	}
+}
+
+// Every version of the keys, read from as many of their replicas as the consistency level needs
+func (self *Ring) MultiGetData(request *BatchRequest, response *BatchResult) error {
+	ctx, cancel := requestContext(request.Timeout)
+	defer cancel()
+
+	response.Results = make([]KeyResult, len(request.Items))
+	keys := make([]int, 0, len(request.Items))
+	positions := make([]int, 0, len(request.Items))
+	for i, item := range request.Items {
+		response.Results[i].Key = item.Key
+		//Only a machine holding a copy of the key can coordinate the read
+		if !self.isReplicaFor(item.Key) {
+			self.redirect(item.Key, &response.Results[i])
+			continue
+		}
+		keys = append(keys, item.Key)
+		positions = append(positions, i)
+	}
+
+	for j, read := range self.readBatchFromReplicas(ctx, keys, request.Consistency) {
+		result := &response.Results[positions[j]]
+		merged, found := mergeReads(read.key, read.reads)
+		var err error
+		if len(read.reads) < read.needed {
+			err = progressError(ctx, len(read.reads), read.needed, "replicas answered")
+		} else if !found || merged.IsDeleted() {
+			err = ErrNotFound
+		} else {
+			result.Data = merged
+		}
+		result.Error = NewRpcError(err)
+		if found {
+			go self.readRepair(&merged, read.reads)
+		}
+		self.logRead(&request.Items[positions[j]], request.Consistency, request.Caller, &RpcResult{Success: Btoi(err == nil), Data: result.Data})
+	}
+	return nil
+}
+
+// Write the items we coordinate, then send them to their replicas
+func (self *Ring) MultiPutData(request *BatchRequest, response *BatchResult) error {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	return self.coordinateBatch(request, response, WriteOp, func(item *data.DataStore, result *KeyResult) (data.DataStore, bool) {
+		if self.getMachineForKey(item.Key).Value != myAddr {
+			self.redirect(item.Key, result)
+			return data.DataStore{}, false
+		}
+		return self.batchWrite(item, result)
+	})
+}
+
+// Write a tombstone over every version of the keys we coordinate, if they hold a live one
+func (self *Ring) MultiDeleteData(request *BatchRequest, response *BatchResult) error {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	return self.coordinateBatch(request, response, RemoveOp, func(item *data.DataStore, result *KeyResult) (data.DataStore, bool) {
+		if self.getMachineForKey(item.Key).Value != myAddr {
+			self.redirect(item.Key, result)
+			return data.DataStore{}, false
+		}
+		stored, err := self.coordinateExisting(item, true)
+		if err != nil {
+			result.Error = NewRpcError(err)
+			return data.DataStore{}, false
+		}
+		return stored, true
+	})
+}
+
+// coordinateWrite for a key of a batch, the key fails on its own if it can't be written
+func (self *Ring) batchWrite(item *data.DataStore, result *KeyResult) (data.DataStore, bool) {
+	stored, err := self.coordinateWrite(item)
+	if err != nil {
+		result.Error = NewRpcError(err)
+		return data.DataStore{}, false
+	}
+	return stored, true
+}
+
+/*
+  Have write store each item it can, then replicate everything stored in one
+  batch per replica. A key is written once as many copies as the consistency
+  level asks for have it.
+*/
+func (self *Ring) coordinateBatch(request *BatchRequest, response *BatchResult, op int,
+	write func(item *data.DataStore, result *KeyResult) (data.DataStore, bool)) error {
+	ctx, cancel := requestContext(request.Timeout)
+	defer cancel()
+
+	response.Results = make([]KeyResult, len(request.Items))
+	stored := make([]data.DataStore, 0, len(request.Items))
+	positions := make([]int, 0, len(request.Items))
+	for i := range request.Items {
+		response.Results[i].Key = request.Items[i].Key
+		if item, ok := write(&request.Items[i], &response.Results[i]); ok {
+			stored = append(stored, item)
+			positions = append(positions, i)
+		}
+	}
+
+	acked := self.replicateBatch(ctx, stored)
+	for j, item := range stored {
+		result := &response.Results[positions[j]]
+		result.Data = item
+		needed := copiesNeeded(request.Consistency, self.replicasFor(item.Key))
+		if acked[j] < needed {
+			result.Error = NewRpcError(progressError(ctx, acked[j], needed, "replicas acknowledged"))
+		}
+	}
+	for i := range request.Items {
+		result := &response.Results[i]
+		self.logWrite(op, &request.Items[i], request.Consistency, request.Caller,
+			&RpcResult{Success: Btoi(result.Error == nil && result.Member == nil), Data: result.Data, Member: result.Member})
+	}
+	return nil
+}
+
+/*
+  Send the items to their other replicas, one request per machine, and count
+  how many copies each one has, ours included. Writes for replicas that can't
+  be reached are handed off and counted the way writeToNReplicas does.
+*/
+func (self *Ring) replicateBatch(ctx context.Context, items []data.DataStore) []int {
+	acked := make([]int, len(items))
+	batches := make(map[string][]int)
+	for i, item := range items {
+		acked[i] = 1
+		for _, member := range self.replicasForKey(item.Key, self.replicasFor(item.Key)-1) {
+			batches[member.Address] = append(batches[member.Address], i)
+		}
+	}
+
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+	for address, indices := range batches {
+		wait.Add(1)
+		go func(address string, indices []int) {
+			defer wait.Done()
+			batch := make([]data.DataStore, 0, len(indices))
+			for _, i := range indices {
+				batch = append(batch, items[i])
+			}
+			var written int
+			err := callMachineContext(ctx, address, "Ring.WriteBatch", &batch, &written)
+			if err != nil && ctx.Err() != nil {
+				fmt.Println("Gave up sending batch:", err)
+				return
+			}
+			stored := indices
+			if err != nil {
+				fmt.Println("Error sending batch:", err)
+				stored = make([]int, 0, len(indices))
+				for _, i := range indices {
+					fallbacks := self.fallbacksForKey(items[i].Key, self.replicasFor(items[i].Key)-1)
+					if self.handOff(ctx, address, &items[i], &fallbacks) {
+						stored = append(stored, i)
+					}
+				}
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for _, i := range stored {
+				acked[i]++
+			}
+		}(address, indices)
+	}
+	wait.Wait()
+	return acked
+}
+
+// Store a batch the coordinator sends, merged with the versions we have
+func (self *Ring) WriteBatch(items *[]data.DataStore, written *int) error {
+	for i := range *items {
+		self.mergeLocal(&(*items)[i])
+	}
+	*written = len(*items)
+	fmt.Println("Stored batch of", *written, "keys")
+	return nil
+}
+
+/*
+  Reading batches
+*/
+
+// The copies of a key the replicas that answered hold
+type batchRead struct {
+	key    int
+	reads  []replicaRead
+	needed int
+}
+
+/*
+  Read the keys from their replicas, one request per machine, until every key
+  has as many answers as it needs or the context is done
+*/
+func (self *Ring) readBatchFromReplicas(ctx context.Context, keys []int, consistency int) []batchRead {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	reads := make([]batchRead, len(keys))
+	batches := make(map[string][]int)
+	members := make(map[string]*data.GroupMember)
+	for i, key := range keys {
+		replicas := self.preferenceList(key, self.replicasFor(key))
+		reads[i] = batchRead{key: key, needed: copiesNeeded(consistency, self.replicasFor(key))}
+		for _, member := range replicas {
+			if member.Address == myAddr {
+				item, found := self.getLocal(key)
+				reads[i].reads = append(reads[i].reads, replicaRead{member, item, found, nil})
+			} else {
+				batches[member.Address] = append(batches[member.Address], i)
+				members[member.Address] = member
+			}
+		}
+	}
+
+	type answer struct {
+		address string
+		results []RpcResult
+		err     error
+	}
+	answers := make(chan answer, len(batches))
+	for address, indices := range batches {
+		go func(address string, indices []int) {
+			batch := make([]int, 0, len(indices))
+			for _, i := range indices {
+				batch = append(batch, keys[i])
+			}
+			var results []RpcResult
+			err := callMachineContext(ctx, address, "Ring.ReadBatch", &batch, &results)
+			if err == nil && len(results) != len(batch) {
+				err = fmt.Errorf("%d results for %d keys", len(results), len(batch))
+			}
+			answers <- answer{address, results, err}
+		}(address, indices)
+	}
+
+	satisfied := func() bool {
+		for _, read := range reads {
+			if len(read.reads) < read.needed {
+				return false
+			}
+		}
+		return true
+	}
+Waiting:
+	for waiting := len(batches); waiting > 0 && !satisfied(); waiting-- {
+		select {
+		case answer := <-answers:
+			if answer.err != nil {
+				fmt.Println("Could not read from replica", answer.address, answer.err)
+				continue
+			}
+			for j, i := range batches[answer.address] {
+				result := answer.results[j]
+				reads[i].reads = append(reads[i].reads, replicaRead{members[answer.address], result.Data, result.Success == 1, nil})
+			}
+		case <-ctx.Done():
+			break Waiting
+		}
+	}
+	return reads
+}
+
+/*
+  Exposed over RPC: what this machine holds for the keys, without asking anyone else
+*/
+func (self *Ring) ReadBatch(keys *[]int, results *[]RpcResult) error {
+	*results = make([]RpcResult, len(*keys))
+	for i, key := range *keys {
+		item, found := self.getLocal(key)
+		(*results)[i] = RpcResult{Success: Btoi(found), Data: item}
+	}
+	return nil
+}
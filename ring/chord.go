@@ -0,0 +1,605 @@
+package ring
+
+import (
+	"../data"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+  Chord routing. Instead of every machine knowing the whole ring, each one keeps
+  a finger table (the successor of Id + 2^i for every i) and a short list of
+  successors. Keys are found by hopping through fingers, halving the distance
+  every hop, so a lookup takes O(log N) messages. Periodic stabilize, fix-fingers
+  and check-predecessor rounds keep everything correct as machines come and go.
+
+  In Chord mode a machine only takes the position given by its Id.
+*/
+
+const (
+	maxChordHops  = 64
+	chordInterval = 500 * time.Millisecond
+)
+
+// One step of a lookup: either the successor of the key was found, or the next machine to ask
+type ChordStep struct {
+	Found bool
+	Node  data.LocationStore
+}
+
+// Sent by a leaving machine to its neighbours, with the links they need to close the gap
+type ChordLeave struct {
+	Node        data.LocationStore
+	Predecessor data.LocationStore
+	Successors  []data.LocationStore
+}
+
+type Chord struct {
+	self              data.LocationStore
+	predecessor       data.LocationStore
+	successors        []data.LocationStore
+	successorListSize int
+	fingers           []data.LocationStore
+	next              int
+	keySpace          int
+	lock              sync.Mutex
+}
+
+// Keeps successorListSize successors, enough to find every replica of a key and one spare
+func NewChord(keySpace int, successorListSize int) *Chord {
+	return &Chord{
+		self:              data.NilLocationStore(),
+		predecessor:       data.NilLocationStore(),
+		successors:        make([]data.LocationStore, 0, successorListSize),
+		successorListSize: successorListSize,
+		fingers:           make([]data.LocationStore, bits.Len64(uint64(keySpace-1))),
+		keySpace:          keySpace,
+	}
+}
+
+// The replication factor changed, keep more or fewer successors from the next stabilize on
+func (self *Chord) setSuccessorListSize(size int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.successorListSize = size
+	if len(self.successors) > size {
+		self.successors = self.successors[:size]
+	}
+}
+
+// Take our place on the ring as the only member
+func (self *Chord) start(me data.LocationStore) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.self = me
+	self.successors = []data.LocationStore{me}
+	for i := range self.fingers {
+		self.fingers[i] = me
+	}
+}
+
+// Start of the range covered by finger i
+func (self *Chord) fingerStart(i int) int {
+	return int((uint64(self.self.Key) + uint64(1)<<uint(i)) % uint64(self.keySpace))
+}
+
+func (self *Chord) successor() data.LocationStore {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.successors) == 0 {
+		return data.NilLocationStore()
+	}
+	return self.successors[0]
+}
+
+func (self *Chord) successorList() []data.LocationStore {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]data.LocationStore{}, self.successors...)
+}
+
+func (self *Chord) getPredecessor() data.LocationStore {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.predecessor
+}
+
+// Whether we are responsible for the key, only known once we have a predecessor
+func (self *Chord) owns(key int) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.self.Key == -1 || self.predecessor.Key == -1 {
+		return false
+	}
+	return data.NewKeyRange(self.predecessor.Key, self.self.Key).Contains(key)
+}
+
+/*
+  Answer a lookup from what we know. If the key falls between us and our
+  successor we are done, otherwise point at the closest finger before the key.
+  Clients have no place on the ring and just point at the machine they know.
+*/
+func (self *Chord) step(key int) ChordStep {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.successors) == 0 {
+		return ChordStep{false, data.NilLocationStore()}
+	}
+	successor := self.successors[0]
+	if self.self.Key == -1 {
+		return ChordStep{false, successor}
+	}
+	if data.NewKeyRange(self.self.Key, successor.Key).Contains(key) {
+		return ChordStep{true, successor}
+	}
+
+	between := data.NewKeyRange(self.self.Key, key)
+	for i := len(self.fingers) - 1; i >= 0; i-- {
+		finger := self.fingers[i]
+		if finger.Key != -1 && finger.Value != "" && finger.Key != key && between.Contains(finger.Key) &&
+			finger.Value != self.self.Value {
+			return ChordStep{false, finger}
+		}
+	}
+	for i := len(self.successors) - 1; i >= 0; i-- {
+		node := self.successors[i]
+		if node.Key != key && between.Contains(node.Key) && node.Value != self.self.Value {
+			return ChordStep{false, node}
+		}
+	}
+	return ChordStep{true, successor}
+}
+
+// Stop using a machine that didn't answer
+func (self *Chord) forget(node data.LocationStore) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	successors := make([]data.LocationStore, 0, len(self.successors))
+	for _, successor := range self.successors {
+		if successor.Value != node.Value {
+			successors = append(successors, successor)
+		}
+	}
+	if len(successors) == 0 && self.self.Key != -1 {
+		successors = append(successors, self.self)
+	}
+	self.successors = successors
+
+	for i, finger := range self.fingers {
+		if finger.Value == node.Value {
+			self.fingers[i] = self.successors[0]
+		}
+	}
+	if self.predecessor.Value == node.Value {
+		self.predecessor = data.NilLocationStore()
+	}
+}
+
+/*
+  The machine right before or after us left: take its predecessor as ours, or
+  the successors it had as ours, up to where its list comes back round to us
+*/
+func (self *Chord) departed(leave *ChordLeave) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.predecessor.Value == leave.Node.Value {
+		self.predecessor = data.NilLocationStore()
+		if leave.Predecessor.Key != -1 && leave.Predecessor.Value != self.self.Value {
+			self.predecessor = leave.Predecessor
+		}
+	}
+
+	successors := self.successors
+	if len(successors) > 0 && successors[0].Value == leave.Node.Value {
+		successors = make([]data.LocationStore, 0, self.successorListSize)
+		for _, node := range leave.Successors {
+			if node.Value == self.self.Value || len(successors) == self.successorListSize {
+				break
+			}
+			successors = append(successors, node)
+		}
+	}
+	kept := make([]data.LocationStore, 0, len(successors))
+	for _, node := range successors {
+		if node.Value != leave.Node.Value {
+			kept = append(kept, node)
+		}
+	}
+	if len(kept) == 0 && self.self.Key != -1 {
+		kept = append(kept, self.self)
+	}
+	self.successors = kept
+
+	for i, finger := range self.fingers {
+		if finger.Value == leave.Node.Value {
+			self.fingers[i] = self.successors[0]
+		}
+	}
+}
+
+// Use successor and the list it sent us as our successor list
+func (self *Chord) setSuccessors(successor data.LocationStore, theirs []data.LocationStore) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	successors := []data.LocationStore{successor}
+	for _, node := range theirs {
+		if len(successors) == self.successorListSize {
+			break
+		}
+		if node.Value == self.self.Value || node.Value == successor.Value {
+			continue
+		}
+		successors = append(successors, node)
+	}
+	self.successors = successors
+}
+
+func (self *Chord) setFinger(i int, node data.LocationStore) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.fingers[i] = node
+}
+
+// A machine thinks it might be our predecessor
+func (self *Chord) notify(node data.LocationStore) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if node.Value == self.self.Value {
+		return false
+	}
+	if self.predecessor.Key == -1 || data.NewKeyRange(self.predecessor.Key, self.self.Key).Contains(node.Key) {
+		self.predecessor = node
+		return true
+	}
+	return false
+}
+
+/*
+  Lookups. All go through a chain of FindSuccessor calls that we drive
+  ourselves, so a machine that doesn't answer can be skipped.
+*/
+
+// The machine responsible for key
+func (self *Ring) findSuccessor(key int) (data.LocationStore, error) {
+	chord := self.getChord()
+	return self.lookupFrom(chord.step(key), key)
+}
+
+func (self *Ring) lookupFrom(step ChordStep, key int) (data.LocationStore, error) {
+	chord := self.getChord()
+	for hops := 0; !step.Found && hops < maxChordHops; hops++ {
+		if step.Node.Value == "" {
+			return data.NilLocationStore(), errors.New("no machine to ask")
+		}
+		var next ChordStep
+		err := callMachine(step.Node.Value, "Ring.FindSuccessor", &key, &next)
+		if err != nil {
+			fmt.Println("Chord lookup could not reach", step.Node.Value, err)
+			chord.forget(step.Node)
+			step = chord.step(key)
+			continue
+		}
+		step = next
+	}
+	if !step.Found {
+		return data.NilLocationStore(), errors.New("lookup did not finish")
+	}
+	self.learnNode(step.Node)
+	return step.Node, nil
+}
+
+// The machine responsible for key, ourselves if we can tell without asking
+func (self *Ring) chordOwner(key int) (data.LocationStore, error) {
+	chord := self.getChord()
+	if chord.owns(key) {
+		return chord.self, nil
+	}
+	return self.findSuccessor(key)
+}
+
+// The owner of key and the machines after it, n in total
+func (self *Ring) chordPreferenceList(key, n int) []*data.GroupMember {
+	chord := self.getChord()
+	members := make([]*data.GroupMember, 0, n)
+	owner, err := self.chordOwner(key)
+	if err != nil {
+		fmt.Println("Chord lookup failed:", err)
+		return members
+	}
+
+	var successors []data.LocationStore
+	if owner.Value == chord.self.Value {
+		successors = chord.successorList()
+	} else if err := callMachine(owner.Value, "Ring.GetSuccessorList", 0, &successors); err != nil {
+		fmt.Println("Could not get successors of", owner.Value, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, node := range append([]data.LocationStore{owner}, successors...) {
+		if len(members) == n {
+			break
+		}
+		if seen[node.Value] {
+			continue
+		}
+		seen[node.Value] = true
+		members = append(members, self.learnNode(node))
+	}
+	return members
+}
+
+// Keep machines we run into in the Usertable, it doubles as the address book
+func (self *Ring) learnNode(node data.LocationStore) *data.GroupMember {
+	self.membersLock.Lock()
+	defer self.membersLock.Unlock()
+	member := self.Usertable[node.Value]
+	if member == nil {
+		member = data.NewGroupMember(node.Key, node.Value, 0, Stable)
+		self.Usertable[node.Value] = member
+	}
+	return self.memberCopy(node.Value)
+}
+
+/*
+  Joining and leaving
+*/
+
+// Find our successor through a machine already on the ring and take the keys we are now responsible for
+func (self *Ring) joinChord(address string, hashedKey int) error {
+	chord := self.getChord()
+	hostPort := net.JoinHostPort(self.Address, self.Port)
+	me := data.LocationStore{hashedKey, hostPort}
+	chord.start(me)
+
+	successor, err := self.lookupFrom(ChordStep{false, data.LocationStore{-1, address}}, hashedKey)
+	if err != nil {
+		return err
+	}
+	chord.setSuccessors(successor, nil)
+
+	var predecessor data.LocationStore
+	err = callMachine(successor.Value, "Ring.GetPredecessor", 0, &predecessor)
+	if err != nil {
+		return err
+	}
+	start := predecessor.Key
+	if start == -1 {
+		start = successor.Key
+	}
+
+	var data_t []*data.DataStore
+	err = callMachine(successor.Value, "Ring.GetEntryData", data.NewKeyRange(start, hashedKey), &data_t)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(data_t); i++ {
+		self.mergeLocal(data_t[i])
+	}
+
+	var accepted bool
+	return callMachine(successor.Value, "Ring.Notify", &me, &accepted)
+}
+
+/*
+  Hand everything we own to our successor, then tell it and our predecessor to
+  link up with each other. The rest of the ring notices we are gone when
+  stabilizing
+*/
+func (self *Ring) leaveChord(ctx context.Context, function string) error {
+	chord := self.getChord()
+	successor := chord.successor()
+	if successor.Value == chord.self.Value {
+		fmt.Println("Last machine on the ring, nobody to take the data")
+		return nil
+	}
+
+	items := self.localData()
+	for sent, sendingData := range items {
+		var result RpcResult
+		err := callMachineContext(ctx, successor.Value, function, &sendingData, &result)
+		if err == nil && result.Success != 1 {
+			err = NewOpError("leave", sendingData.Key, successor.Value, ErrInsufficientReplicas)
+		}
+		if err != nil {
+			fmt.Println("Error sending data", err)
+			return &ProgressError{Err: err, Done: sent, Needed: len(items), What: "keys handed off"}
+		}
+		self.deleteLocal(sendingData.Key)
+	}
+
+	leave := &ChordLeave{chord.self, chord.getPredecessor(), chord.successorList()}
+	neighbours := []data.LocationStore{successor}
+	if leave.Predecessor.Key != -1 && leave.Predecessor.Value != successor.Value && leave.Predecessor.Value != chord.self.Value {
+		neighbours = append(neighbours, leave.Predecessor)
+	}
+	for _, node := range neighbours {
+		var unused bool
+		if err := callMachineContext(ctx, node.Value, "Ring.Departed", leave, &unused); err != nil {
+			fmt.Println("Could not tell", node.Value, "we are leaving", err)
+		}
+	}
+	self.Active = false
+	return nil
+}
+
+/*
+  Maintenance
+*/
+
+func (self *Ring) ChordMaintenance(interval time.Duration) {
+	for self.Active {
+		self.stabilize()
+		self.fixFingers()
+		self.checkPredecessor()
+		time.Sleep(interval)
+	}
+}
+
+// Ask our successor for its predecessor, which may be a better successor for us, then tell it about us
+func (self *Ring) stabilize() {
+	chord := self.getChord()
+	me := chord.self
+	successor := chord.successor()
+	if me.Key == -1 || successor.Key == -1 {
+		return
+	}
+
+	var candidate data.LocationStore
+	err := callMachine(successor.Value, "Ring.GetPredecessor", 0, &candidate)
+	if err != nil {
+		fmt.Println("Successor", successor.Value, "is gone")
+		chord.forget(successor)
+		return
+	}
+	if candidate.Key != -1 && candidate.Value != me.Value &&
+		(successor.Value == me.Value || data.NewKeyRange(me.Key, successor.Key).Contains(candidate.Key)) &&
+		candidate.Key != successor.Key {
+		successor = candidate
+	}
+
+	var theirs []data.LocationStore
+	err = callMachine(successor.Value, "Ring.GetSuccessorList", 0, &theirs)
+	if err != nil {
+		chord.forget(successor)
+		return
+	}
+	chord.setSuccessors(successor, theirs)
+	self.learnNode(successor)
+
+	var accepted bool
+	callMachine(successor.Value, "Ring.Notify", &me, &accepted)
+}
+
+// Point the fingers that fall before our successor at it, and look up one of the others every round
+func (self *Ring) fixFingers() {
+	chord := self.getChord()
+	me := chord.self
+	if me.Key == -1 {
+		return
+	}
+	successor := chord.successor()
+	nearby := data.NewKeyRange(me.Key, successor.Key)
+	if successor.Value == me.Value {
+		nearby = data.NewKeyRange(me.Key, me.Key+1)
+	}
+
+	for n := 0; n < len(chord.fingers); n++ {
+		i := chord.next
+		chord.next = (chord.next + 1) % len(chord.fingers)
+
+		start := chord.fingerStart(i)
+		if nearby.Contains(start) {
+			chord.setFinger(i, successor)
+			continue
+		}
+		node, err := self.findSuccessor(start)
+		if err == nil {
+			chord.setFinger(i, node)
+		}
+		return
+	}
+}
+
+// Forget our predecessor if it stopped answering, the keys it owned are ours now
+func (self *Ring) checkPredecessor() {
+	chord := self.getChord()
+	predecessor := chord.getPredecessor()
+	if predecessor.Key == -1 {
+		return
+	}
+	//A machine that is leaving still answers, but says it is no longer active
+	var alive bool
+	if err := callMachine(predecessor.Value, "Ring.Ping", 0, &alive); err != nil || !alive {
+		log.Println("MACHINE DEAD!", predecessor.Key)
+		chord.forget(predecessor)
+		self.bulkDataSendToReplicas()
+	}
+}
+
+func (self *Ring) PrintChord() {
+	chord := self.getChord()
+	fmt.Println("Printing Chord State")
+	fmt.Println("Self:", chord.self)
+	fmt.Println("Predecessor:", chord.getPredecessor())
+	fmt.Println("Successors:", chord.successorList())
+	chord.lock.Lock()
+	defer chord.lock.Unlock()
+	last := data.NilLocationStore()
+	for i, finger := range chord.fingers {
+		if finger != last {
+			fmt.Printf("Finger %d: %v\n", i, finger)
+			last = finger
+		}
+	}
+}
+
+/*
+  Exposed over RPC for other machines running Chord
+*/
+func (self *Ring) FindSuccessor(key *int, step *ChordStep) error {
+	chord := self.getChord()
+	if chord == nil {
+		return errors.New("not running chord")
+	}
+	*step = chord.step(*key)
+	return nil
+}
+
+func (self *Ring) GetPredecessor(unused int, predecessor *data.LocationStore) error {
+	chord := self.getChord()
+	if chord == nil {
+		return errors.New("not running chord")
+	}
+	*predecessor = chord.getPredecessor()
+	return nil
+}
+
+func (self *Ring) GetSuccessorList(unused int, successors *[]data.LocationStore) error {
+	chord := self.getChord()
+	if chord == nil {
+		return errors.New("not running chord")
+	}
+	*successors = chord.successorList()
+	return nil
+}
+
+func (self *Ring) Notify(node *data.LocationStore, accepted *bool) error {
+	chord := self.getChord()
+	if chord == nil {
+		return errors.New("not running chord")
+	}
+	*accepted = chord.notify(*node)
+	if *accepted {
+		self.learnNode(*node)
+	}
+	return nil
+}
+
+func (self *Ring) Departed(leave *ChordLeave, unused *bool) error {
+	chord := self.getChord()
+	if chord == nil {
+		return errors.New("not running chord")
+	}
+	chord.departed(leave)
+	if predecessor := chord.getPredecessor(); predecessor.Key != -1 {
+		self.learnNode(predecessor)
+	}
+	self.learnNode(chord.successor())
+	return nil
+}
+
+func (self *Ring) Ping(unused int, alive *bool) error {
+	*alive = self.Active
+	return nil
+}
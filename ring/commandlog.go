@@ -0,0 +1,269 @@
+package ring
+
+import (
+	"../data"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+  A bounded history of the operations served by this node. Every entry records
+  what was done to which key, at what consistency level, who asked for it and
+  how it went, so the story of a key can be pieced back together by asking every
+  member of the ring for its log.
+*/
+
+const (
+	commandLogSize = 1000
+)
+
+// Operation types recorded in the log
+const (
+	ReadOp = iota
+	WriteOp
+	UpdateOp
+	RemoveOp
+)
+
+// Outcomes recorded in the log
+const (
+	OutcomeOK        = "OK"
+	OutcomeFailed    = "FAILED"
+	OutcomeRedirect  = "REDIRECT"
+	OutcomeCondition = "CONDITION FAILED"
+)
+
+var opNames = []string{"READ", "WRITE", "UPDATE", "REMOVE"}
+
+type CommandLogEntry struct {
+	Op          int
+	Key         int
+	ValueDigest string
+	Consistency int
+	Caller      string
+	Node        string
+	Timestamp   time.Time
+	Outcome     string
+}
+
+func (self CommandLogEntry) String() string {
+	return fmt.Sprintf("%s %s %d [%s] consistency=%d caller=%s node=%s %s",
+		self.Timestamp.Format("15:04:05.000"), opNames[self.Op], self.Key, self.ValueDigest,
+		self.Consistency, self.Caller, self.Node, self.Outcome)
+}
+
+/*
+  Selects entries from the log. Key and Op are -1 to match anything, and a zero
+  Since/Until leaves that end of the time range open.
+*/
+type CommandLogFilter struct {
+	Key   int
+	Op    int
+	Since time.Time
+	Until time.Time
+}
+
+// A filter that matches every entry
+func AllCommands() *CommandLogFilter {
+	return &CommandLogFilter{Key: -1, Op: -1}
+}
+
+// A filter that matches every entry touching the given key
+func KeyCommands(key int) *CommandLogFilter {
+	return &CommandLogFilter{Key: key, Op: -1}
+}
+
+func (self *CommandLogFilter) Match(entry *CommandLogEntry) bool {
+	if self.Key != -1 && self.Key != entry.Key {
+		return false
+	}
+	if self.Op != -1 && self.Op != entry.Op {
+		return false
+	}
+	if !self.Since.IsZero() && entry.Timestamp.Before(self.Since) {
+		return false
+	}
+	if !self.Until.IsZero() && entry.Timestamp.After(self.Until) {
+		return false
+	}
+	return true
+}
+
+// Fixed size circular buffer of entries, the oldest entry is overwritten first
+type CommandLog struct {
+	entries []CommandLogEntry
+	next    int
+	full    bool
+	lock    sync.Mutex
+}
+
+func NewCommandLog(size int) *CommandLog {
+	return &CommandLog{entries: make([]CommandLogEntry, size)}
+}
+
+func (self *CommandLog) Add(entry CommandLogEntry) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	self.entries[self.next] = entry
+	self.next = (self.next + 1) % len(self.entries)
+	if self.next == 0 {
+		self.full = true
+	}
+}
+
+func (self *CommandLog) AddRead(key int, value []byte, consistency int, caller, outcome string) {
+	self.Add(CommandLogEntry{
+		Op:          ReadOp,
+		Key:         key,
+		ValueDigest: Digest(value),
+		Consistency: consistency,
+		Caller:      caller,
+		Outcome:     outcome,
+	})
+}
+
+// Records a mutation, op is one of WriteOp, UpdateOp or RemoveOp
+func (self *CommandLog) AddWrite(op, key int, value []byte, consistency int, caller, outcome string) {
+	self.Add(CommandLogEntry{
+		Op:          op,
+		Key:         key,
+		ValueDigest: Digest(value),
+		Consistency: consistency,
+		Caller:      caller,
+		Outcome:     outcome,
+	})
+}
+
+func (self *CommandLog) Len() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.full {
+		return len(self.entries)
+	}
+	return self.next
+}
+
+// Entries matching the filter, oldest first
+func (self *CommandLog) Query(filter *CommandLogFilter) []CommandLogEntry {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	start, count := 0, self.next
+	if self.full {
+		start, count = self.next, len(self.entries)
+	}
+
+	result := make([]CommandLogEntry, 0)
+	for i := 0; i < count; i++ {
+		entry := self.entries[(start+i)%len(self.entries)]
+		if filter == nil || filter.Match(&entry) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+func (self *CommandLog) Print() {
+	fmt.Println("Printing Command Log")
+	for _, entry := range self.Query(nil) {
+		fmt.Println(entry)
+	}
+}
+
+// Short fingerprint of a value so the log doesn't hold on to the data itself
+func Digest(value []byte) string {
+	if len(value) == 0 {
+		return ""
+	}
+	sum := sha1.Sum(value)
+	return hex.EncodeToString(sum[:4])
+}
+
+// Maps an RPC response to the outcome we keep in the log
+func outcomeOf(response *RpcResult) string {
+	if response.Success == 1 {
+		return OutcomeOK
+	}
+	if response.Member != nil {
+		return OutcomeRedirect
+	}
+	if response.ConditionFailed {
+		return OutcomeCondition
+	}
+	return OutcomeFailed
+}
+
+func (self *Ring) logRead(item *data.DataStore, consistency int, caller string, response *RpcResult) {
+	value := item.Value
+	if response.Success == 1 {
+		value = response.Data.Value
+	}
+	self.CmdLog.AddRead(item.Key, value, consistency, caller, outcomeOf(response))
+}
+
+func (self *Ring) logWrite(op int, item *data.DataStore, consistency int, caller string, response *RpcResult) {
+	self.CmdLog.AddWrite(op, item.Key, item.Value, consistency, caller, outcomeOf(response))
+}
+
+/*
+  Exposed over RPC so that a remote machine can fetch our history
+*/
+func (self *Ring) GetCommandLog(filter *CommandLogFilter, entries *[]CommandLogEntry) error {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	result := self.CmdLog.Query(filter)
+	for i := range result {
+		result[i].Node = myAddr
+	}
+	*entries = result
+	return nil
+}
+
+// Fetch the matching entries from a single machine
+func FetchCommandLog(address string, filter *CommandLogFilter) ([]CommandLogEntry, error) {
+	var entries []CommandLogEntry
+	err := callMachine(address, "Ring.GetCommandLog", filter, &entries)
+	return entries, err
+}
+
+/*
+  Ask every live machine we know of for its log and merge the answers into one
+  history ordered by time. Machines that can't be reached are skipped.
+*/
+func (self *Ring) ClusterHistory(filter *CommandLogFilter) []CommandLogEntry {
+	history := make([]CommandLogEntry, 0)
+	for _, member := range self.members() {
+		if member.Id == -1 {
+			continue
+		}
+		entries, err := FetchCommandLog(member.Address, filter)
+		if err != nil {
+			fmt.Println("Could not fetch command log from", member.Address, err)
+			continue
+		}
+		history = append(history, entries...)
+	}
+	sort.Sort(byTimestamp(history))
+	return history
+}
+
+func (self *Ring) PrintKeyHistory(key int) {
+	fmt.Println("History of key", key)
+	for _, entry := range self.ClusterHistory(KeyCommands(key)) {
+		fmt.Println(entry)
+	}
+}
+
+type byTimestamp []CommandLogEntry
+
+func (a byTimestamp) Len() int           { return len(a) }
+func (a byTimestamp) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTimestamp) Less(i, j int) bool { return a[i].Timestamp.Before(a[j].Timestamp) }
@@ -0,0 +1,141 @@
+package ring
+
+import (
+	"../data"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+/*
+  Conditional writes: compare-and-swap, put-if-absent and delete-if-version.
+  The coordinator of the key checks the condition against its copy and writes
+  in the same step, then replicates like any other write. At quorum or all it
+  first brings its copy up to what that many replicas hold, so the condition
+  is checked against what a read at the same level would see.
+
+  When the condition doesn't hold nothing is written, the caller gets
+  ErrConditionFailed along with what the key holds instead.
+*/
+
+func (self *Session) PutIfAbsent(key int, val []byte, meta data.Metadata, consistency int) (data.DataStore, error) {
+	return self.PutIfAbsentContext(context.Background(), key, val, meta, consistency)
+}
+
+func (self *Session) PutIfAbsentContext(ctx context.Context, key int, val []byte, meta data.Metadata, consistency int) (data.DataStore, error) {
+	args := data.NewDataStore(key, val)
+	args.Meta = meta
+	return self.conditionalWrite(ctx, "putifabsent", args, data.NewAbsentCondition(), consistency)
+}
+
+// Write the value if the key holds exactly the versions described by the context from a Lookup
+func (self *Session) CompareAndSwap(key int, expected data.VectorClock, val []byte, meta data.Metadata, consistency int) (data.DataStore, error) {
+	return self.CompareAndSwapContext(context.Background(), key, expected, val, meta, consistency)
+}
+
+func (self *Session) CompareAndSwapContext(ctx context.Context, key int, expected data.VectorClock, val []byte, meta data.Metadata, consistency int) (data.DataStore, error) {
+	args := data.NewDataStore(key, val)
+	args.Meta = meta
+	return self.conditionalWrite(ctx, "cas", args, data.NewVersionCondition(expected), consistency)
+}
+
+// Write the value if the key holds the expected one and nothing concurrent with it
+func (self *Session) CompareAndSwapValue(key int, expected []byte, val []byte, meta data.Metadata, consistency int) (data.DataStore, error) {
+	return self.CompareAndSwapValueContext(context.Background(), key, expected, val, meta, consistency)
+}
+
+func (self *Session) CompareAndSwapValueContext(ctx context.Context, key int, expected []byte, val []byte, meta data.Metadata, consistency int) (data.DataStore, error) {
+	args := data.NewDataStore(key, val)
+	args.Meta = meta
+	return self.conditionalWrite(ctx, "cas", args, data.NewValueCondition(expected), consistency)
+}
+
+// Remove the key if it holds exactly the versions described by the context from a Lookup
+func (self *Session) DeleteIfVersion(key int, expected data.VectorClock, consistency int) (data.DataStore, error) {
+	return self.DeleteIfVersionContext(context.Background(), key, expected, consistency)
+}
+
+func (self *Session) DeleteIfVersionContext(ctx context.Context, key int, expected data.VectorClock, consistency int) (data.DataStore, error) {
+	args := data.NewDataStore(key, nil)
+	args.Deleted = true
+	return self.conditionalWrite(ctx, "deleteif", args, data.NewVersionCondition(expected), consistency)
+}
+
+/*
+  Returns what was stored, or what the key holds if the condition failed.
+  Either way we remember its context, so the caller can Update or try again
+  from there.
+*/
+func (self *Session) conditionalWrite(ctx context.Context, op string, args *data.DataStore, condition *data.Condition, consistency int) (data.DataStore, error) {
+	result, err := self.coordinateIf(ctx, op, args.Key, "Ring.ConditionalWrite", args, condition, consistency)
+	if errors.Is(err, ErrConditionFailed) {
+		self.remember(args.Key, result.Data.Context())
+		return result.Data, err
+	}
+	if err != nil {
+		return result.Data, err
+	}
+	if args.Deleted {
+		self.forget(args.Key)
+	} else {
+		self.rememberWrite(&result.Data, args.Value, nil)
+	}
+	return result.Data, nil
+}
+
+/*
+  Exposed over RPC: the conditional write, a remove if the sent item is
+  Deleted. Conditional writes only come with a consistency level.
+*/
+func (self *Ring) ConditionalWriteConsistent(request *data.ConsistentOpArgs, response *RpcResult) (err error) {
+	defer response.carry(&err)
+	consistency := request.Consistency
+	ctx, cancel := requestContext(request.Timeout)
+	defer cancel()
+	sentData := request.DataStore
+	condition := request.Condition
+
+	op := UpdateOp
+	if sentData.Deleted {
+		op = RemoveOp
+	} else if condition != nil && condition.Kind == data.IfAbsent {
+		op = WriteOp
+	}
+	defer func() { self.logWrite(op, sentData, consistency, request.Caller, response) }()
+
+	machineAddr := self.getMachineForKey(sentData.Key).Value
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	if machineAddr != myAddr {
+		response.Member = self.getMember(machineAddr)
+		return nil
+	}
+	if condition == nil {
+		return ErrConditionFailed
+	}
+
+	//Check against what the replicas hold, not just our own copy
+	if consistency != One {
+		merged, found, answered, needed := self.readFromReplicas(ctx, sentData.Key, copiesNeeded(consistency, self.replicasFor(sentData.Key)))
+		if answered < needed {
+			fmt.Println("Could not reach enough replicas")
+			return progressError(ctx, answered, needed, "replicas answered")
+		}
+		if found {
+			self.mergeLocal(&merged)
+		}
+	}
+
+	stored, ok, err := self.coordinateConditionalWrite(sentData, condition)
+	if err != nil {
+		return err
+	}
+	response.Data = stored
+	if !ok {
+		fmt.Println("Condition failed:", sentData.Key, condition)
+		response.ConditionFailed = true
+		return nil
+	}
+	response.Success, err = self.replicate(ctx, &stored, consistency)
+	return err
+}
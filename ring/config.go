@@ -0,0 +1,111 @@
+package ring
+
+import (
+	"../data"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultVirtualNodes = 16
+	DefaultReplicas     = 3
+)
+
+/*
+  Settings that every member of the ring has to agree on. They are chosen by the
+  first machine and handed to everyone that joins through it.
+*/
+type Config struct {
+	HashFunction string
+	KeySpace     int
+	VirtualNodes int
+	Chord        bool
+
+	//How long removed keys keep their tombstones
+	TombstoneGrace time.Duration
+
+	//How many machines hold a copy of each key, unless its namespace says otherwise
+	Replicas   int
+	Namespaces []Namespace
+
+	//Goes up every time the replication settings change on a live ring
+	Epoch int
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		HashFunction: data.DefaultHashFunction,
+		KeySpace:     data.DefaultKeySpace,
+		VirtualNodes: DefaultVirtualNodes,
+
+		TombstoneGrace: defaultTombstoneGrace,
+		Replicas:       DefaultReplicas,
+	}
+}
+
+// Use the given settings from now on. Has to happen before we take a place on the ring
+func (self *Ring) Configure(config *Config) error {
+	hasher, err := data.NewHasher(config.HashFunction, config.KeySpace)
+	if err != nil {
+		return err
+	}
+	if config.VirtualNodes < 1 {
+		return errors.New("need at least one virtual node per machine")
+	}
+	if config.TombstoneGrace <= 0 {
+		return errors.New("tombstones need a grace period")
+	}
+	if err := config.checkReplication(); err != nil {
+		return err
+	}
+	self.configLock.Lock()
+	defer self.configLock.Unlock()
+	//Chord routes by the Id alone, one position per machine
+	if config.Chord {
+		config.VirtualNodes = 1
+		self.chord = NewChord(config.KeySpace, config.maxReplicas()+1)
+	}
+	self.Config = config
+	self.hasher = hasher
+	return nil
+}
+
+// Fetch the settings of the ring the given machine belongs to and use them
+func (self *Ring) AdoptConfig(address string) error {
+	var config Config
+	if err := callMachine(address, "Ring.GetConfig", 0, &config); err != nil {
+		return err
+	}
+	fmt.Printf("Using ring config %+v\n", config)
+	return self.Configure(&config)
+}
+
+// Hash a key or machine onto the ring
+func (self *Ring) Hash(s string) int {
+	self.configLock.RLock()
+	hasher := self.hasher
+	self.configLock.RUnlock()
+	return hasher.Hash(s)
+}
+
+func (self *Ring) KeySpace() int {
+	self.configLock.RLock()
+	defer self.configLock.RUnlock()
+	return self.hasher.KeySpace()
+}
+
+// The Chord routing table, nil when the ring gossips its whole table instead
+func (self *Ring) getChord() *Chord {
+	self.configLock.RLock()
+	defer self.configLock.RUnlock()
+	return self.chord
+}
+
+/*
+  Exposed over RPC so that joining machines and clients can use our settings
+*/
+func (self *Ring) GetConfig(unused int, config *Config) error {
+	*config = *self.settings()
+	return nil
+}
@@ -2,9 +2,10 @@ package ring
 
 import (
 	"../data"
+	"context"
 	"fmt"
 	"net"
-  "strconv"
+	"time"
 )
 
 const (
@@ -13,141 +14,170 @@ const (
 	All
 )
 
-/* Insert */
-func (self *Ring) SendDataConsistent(request *data.ConsistentOpArgs, response *RpcResult) error {
+const (
+	//Part of the caller's time we keep to tell it how far we got, at most maxReplyMargin
+	replyShare     = 10
+	maxReplyMargin = 100 * time.Millisecond
+)
 
+// Stop working on a request a little before the caller stops waiting for the answer, after timeout
+func requestContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	margin := timeout / replyShare
+	if margin > maxReplyMargin {
+		margin = maxReplyMargin
+	}
+	return context.WithTimeout(context.Background(), timeout-margin)
+}
 
+/* Insert */
+func (self *Ring) SendDataConsistent(request *data.ConsistentOpArgs, response *RpcResult) (err error) {
+	defer response.carry(&err)
 	consistency := request.Consistency
+	ctx, cancel := requestContext(request.Timeout)
+	defer cancel()
 	sentData := request.DataStore
 
-
 	//Check if there is a newer machine for this
 	machineAddr := self.getMachineForKey(sentData.Key).Value
 	myAddr := net.JoinHostPort(self.Address, self.Port)
 
 	//newer machine exists
 	if machineAddr != myAddr {
-		response.Member = self.Usertable[machineAddr]
+		response.Member = self.getMember(machineAddr)
 		//i am the newest
 	} else {
-		inserted := self.KeyValTable.Insert(data.DataStore{(*sentData).Key, (*sentData).Value})
-		response.Success = Btoi(inserted)
-		if response.Success != 1 {
-			//fmt.Println("Cannot store data: Should not happen unless machine gone")
-      // TODO
-		} else {
-			switch consistency {
-			case One:
-				response.Success = self.writeToOneReplica(sentData, self.Usertable[myAddr].Id)
-			case Quorum:
-				response.Success = self.writeToQuorumReplicas(sentData, self.Usertable[myAddr].Id)
-			case All:
-				response.Success = self.writeToReplicas(sentData, self.Usertable[myAddr].Id)
-			}
-      self.CmdLog.AddWrite(strconv.Itoa(consistency) + " : " + strconv.Itoa(sentData.Key) + " --> " + sentData.Value)
-
+		//Inserting over a removed key replaces its tombstones
+		var stored data.DataStore
+		var ok bool
+		stored, ok, err = self.coordinateConditionalWrite(sentData, data.NewAbsentCondition())
+		if err == nil && !ok {
+			fmt.Println("Cannot store data: Key already exists")
+			err = ErrExists
+		}
+		if err == nil {
+			response.Data = stored
+			response.Success, err = self.replicate(ctx, &stored, consistency)
 		}
 	}
+	self.logWrite(WriteOp, sentData, consistency, request.Caller, response)
 
-	return nil
+	return err
 }
 
-/* Remove */
-func (self *Ring) RemoveDataConsistent(request *data.ConsistentOpArgs, response *RpcResult) error {
-
+/* Remove : writes a tombstone over every version we know of */
+func (self *Ring) RemoveDataConsistent(request *data.ConsistentOpArgs, response *RpcResult) (err error) {
+	defer response.carry(&err)
 	consistency := request.Consistency
+	ctx, cancel := requestContext(request.Timeout)
+	defer cancel()
 	args := request.DataStore
 
-	deleted := self.KeyValTable.DeleteWithKey(data.DataStore{(*args).Key, ""})
-	response.Success = Btoi(deleted)
+	response.Success = 0
 	response.Member = nil
-	myAddr := net.JoinHostPort(self.Address, self.Port)
 
-	if response.Success != 1 {
-		machineAddr := self.getMachineForKey(args.Key).Value
-		myAddr := net.JoinHostPort(self.Address, self.Port)
-		if machineAddr != myAddr {
-			response.Member = self.Usertable[machineAddr]
-		} else {
+	//Only the coordinator writes, replicas would count the versions with their own clocks
+	machineAddr := self.getMachineForKey(args.Key).Value
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	if machineAddr != myAddr {
+		response.Member = self.getMember(machineAddr)
+	} else {
+		var stored data.DataStore
+		stored, err = self.coordinateExisting(args, true)
+		if err == ErrNotFound {
 			fmt.Println("Data doesnt exist")
 		}
-	} else {
-		(*args).Value = "##DELETE##"
-		switch consistency {
-		case One:
-			//return nil
-			response.Success = self.writeToOneReplica(args, self.Usertable[myAddr].Id)
-		case Quorum:
-			response.Success = self.writeToQuorumReplicas(args, self.Usertable[myAddr].Id)
-		case All:
-			response.Success = self.writeToReplicas(args, self.Usertable[myAddr].Id)
+		if err == nil {
+			response.Data = stored
+			response.Success, err = self.replicate(ctx, &stored, consistency)
 		}
-
 	}
-	return nil
+	self.logWrite(RemoveOp, args, consistency, request.Caller, response)
+	return err
 }
 
-/* Lookup */
-func (self *Ring) GetDataConsistent(request *data.ConsistentOpArgs, response *RpcResult) error {
-
-	//	consistency := request.Consistency
+/* Lookup : asks as many replicas as the consistency level needs and returns every version they hold,
+   along with the context to send back on the next write */
+func (self *Ring) GetDataConsistent(request *data.ConsistentOpArgs, response *RpcResult) (err error) {
+	defer response.carry(&err)
+	consistency := request.Consistency
+	ctx, cancel := requestContext(request.Timeout)
+	defer cancel()
 	args := request.DataStore
 
-
-	found := self.KeyValTable.Get(data.DataStore{(*args).Key, ""})
 	response.Member = nil
-	if found == nil {
+	response.Success = 0
+
+	//Only a machine holding a copy of the key can coordinate the read
+	if !self.isReplicaFor(args.Key) {
 		machineAddr := self.getMachineForKey(args.Key).Value
-		myAddr := net.JoinHostPort(self.Address, self.Port)
-		if machineAddr != myAddr {
-			response.Member = self.Usertable[machineAddr]
-		} else {
+		response.Member = self.getMember(machineAddr)
+	} else {
+		merged, found, answered, needed := self.readFromReplicas(ctx, args.Key, copiesNeeded(consistency, self.replicasFor(args.Key)))
+		if answered < needed {
+			fmt.Println("Could not reach enough replicas")
+			err = progressError(ctx, answered, needed, "replicas answered")
+		} else if !found || merged.IsDeleted() {
 			fmt.Println("Data doesnt exist")
+			err = ErrNotFound
+		} else {
+			response.Success = 1
+			response.Data = merged
 		}
-		response.Success = 0
-	} else {
-		response.Success = 1
-		response.Data = found.(data.DataStore)
-
-    cons := strconv.Itoa(request.Consistency)
-    self.CmdLog.AddRead(cons + " : " + strconv.Itoa(response.Data.Key) + " --> " + response.Data.Value)
 	}
-	return nil
+	self.logRead(args, consistency, request.Caller, response)
+	return err
 }
 
-/* Update : Delete the current data, then add the new */
-func (self *Ring) UpdateDataConsistent(request *data.ConsistentOpArgs, response *RpcResult) error {
-
+/* Update : Replace the versions the client has seen with the new value */
+func (self *Ring) UpdateDataConsistent(request *data.ConsistentOpArgs, response *RpcResult) (err error) {
+	defer response.carry(&err)
 	consistency := request.Consistency
+	ctx, cancel := requestContext(request.Timeout)
+	defer cancel()
 	sentData := request.DataStore
 
-	deleted := self.KeyValTable.DeleteWithKey(data.DataStore{(*sentData).Key, ""})
+	machineAddr := self.getMachineForKey(sentData.Key).Value
 	myAddr := net.JoinHostPort(self.Address, self.Port)
-	if !deleted {
-		machineAddr := self.getMachineForKey(sentData.Key).Value
-		myAddr := net.JoinHostPort(self.Address, self.Port)
-		if machineAddr != myAddr {
-			response.Member = self.Usertable[machineAddr]
-		} else {
-			fmt.Println("Data doesnt exist")
-		}
+	if machineAddr != myAddr {
+		response.Member = self.getMember(machineAddr)
 		response.Success = 0
 	} else {
-		inserted := self.KeyValTable.Insert(data.DataStore{(*sentData).Key, (*sentData).Value})
-		response.Success = Btoi(inserted)
-		if response.Success != 1 {
-			fmt.Println("Cannot update date: Should not happen unless machine gone")
-		} else {
-			switch consistency {
-			case One:
-				response.Success = self.writeToOneReplica(sentData, self.Usertable[myAddr].Id)
-			case Quorum:
-				response.Success = self.writeToQuorumReplicas(sentData, self.Usertable[myAddr].Id)
-			case All:
-				response.Success = self.writeToReplicas(sentData, self.Usertable[myAddr].Id)
-			}
+		var stored data.DataStore
+		stored, err = self.coordinateExisting(sentData, false)
+		if err == ErrNotFound {
+			fmt.Println("Data doesnt exist")
+		}
+		if err == nil {
+			response.Data = stored
+			response.Success, err = self.replicate(ctx, &stored, consistency)
 		}
 	}
+	self.logWrite(UpdateOp, sentData, consistency, request.Caller, response)
+
+	return err
+}
 
-	return nil
+// Send the item to the other replicas, it is written once as many as the consistency level asks for have it
+func (self *Ring) replicate(ctx context.Context, item *data.DataStore, consistency int) (int, error) {
+	n := self.replicasFor(item.Key)
+	needed := copiesNeeded(consistency, n)
+
+	//Our copy counts as one of them
+	acked := 1 + self.writeToNReplicas(ctx, item, n-1)
+	if acked < needed {
+		return 0, progressError(ctx, acked, needed, "replicas acknowledged")
+	}
+	return 1, nil
+}
+
+// Too few replicas answered, because time ran out or because they couldn't be reached
+func progressError(ctx context.Context, done int, needed int, what string) error {
+	err := ErrInsufficientReplicas
+	if ctx.Err() != nil {
+		err = contextError(ctx.Err())
+	}
+	return &ProgressError{Err: err, Done: done, Needed: needed, What: what}
 }
@@ -0,0 +1,285 @@
+package ring
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+  Errors the operations on the ring return. A machine coordinating an
+  operation returns them from its RPC, and the caller gets the same error back
+  so it can be checked with errors.Is. Failures to reach a machine are
+  ErrUnavailable or ErrTimeout. Whatever the operation, the error comes
+  wrapped in an OpError saying which key and machine it was about.
+
+  An operation whose context expires returns ErrTimeout, one whose context is
+  canceled ErrCanceled. When replicas had already answered, a ProgressError in
+  between says how many did, so the caller knows what the write left behind.
+*/
+
+var (
+	ErrNotFound             = errors.New("key not found")
+	ErrExists               = errors.New("key already exists")
+	ErrUnavailable          = errors.New("machine unavailable")
+	ErrInsufficientReplicas = errors.New("not enough replicas answered")
+	ErrTimeout              = errors.New("timed out")
+	ErrRedirectLoop         = errors.New("redirected too many times")
+	ErrCanceled             = errors.New("canceled")
+	ErrInvalidToken         = errors.New("invalid scan token")
+	ErrConditionFailed      = errors.New("condition failed")
+	ErrLocked               = errors.New("key locked by a transaction")
+	ErrAborted              = errors.New("transaction aborted")
+	ErrNoStorage            = errors.New("no data directory to record transactions in")
+	ErrUnknownOutcome       = errors.New("transaction outcome unknown")
+)
+
+const (
+	//How long a machine gets to answer an RPC
+	rpcTimeout = 5 * time.Second
+
+	//How often a coordinator may send us to a newer one before we give up
+	maxRedirects = 8
+
+	//Attempts at reaching a coordinator before it counts as unavailable, only for calls Retryable allows
+	coordinatorAttempts = 3
+)
+
+type OpError struct {
+	Op      string
+	Key     int
+	Address string
+
+	//One of the errors above, and what went wrong underneath if there is more to say
+	Err   error
+	Cause error
+}
+
+func (self *OpError) Error() string {
+	message := ""
+	if self.Op != "" {
+		message = self.Op + " " + strconv.Itoa(self.Key) + " "
+	}
+	if self.Address != "" {
+		message += "on " + self.Address + " "
+	}
+	message = strings.TrimSuffix(message, " ")
+	if message != "" {
+		message += ": "
+	}
+	message += self.Err.Error()
+	if self.Cause != nil {
+		message += ": " + self.Cause.Error()
+	}
+	return message
+}
+
+func (self *OpError) Unwrap() error {
+	return self.Err
+}
+
+// Say which operation the error came from, keeping the machine it happened on if there was one
+func NewOpError(op string, key int, address string, err error) error {
+	var machineErr *OpError
+	if errors.As(err, &machineErr) {
+		wrapped := *machineErr
+		wrapped.Op, wrapped.Key = op, key
+		return &wrapped
+	}
+	return &OpError{Op: op, Key: key, Address: address, Err: err}
+}
+
+// How far an operation got before it failed, Done out of the Needed replicas answered or keys were sent
+type ProgressError struct {
+	Err    error
+	Done   int
+	Needed int
+	What   string
+}
+
+func (self *ProgressError) Error() string {
+	return fmt.Sprintf("%s: %d of %d %s", self.Err, self.Done, self.Needed, self.What)
+}
+
+// Too few replicas is also a machine being unavailable, errors.Is finds either
+func (self *ProgressError) Unwrap() []error {
+	if self.Err == ErrInsufficientReplicas {
+		return []error{self.Err, ErrUnavailable}
+	}
+	return []error{self.Err}
+}
+
+// Our error for a context that is done
+func contextError(err error) error {
+	if err == context.Canceled {
+		return ErrCanceled
+	}
+	return ErrTimeout
+}
+
+/*
+  Errors in replies. net/rpc sends only the text of an error a handler
+  returns, and no reply with it, so handlers put theirs in the reply instead.
+  An RpcError says which of our errors it is by its code, and carries what an
+  OpError or a ProgressError wraps along with it.
+*/
+
+const (
+	codeOther = iota
+	codeOp
+	codeProgress
+	codeNotFound
+	codeExists
+	codeUnavailable
+	codeInsufficientReplicas
+	codeTimeout
+	codeRedirectLoop
+	codeCanceled
+	codeInvalidToken
+	codeConditionFailed
+	codeLocked
+	codeAborted
+	codeNoStorage
+	codeUnknownOutcome
+)
+
+var errorCodes = map[int]error{
+	codeNotFound:             ErrNotFound,
+	codeExists:               ErrExists,
+	codeUnavailable:          ErrUnavailable,
+	codeInsufficientReplicas: ErrInsufficientReplicas,
+	codeTimeout:              ErrTimeout,
+	codeRedirectLoop:         ErrRedirectLoop,
+	codeCanceled:             ErrCanceled,
+	codeInvalidToken:         ErrInvalidToken,
+	codeConditionFailed:      ErrConditionFailed,
+	codeLocked:               ErrLocked,
+	codeAborted:              ErrAborted,
+	codeNoStorage:            ErrNoStorage,
+	codeUnknownOutcome:       ErrUnknownOutcome,
+}
+
+type RpcError struct {
+	Code int
+
+	//The text of an error that isn't ours
+	Message string
+
+	//What an OpError says and wraps
+	Op      string
+	Key     int
+	Address string
+	Err     *RpcError
+	Cause   *RpcError
+
+	//How far a ProgressError got
+	Done   int
+	Needed int
+	What   string
+}
+
+// The error as it goes in a reply, nil if there is none
+func NewRpcError(err error) *RpcError {
+	if err == nil {
+		return nil
+	}
+	switch known := err.(type) {
+	case *OpError:
+		return &RpcError{Code: codeOp, Op: known.Op, Key: known.Key, Address: known.Address,
+			Err: NewRpcError(known.Err), Cause: NewRpcError(known.Cause)}
+	case *ProgressError:
+		return &RpcError{Code: codeProgress, Err: NewRpcError(known.Err), Done: known.Done, Needed: known.Needed, What: known.What}
+	}
+	for code, known := range errorCodes {
+		if err == known {
+			return &RpcError{Code: code}
+		}
+	}
+	return &RpcError{Code: codeOther, Message: err.Error(), Err: NewRpcError(errors.Unwrap(err))}
+}
+
+// The error the reply came with, the way the handler returned it
+func (self *RpcError) Unpack() error {
+	if self == nil {
+		return nil
+	}
+	switch self.Code {
+	case codeOp:
+		return &OpError{Op: self.Op, Key: self.Key, Address: self.Address, Err: self.Err.Unpack(), Cause: self.Cause.Unpack()}
+	case codeProgress:
+		return &ProgressError{Err: self.Err.Unpack(), Done: self.Done, Needed: self.Needed, What: self.What}
+	case codeOther:
+		return &remoteError{self.Message, self.Err.Unpack()}
+	}
+	if known, found := errorCodes[self.Code]; found {
+		return known
+	}
+	return fmt.Errorf("unknown error code %d", self.Code)
+}
+
+// An error that isn't ours, keeping what it wraps
+type remoteError struct {
+	message string
+	err     error
+}
+
+func (self *remoteError) Error() string {
+	return self.message
+}
+
+func (self *remoteError) Unwrap() error {
+	return self.err
+}
+
+// Replies with an error in them
+type errorReply interface {
+	replyError() error
+}
+
+// A call that never left this machine, because we couldn't connect
+type unsentError struct {
+	err error
+}
+
+func (self *unsentError) Error() string {
+	return self.err.Error()
+}
+
+func (self *unsentError) Unwrap() error {
+	return self.err
+}
+
+/*
+  Whether a call to function that failed with err can be sent again without
+  the risk of applying it twice: the machine never got it, or the call does
+  the same however often it arrives
+*/
+func Retryable(function string, err error) bool {
+	if !errors.Is(err, ErrUnavailable) {
+		return false
+	}
+	if retriedCalls[function] {
+		return true
+	}
+	var opErr *OpError
+	var unsent *unsentError
+	return errors.As(err, &opErr) && errors.As(opErr.Cause, &unsent)
+}
+
+// Turn what an RPC to address returned into one of our errors
+func callError(function, address string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(rpc.ServerError); ok {
+		return fmt.Errorf("%s on %s: %w", function, address, err)
+	}
+	if errors.Is(err, ErrTimeout) || errors.Is(err, ErrCanceled) {
+		return &OpError{Address: address, Err: err, Cause: errors.New(function)}
+	}
+	return &OpError{Address: address, Err: ErrUnavailable, Cause: err}
+}
@@ -0,0 +1,50 @@
+package ring
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+/*
+  Keys written with a time to live. Readers stop seeing a value as soon as it
+  expires, wherever the copy they read is. Every so often the coordinator of
+  a key whose values all expired writes a tombstone over them and sends it to
+  the other replicas, the value is then gone from every table and the
+  tombstone is collected like that of any removed key.
+
+  A value that expired next to a concurrent one that didn't stays hidden until
+  the key is written again, a tombstone would replace both.
+*/
+
+const (
+	expiryInterval = 5 * time.Second
+)
+
+func (self *Ring) ExpirySweeper(interval time.Duration) {
+	for self.Active {
+		time.Sleep(interval)
+		self.sweepExpired()
+	}
+}
+
+func (self *Ring) sweepExpired() {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	expired := 0
+	for _, item := range self.localData() {
+		if !item.Expired() || self.getMachineForKey(item.Key).Value != myAddr {
+			continue
+		}
+		tombstone, ok := self.expireLocal(item.Key)
+		if !ok {
+			continue
+		}
+		if self.writeToReplicas(&tombstone) != 1 {
+			fmt.Println("Could not remove expired key", item.Key, "from every replica, it was handed off")
+		}
+		expired++
+	}
+	if expired > 0 {
+		fmt.Println("Removed", expired, "expired keys")
+	}
+}
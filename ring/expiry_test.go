@@ -0,0 +1,68 @@
+package ring
+
+import (
+	"../data"
+	"testing"
+	"time"
+)
+
+func testExpiring(key int, value string, clock data.VectorClock, expires time.Time) data.DataStore {
+	item := testVersion(key, value, clock)
+	item.Meta.Expires = expires
+	return item
+}
+
+/*
+  What b:1 holds before the sweep, and whether the key is removed by it. b:1
+  owns the keys from 11 to 20, a:1 the rest
+*/
+var sweepCases = []struct {
+	name    string
+	item    data.DataStore
+	locked  bool
+	removed bool
+}{
+	{"expired", testExpiring(12, "gone", data.VectorClock{"b:1": 1}, time.Now().Add(-time.Minute)), false, true},
+	{"expires later", testExpiring(13, "kept", data.VectorClock{"b:1": 1}, time.Now().Add(time.Hour)), false, false},
+	{"no time to live", testVersion(14, "kept", data.VectorClock{"b:1": 1}), false, false},
+	{"next to a live sibling", data.DataStore{
+		Key:      16,
+		Version:  testExpiring(16, "gone", data.VectorClock{"b:1": 1}, time.Now().Add(-time.Minute)).Version,
+		Siblings: []data.Version{testVersion(16, "kept", data.VectorClock{"a:1": 1}).Version},
+	}, false, false},
+	{"locked by a transaction", testExpiring(17, "kept", data.VectorClock{"b:1": 1}, time.Now().Add(-time.Minute)), true, false},
+	{"coordinated by a:1", testExpiring(5, "kept", data.VectorClock{"a:1": 1}, time.Now().Add(-time.Minute)), false, false},
+}
+
+func TestSweepExpired(t *testing.T) {
+	ring := testReplicaRing(t, 1)
+	ring.updateMember(data.NewGroupMember(10, "a:1", 0, Stable))
+	for _, c := range sweepCases {
+		ring.mergeLocal(&c.item)
+		if c.locked {
+			ring.txns.locks[c.item.Key] = "txn"
+		}
+	}
+
+	ring.sweepExpired()
+
+	for _, c := range sweepCases {
+		item, found := ring.getLocal(c.item.Key)
+		if !found {
+			t.Errorf("%s: key %d is gone, expired keys leave a tombstone", c.name, c.item.Key)
+			continue
+		}
+		//An expired value reads as removed already, only the tombstone tells the sweep got to it
+		removed := false
+		for _, version := range item.Versions() {
+			removed = removed || version.Deleted
+		}
+		if removed != c.removed {
+			t.Errorf("%s: removed %v, want %v", c.name, removed, c.removed)
+		}
+		//The tombstone replaces what expired, so it wins over the copies the other replicas still hold
+		if c.removed && !item.Context().Descends(c.item.Context()) {
+			t.Errorf("%s: tombstone %v doesn't replace %v", c.name, item, c.item)
+		}
+	}
+}
@@ -9,6 +9,8 @@ import (
 
 //Get a random member from the table -- Changed so that uses first table which is client + server whereas second table is only servers
 func (self *Ring) getRandomMember() *data.GroupMember {
+	self.membersLock.RLock()
+	defer self.membersLock.RUnlock()
 
 	tableLength := len(self.Usertable)
 
@@ -18,7 +20,7 @@ func (self *Ring) getRandomMember() *data.GroupMember {
   for _, value := range self.Usertable {
     if receiverIndex == i {
       if value.Id != -1 {
-        return value
+        return self.memberCopy(value.Address)
       } else {
         receiverIndex = (receiverIndex + 1) % tableLength
       }
@@ -29,7 +31,7 @@ func (self *Ring) getRandomMember() *data.GroupMember {
   // Restart from beginning, looking for first live member
   for _, value := range self.Usertable {
     if value.Id != -1 {
-      return value
+      return self.memberCopy(value.Address)
     }
   }
 
@@ -49,6 +51,9 @@ func (self *Ring) getSuccessorKey(key int) int {
 
 //Gets the successor
 func (self *Ring) getSuccessor(key int) data.LocationStore {
+	self.membersLock.RLock()
+	defer self.membersLock.RUnlock()
+
 	//Find successor
 	successorItem := self.UserKeyTable.FindGE(data.LocationStore{key + 1, ""})
 	me := self.UserKeyTable.FindLE(data.LocationStore{key, ""})
@@ -76,6 +81,9 @@ func (self *Ring) getSuccessor(key int) data.LocationStore {
 //Gets the predecessor
 func (self *Ring) getPredecessor(key int) data.LocationStore {
 
+	self.membersLock.RLock()
+	defer self.membersLock.RUnlock()
+
 	//Find predecessor
 	item := self.UserKeyTable.FindLE(data.LocationStore{key - 1, ""})
 	me := self.UserKeyTable.FindLE(data.LocationStore{key, ""})
@@ -98,5 +106,5 @@ func (self *Ring) getPredecessor(key int) data.LocationStore {
 func (self *Ring) getKey() int {
 
 	myAddr := net.JoinHostPort(self.Address, self.Port)
-	return self.Usertable[myAddr].Id
+	return self.getMember(myAddr).Id
 }
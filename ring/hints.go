@@ -0,0 +1,251 @@
+package ring
+
+import (
+	"../data"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+  Hinted handoff. When a replica can't be reached, the write is handed to a
+  fallback machine instead, together with a hint saying who it was meant for.
+  The fallback keeps hints apart from its own data and replays them once gossip
+  shows the replica is alive again. Hints that can't be delivered in time are
+  dropped, anti-entropy has to catch those keys up.
+*/
+
+const (
+	hintInterval = 1 * time.Second
+	hintExpiry   = 1 * time.Hour
+)
+
+// A write meant for Target that we hold on to until it's back
+type Hint struct {
+	Target  string
+	Data    data.DataStore
+	Created time.Time
+}
+
+type HintStats struct {
+	Pending  int
+	Stored   int
+	Replayed int
+	Expired  int
+	ByTarget map[string]int
+}
+
+// The hints held by this machine, at most one per key and target
+type HintStore struct {
+	hints map[string]map[int]Hint
+	stats HintStats
+	lock  sync.Mutex
+}
+
+func NewHintStore() *HintStore {
+	return &HintStore{hints: make(map[string]map[int]Hint)}
+}
+
+// Keep a hint, merging it with an older one for the same key and target
+func (self *HintStore) Add(hint Hint) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if hint.Created.IsZero() {
+		hint.Created = time.Now()
+	}
+	forTarget := self.hints[hint.Target]
+	if forTarget == nil {
+		forTarget = make(map[int]Hint)
+		self.hints[hint.Target] = forTarget
+	}
+	if older, found := forTarget[hint.Data.Key]; found {
+		hint.Data.Merge(&older.Data)
+		hint.Created = older.Created
+	} else {
+		self.stats.Pending++
+	}
+	forTarget[hint.Data.Key] = hint
+	self.stats.Stored++
+}
+
+// The machines we hold hints for
+func (self *HintStore) Targets() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	targets := make([]string, 0, len(self.hints))
+	for target := range self.hints {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// The hints for a target, dropping the ones that expired
+func (self *HintStore) For(target string) []Hint {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	hints := make([]Hint, 0, len(self.hints[target]))
+	for key, hint := range self.hints[target] {
+		if time.Since(hint.Created) > hintExpiry {
+			self.drop(target, key)
+			self.stats.Expired++
+			continue
+		}
+		hints = append(hints, hint)
+	}
+	return hints
+}
+
+// The hint made it to its target. A newer write merged into it since it was read stays for the next replay
+func (self *HintStore) Delivered(hint Hint) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	held, found := self.hints[hint.Target][hint.Data.Key]
+	if found && !hint.Data.Context().Descends(held.Data.Context()) {
+		return
+	}
+	self.drop(hint.Target, hint.Data.Key)
+	self.stats.Replayed++
+}
+
+func (self *HintStore) Stats() HintStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	stats := self.stats
+	stats.ByTarget = make(map[string]int)
+	for target, hints := range self.hints {
+		stats.ByTarget[target] = len(hints)
+	}
+	return stats
+}
+
+// Expects the lock to be held
+func (self *HintStore) drop(target string, key int) {
+	if _, found := self.hints[target][key]; !found {
+		return
+	}
+	delete(self.hints[target], key)
+	self.stats.Pending--
+	if len(self.hints[target]) == 0 {
+		delete(self.hints, target)
+	}
+}
+
+/*
+  Handing writes off
+*/
+
+// The machines right after the key's preference list, they stand in for replicas that are down
+func (self *Ring) fallbacksForKey(key, N int) []*data.GroupMember {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	fallbacks := make([]*data.GroupMember, 0, N)
+	members := self.preferenceList(key, 2*N+1)
+	for i := N + 1; i < len(members); i++ {
+		if members[i].Address != myAddr {
+			fallbacks = append(fallbacks, members[i])
+		}
+	}
+	return fallbacks
+}
+
+/*
+  Store the write meant for target on the first fallback that takes it, or on
+  this machine if none does. Every fallback stands in for one replica only.
+  Returns whether another machine holds the write now, a hint we keep
+  ourselves is no copy anywhere else and doesn't count as one. Once the
+  context is done the hint is kept here without asking anyone else.
+*/
+func (self *Ring) handOff(ctx context.Context, target string, item *data.DataStore, fallbacks *[]*data.GroupMember) bool {
+	hint := &Hint{Target: target, Data: *item, Created: time.Now()}
+	for len(*fallbacks) > 0 && ctx.Err() == nil {
+		fallback := (*fallbacks)[0]
+		*fallbacks = (*fallbacks)[1:]
+		if fallback.Address == target {
+			continue
+		}
+
+		var result RpcResult
+		err := callMachineContext(ctx, fallback.Address, "Ring.StoreHint", hint, &result)
+		if err == nil && result.Success == 1 {
+			fmt.Println("Handed write for", target, "to", fallback.Address)
+			return true
+		}
+		fmt.Println("Fallback", fallback.Address, "did not take the hint", err)
+	}
+	fmt.Println("Keeping hint for", target)
+	self.Hints.Add(*hint)
+	return false
+}
+
+/*
+  Replaying hints
+*/
+
+func (self *Ring) HintedHandoff(interval time.Duration) {
+	for self.Active {
+		self.replayHints()
+		time.Sleep(interval)
+	}
+}
+
+// Deliver the hints of every target that is alive again
+func (self *Ring) replayHints() {
+	for _, target := range self.Hints.Targets() {
+		hints := self.Hints.For(target)
+		if len(hints) == 0 || !self.isAlive(target) {
+			continue
+		}
+		fmt.Println("Replaying", len(hints), "hints to", target)
+		for _, hint := range hints {
+			var result RpcResult
+			err := callMachine(target, "Ring.WriteData", &hint.Data, &result)
+			if err != nil || result.Success != 1 {
+				fmt.Println("Could not replay hint to", target, err)
+				break
+			}
+			self.Hints.Delivered(hint)
+		}
+	}
+}
+
+// Whether the failure detector thinks the machine is up, Chord doesn't gossip so we ask it directly
+func (self *Ring) isAlive(address string) bool {
+	if self.getChord() != nil {
+		var alive bool
+		return callMachine(address, "Ring.Ping", 0, &alive) == nil && alive
+	}
+	member := self.getMember(address)
+	return member != nil && member.Id != -1 && member.State == data.Alive
+}
+
+func (self *Ring) PrintHints() {
+	stats := self.Hints.Stats()
+	fmt.Printf("Printing Hints: %d pending, %d stored, %d replayed, %d expired\n",
+		stats.Pending, stats.Stored, stats.Replayed, stats.Expired)
+	for target, pending := range stats.ByTarget {
+		fmt.Println(target, pending)
+	}
+}
+
+/*
+  Exposed over RPC
+*/
+
+// Hold on to a write for a replica that is down
+func (self *Ring) StoreHint(hint *Hint, response *RpcResult) error {
+	self.Hints.Add(*hint)
+	response.Success = 1
+	return nil
+}
+
+func (self *Ring) GetHintStats(unused int, stats *HintStats) error {
+	*stats = self.Hints.Stats()
+	return nil
+}
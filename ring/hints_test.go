@@ -0,0 +1,101 @@
+package ring
+
+import (
+	"../data"
+	"net"
+	"net/http"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func testHint(target string, item data.DataStore) Hint {
+	return Hint{Target: target, Data: item}
+}
+
+func TestHintStore(t *testing.T) {
+	store := NewHintStore()
+	store.Add(testHint("c:1", newer))
+	store.Add(testHint("c:1", concurrent))
+	store.Add(testHint("a:1", older))
+
+	//Two writes of a key for the same machine are one hint holding both
+	hints := store.For("c:1")
+	if len(hints) != 1 || len(hints[0].Data.Versions()) != 2 {
+		t.Fatalf("hints for c:1: %v", hints)
+	}
+	if targets := store.Targets(); len(targets) != 2 || targets[0] != "a:1" || targets[1] != "c:1" {
+		t.Errorf("targets %v, want [a:1 c:1]", targets)
+	}
+	if stats := store.Stats(); stats.Pending != 2 || stats.Stored != 3 || stats.ByTarget["c:1"] != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	//A write that came in after the hint was read stays for the next replay
+	stale := store.For("a:1")[0]
+	store.Add(testHint("a:1", testVersion(1, "newest", data.VectorClock{"a:1": 3})))
+	store.Delivered(stale)
+	if hints := store.For("a:1"); len(hints) != 1 || string(hints[0].Data.Value) != "newest" {
+		t.Errorf("hints for a:1 after a stale delivery: %v", hints)
+	}
+
+	store.Delivered(hints[0])
+	if hints := store.For("c:1"); len(hints) != 0 {
+		t.Errorf("hints for c:1 after delivery: %v", hints)
+	}
+	if stats := store.Stats(); stats.Pending != 1 || stats.Replayed != 1 {
+		t.Errorf("stats after delivery %+v", stats)
+	}
+}
+
+func TestHintExpiry(t *testing.T) {
+	store := NewHintStore()
+	hint := testHint("c:1", older)
+	hint.Created = time.Now().Add(-hintExpiry - time.Minute)
+	store.Add(hint)
+	store.Add(testHint("c:1", testVersion(2, "fresh", data.VectorClock{"a:1": 1})))
+
+	if hints := store.For("c:1"); len(hints) != 1 || hints[0].Data.Key != 2 {
+		t.Errorf("hints %v, want only the one for key 2", hints)
+	}
+	if stats := store.Stats(); stats.Pending != 1 || stats.Expired != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+// Hints go to their target once it is alive, and are kept until then
+func TestReplayHints(t *testing.T) {
+	target := testStorageRing()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := rpc.NewServer()
+	if err := server.RegisterName("Ring", target); err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, server)
+	address := listener.Addr().String()
+
+	ring := testReplicaRing(t, 1)
+	ring.Hints = NewHintStore()
+	ring.Hints.Add(testHint(address, newer))
+
+	//Nobody told us about the target yet
+	ring.replayHints()
+	if _, found := target.getLocal(1); found {
+		t.Fatal("hint replayed to a machine we don't know of")
+	}
+
+	member := data.NewGroupMember(30, address, 0, Stable)
+	member.State = data.Alive
+	ring.updateMember(member)
+	ring.replayHints()
+	if item, found := target.getLocal(1); !found || !data.SameVersions(&item, &newer) {
+		t.Errorf("target holds %v, %v after the replay", item, found)
+	}
+	if stats := ring.Hints.Stats(); stats.Pending != 0 || stats.Replayed != 1 {
+		t.Errorf("stats after the replay %+v", stats)
+	}
+}
@@ -0,0 +1,308 @@
+package ring
+
+import (
+	"../data"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+  Anti-entropy. Every so often each machine builds a Merkle tree over every key
+  range it owns and compares it with the same tree built by each replica of the
+  range. Equal roots mean the replicas agree. Otherwise we walk down the
+  branches that differ until we reach the leaves, and only the keys in those
+  leaves are exchanged and merged on both sides.
+
+  The leaves split the range into equal slices of the key space, so both sides
+  put every key in the same leaf without having to agree on anything else.
+
+  The replica builds its tree once per round, on the first request of it, and
+  answers the rest of the round's requests from that tree.
+*/
+
+const (
+	antiEntropyInterval = 10 * time.Second
+	merkleDepth         = 8
+	merkleLeaves        = 1 << merkleDepth
+)
+
+// Asks for the hashes of some nodes of the tree over a range, or for the keys under some leaves
+type MerkleRequest struct {
+	Range data.KeyRange
+	Nodes []int
+
+	//When the asking machine built its tree, the same for every request of a round
+	Round int64
+}
+
+/*
+  Tree stored as an array: node i has children 2i+1 and 2i+2, the leaves are
+  the last merkleLeaves entries.
+*/
+type MerkleTree struct {
+	keyRange data.KeyRange
+	hashes   []uint64
+	leaves   [][]data.DataStore
+	built    time.Time
+}
+
+// The trees built for the rounds replicas are going through with us
+type merkleCache struct {
+	trees map[merkleRound]*MerkleTree
+	lock  sync.Mutex
+}
+
+type merkleRound struct {
+	keyRange data.KeyRange
+	round    int64
+}
+
+func newMerkleCache() *merkleCache {
+	return &merkleCache{trees: make(map[merkleRound]*MerkleTree)}
+}
+
+func isMerkleLeaf(node int) bool {
+	return node >= merkleLeaves-1
+}
+
+// Leaf of the tree the key falls in
+func merkleLeafFor(keyRange *data.KeyRange, keySpace int, key int) int {
+	space := uint64(keySpace)
+	length := (uint64(keyRange.End) + space - uint64(keyRange.Start)) % space
+	if length == 0 {
+		length = space
+	}
+	offset := (uint64(key) + space - uint64(keyRange.Start) - 1) % space
+
+	//offset * merkleLeaves / length without overflowing
+	hi, lo := bits.Mul64(offset, merkleLeaves)
+	leaf, _ := bits.Div64(hi, lo, length)
+	return int(leaf)
+}
+
+func (self *Ring) buildMerkleTree(keyRange *data.KeyRange) *MerkleTree {
+	tree := &MerkleTree{
+		keyRange: *keyRange,
+		hashes:   make([]uint64, 2*merkleLeaves-1),
+		leaves:   make([][]data.DataStore, merkleLeaves),
+		built:    time.Now(),
+	}
+
+	//localData is in key order, so every leaf is too
+	for _, item := range self.localData() {
+		if keyRange.Contains(item.Key) {
+			leaf := merkleLeafFor(keyRange, self.KeySpace(), item.Key)
+			tree.leaves[leaf] = append(tree.leaves[leaf], item)
+		}
+	}
+
+	for leaf, items := range tree.leaves {
+		if len(items) == 0 {
+			continue
+		}
+		h := sha1.New()
+		for i := range items {
+			writeItemDigest(h, &items[i])
+		}
+		tree.hashes[merkleLeaves-1+leaf] = sum64(h)
+	}
+	for node := merkleLeaves - 2; node >= 0; node-- {
+		left, right := tree.hashes[2*node+1], tree.hashes[2*node+2]
+		if left == 0 && right == 0 {
+			continue
+		}
+		h := sha1.New()
+		binary.Write(h, binary.BigEndian, left)
+		binary.Write(h, binary.BigEndian, right)
+		tree.hashes[node] = sum64(h)
+	}
+	return tree
+}
+
+// Everything two replicas have to agree on for a key
+func writeItemDigest(h hash.Hash, item *data.DataStore) {
+	binary.Write(h, binary.BigEndian, int64(item.Key))
+	for _, version := range data.Reconcile(item.Versions()) {
+		h.Write(version.Value)
+		if version.Deleted {
+			h.Write([]byte{0})
+		}
+		h.Write([]byte(version.Clock.String()))
+	}
+}
+
+func sum64(h hash.Hash) uint64 {
+	return binary.BigEndian.Uint64(h.Sum(nil)[:8])
+}
+
+/*
+  The ranges this machine owns, the first of their preference lists
+*/
+func (self *Ring) ownedRanges() []*data.KeyRange {
+	chord := self.getChord()
+	ranges := make([]*data.KeyRange, 0)
+	if chord != nil {
+		predecessor := chord.getPredecessor()
+		if predecessor.Key != -1 {
+			ranges = append(ranges, data.NewKeyRange(predecessor.Key, chord.self.Key))
+		}
+		return ranges
+	}
+	for _, token := range self.myTokens() {
+		predecessor := self.getPredecessor(token)
+		if predecessor.Key == -1 {
+			predecessor.Key = token
+		}
+		ranges = append(ranges, data.NewKeyRange(predecessor.Key, token))
+	}
+	return ranges
+}
+
+func (self *Ring) AntiEntropy(interval time.Duration) {
+	for self.Active {
+		time.Sleep(interval)
+		self.catchUpReplication()
+		self.doAntiEntropy()
+	}
+}
+
+func (self *Ring) doAntiEntropy() {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	if self.getMember(myAddr) == nil {
+		return
+	}
+	for _, owned := range self.ownedRanges() {
+		//Every key of a piece has the same replicas
+		for _, keyRange := range self.settings().splitByNamespace(owned) {
+			self.syncWithReplicas(keyRange)
+		}
+	}
+}
+
+func (self *Ring) syncWithReplicas(keyRange *data.KeyRange) {
+	tree := self.buildMerkleTree(keyRange)
+	for _, peer := range self.replicasForKey(keyRange.End, self.replicasFor(keyRange.End)-1) {
+		if err := self.syncRange(tree, peer.Address); err != nil {
+			fmt.Println("Anti-entropy with", peer.Address, "failed:", err)
+		}
+	}
+}
+
+// Compare our tree with the peer's, level by level, and exchange the keys under the leaves that differ
+func (self *Ring) syncRange(tree *MerkleTree, peer string) error {
+	differing := make([]int, 0)
+	nodes := []int{0}
+	for len(nodes) > 0 {
+		var theirs []uint64
+		err := callMachine(peer, "Ring.GetMerkleHashes", &MerkleRequest{tree.keyRange, nodes, tree.built.UnixNano()}, &theirs)
+		if err != nil {
+			return err
+		}
+
+		next := make([]int, 0)
+		for i, node := range nodes {
+			if i >= len(theirs) || tree.hashes[node] == theirs[i] {
+				continue
+			}
+			if isMerkleLeaf(node) {
+				differing = append(differing, node)
+			} else {
+				next = append(next, 2*node+1, 2*node+2)
+			}
+		}
+		nodes = next
+	}
+	if len(differing) == 0 {
+		return nil
+	}
+
+	var theirItems []data.DataStore
+	err := callMachine(peer, "Ring.GetMerkleLeaves", &MerkleRequest{tree.keyRange, differing, tree.built.UnixNano()}, &theirItems)
+	if err != nil {
+		return err
+	}
+
+	theirKeys := make(map[int]data.DataStore)
+	for _, item := range theirItems {
+		theirKeys[item.Key] = item
+	}
+	pushed, pulled := 0, 0
+
+	//Take what they have, then send back whatever they are missing or have an older version of
+	for _, item := range theirItems {
+		mine, found := self.getLocal(item.Key)
+		if !found || !data.SameVersions(&mine, &item) {
+			self.mergeLocal(&item)
+			pulled++
+		}
+	}
+	for _, node := range differing {
+		for _, mine := range tree.leaves[node-(merkleLeaves-1)] {
+			merged, _ := self.getLocal(mine.Key)
+			theirs, found := theirKeys[mine.Key]
+			if found && data.SameVersions(&merged, &theirs) {
+				continue
+			}
+			var result RpcResult
+			if err := callMachine(peer, "Ring.WriteData", &merged, &result); err != nil {
+				return err
+			}
+			pushed++
+		}
+	}
+	fmt.Printf("Anti-entropy with %s: %d leaves differ, pulled %d keys, pushed %d\n", peer, len(differing), pulled, pushed)
+	return nil
+}
+
+/*
+  Exposed over RPC for the replica comparing trees with us
+*/
+func (self *Ring) GetMerkleHashes(request *MerkleRequest, hashes *[]uint64) error {
+	tree := self.merkleTreeFor(request)
+	result := make([]uint64, len(request.Nodes))
+	for i, node := range request.Nodes {
+		if node >= 0 && node < len(tree.hashes) {
+			result[i] = tree.hashes[node]
+		}
+	}
+	*hashes = result
+	return nil
+}
+
+func (self *Ring) GetMerkleLeaves(request *MerkleRequest, items *[]data.DataStore) error {
+	tree := self.merkleTreeFor(request)
+	result := make([]data.DataStore, 0)
+	for _, node := range request.Nodes {
+		if isMerkleLeaf(node) && node < len(tree.hashes) {
+			result = append(result, tree.leaves[node-(merkleLeaves-1)]...)
+		}
+	}
+	*items = result
+	return nil
+}
+
+// Our tree for the request's round, built on its first request. Trees of rounds that should be over are dropped
+func (self *Ring) merkleTreeFor(request *MerkleRequest) *MerkleTree {
+	cache := self.merkleTrees
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	round := merkleRound{request.Range, request.Round}
+	if tree, found := cache.trees[round]; found {
+		return tree
+	}
+	for old, tree := range cache.trees {
+		if time.Since(tree.built) > antiEntropyInterval {
+			delete(cache.trees, old)
+		}
+	}
+	tree := self.buildMerkleTree(&request.Range)
+	cache.trees[round] = tree
+	return tree
+}
@@ -0,0 +1,333 @@
+package ring
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+  Connections to other machines are kept open and shared instead of dialing
+  for every call. An rpc.Client can carry many calls at once, so each machine
+  gets a handful of them and a call goes to the least busy one, opening
+  another only when they are all in use.
+
+  A connection that fails is closed and dropped. If it was one we had kept
+  around, the machine may just have restarted, and a call that does the same
+  however often it arrives is tried once more on a fresh connection. Any other
+  call may have been applied with only the answer lost, so it fails instead.
+  Every so often connections nobody used for a while are closed, and the
+  others are pinged so dead ones don't wait for a call to find out.
+
+  A call whose context is done stops waiting, but keeps its connection: the
+  answer is read when it comes and thrown away, so other calls on it go on.
+  A machine that stopped answering altogether is found by the pings.
+*/
+
+const (
+	maxConnsPerPeer   = 4
+	poolIdleTimeout   = 1 * time.Minute
+	poolCheckInterval = 10 * time.Second
+	dialTimeout       = 2 * time.Second
+)
+
+type pooledConn struct {
+	client   *rpc.Client
+	inFlight int
+	lastUsed time.Time
+}
+
+type PoolStats struct {
+	Dials      int
+	Reuses     int
+	Reconnects int
+	Evicted    int
+}
+
+type ConnPool struct {
+	peers       map[string][]*pooledConn
+	stats       PoolStats
+	maintaining sync.Once
+	lock        sync.Mutex
+}
+
+// Shared by everything in this process that talks to other machines
+var connections = NewConnPool()
+
+// Reads, and writes merging versions a replica may already hold, can be sent twice
+var retriedCalls = map[string]bool{
+	"Ring.Ping":              true,
+	"Ring.GetData":           true,
+	"Ring.GetDataConsistent": true,
+	"Ring.ReadData":          true,
+	"Ring.ReadBatch":         true,
+	"Ring.ReadRange":         true,
+	"Ring.MultiGetData":      true,
+	"Ring.ScanRange":         true,
+	"Ring.GetEntryData":      true,
+	"Ring.GetMembers":        true,
+	"Ring.GetRingView":       true,
+	"Ring.GetConfig":         true,
+	"Ring.GetCommandLog":     true,
+	"Ring.GetMerkleHashes":   true,
+	"Ring.GetMerkleLeaves":   true,
+	"Ring.GetSuccessor":      true,
+	"Ring.FindSuccessor":     true,
+	"Ring.GetSuccessorList":  true,
+	"Ring.GetPredecessor":    true,
+	"Ring.GetHintStats":      true,
+	"Ring.WatchEvents":       true,
+	"Ring.WatchOwners":       true,
+	"Ring.TxnStatus":         true,
+	"Ring.WriteData":         true,
+	"Ring.WriteBatch":        true,
+	"Ring.StoreHint":         true,
+}
+
+/*
+Calls moving many keys at once take as long as the keys take to send, they
+don't get rpcTimeout and only stop when their context is done or the
+connection breaks
+*/
+var bulkCalls = map[string]bool{
+	"Ring.GetEntryData":    true,
+	"Ring.GetMerkleLeaves": true,
+	"Ring.MultiGetData":    true,
+	"Ring.MultiPutData":    true,
+	"Ring.MultiDeleteData": true,
+	"Ring.ReadBatch":       true,
+	"Ring.WriteBatch":      true,
+	"Ring.SendLeaveData":   true,
+}
+
+func NewConnPool() *ConnPool {
+	return &ConnPool{peers: make(map[string][]*pooledConn)}
+}
+
+// Make an RPC to the machine over one of our connections to it
+func (self *ConnPool) Call(ctx context.Context, address, function string, args interface{}, reply interface{}) error {
+	self.maintaining.Do(func() { go self.Maintain(poolCheckInterval) })
+
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := self.acquire(ctx, address)
+		if err != nil {
+			return &unsentError{err}
+		}
+		err = callTimeout(ctx, conn.client, function, args, reply)
+		broken := brokenConn(err) && err != ErrTimeout && err != ErrCanceled
+		self.release(address, conn, broken)
+
+		//The machine went away since we last used the connection, it may be back
+		if broken && reused && attempt == 0 && retriedCalls[function] {
+			self.lock.Lock()
+			self.stats.Reconnects++
+			self.lock.Unlock()
+			continue
+		}
+		return err
+	}
+}
+
+// The least busy connection to the machine, a new one if they are all busy and there is room
+func (self *ConnPool) acquire(ctx context.Context, address string) (*pooledConn, bool, error) {
+	self.lock.Lock()
+	var best *pooledConn
+	for _, conn := range self.peers[address] {
+		if best == nil || conn.inFlight < best.inFlight {
+			best = conn
+		}
+	}
+	if best != nil && (best.inFlight == 0 || len(self.peers[address]) >= maxConnsPerPeer) {
+		best.inFlight++
+		best.lastUsed = time.Now()
+		self.stats.Reuses++
+		self.lock.Unlock()
+		return best, true, nil
+	}
+	self.lock.Unlock()
+
+	client, err := dialMachine(ctx, address)
+	if err != nil {
+		return nil, false, err
+	}
+	conn := &pooledConn{client: client, inFlight: 1, lastUsed: time.Now()}
+	self.lock.Lock()
+	self.peers[address] = append(self.peers[address], conn)
+	self.stats.Dials++
+	self.lock.Unlock()
+	return conn, false, nil
+}
+
+func (self *ConnPool) release(address string, conn *pooledConn, broken bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	conn.inFlight--
+	if broken {
+		self.remove(address, conn)
+	}
+}
+
+// Expects the lock to be held
+func (self *ConnPool) remove(address string, conn *pooledConn) {
+	conns := self.peers[address]
+	for i := range conns {
+		if conns[i] == conn {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(self.peers, address)
+	} else {
+		self.peers[address] = conns
+	}
+	conn.client.Close()
+}
+
+// Close every connection to a machine, it's gone
+func (self *ConnPool) Drop(address string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, conn := range self.peers[address] {
+		conn.client.Close()
+	}
+	delete(self.peers, address)
+}
+
+// Whether the connection can't be used any more. Errors from the machine itself come over a working one
+func brokenConn(err error) bool {
+	if err == nil {
+		return false
+	}
+	var serverErr rpc.ServerError
+	return !errors.As(err, &serverErr)
+}
+
+/*
+  Idle eviction and health checks
+*/
+
+func (self *ConnPool) Maintain(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		self.evictIdle()
+		self.checkHealth()
+	}
+}
+
+func (self *ConnPool) evictIdle() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for address, conns := range self.peers {
+		for _, conn := range append([]*pooledConn{}, conns...) {
+			if conn.inFlight == 0 && time.Since(conn.lastUsed) > poolIdleTimeout {
+				self.remove(address, conn)
+				self.stats.Evicted++
+			}
+		}
+	}
+}
+
+// Ping the idle connections, the busy ones find out soon enough
+func (self *ConnPool) checkHealth() {
+	type idleConn struct {
+		address string
+		conn    *pooledConn
+	}
+	self.lock.Lock()
+	idle := make([]idleConn, 0)
+	for address, conns := range self.peers {
+		for _, conn := range conns {
+			if conn.inFlight == 0 {
+				conn.inFlight++
+				idle = append(idle, idleConn{address, conn})
+			}
+		}
+	}
+	self.lock.Unlock()
+
+	for _, checked := range idle {
+		var alive bool
+		err := callTimeout(context.Background(), checked.conn.client, "Ring.Ping", 0, &alive)
+		self.lock.Lock()
+		checked.conn.inFlight--
+		if brokenConn(err) {
+			self.remove(checked.address, checked.conn)
+			self.stats.Evicted++
+		}
+		self.lock.Unlock()
+	}
+}
+
+func (self *ConnPool) Stats() PoolStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stats
+}
+
+func (self *ConnPool) Print() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	addresses := make([]string, 0, len(self.peers))
+	for address := range self.peers {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	fmt.Printf("Connections: %d dialed, %d reused, %d reconnected, %d evicted\n",
+		self.stats.Dials, self.stats.Reuses, self.stats.Reconnects, self.stats.Evicted)
+	for _, address := range addresses {
+		busy := 0
+		for _, conn := range self.peers[address] {
+			busy += conn.inFlight
+		}
+		fmt.Println(" ", address, len(self.peers[address]), "open,", busy, "calls in flight")
+	}
+}
+
+func PrintConnections() {
+	connections.Print()
+}
+
+// rpc.DialHTTP without the wait for an unreachable machine
+func dialMachine(ctx context.Context, address string) (*rpc.Client, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, dialError(ctx, err)
+	}
+	deadline := time.Now().Add(dialTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, dialError(ctx, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
+
+// Dialing failed because the context ran out, or because the machine isn't there
+func dialError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return contextError(ctx.Err())
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return ErrTimeout
+	}
+	return err
+}
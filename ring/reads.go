@@ -0,0 +1,135 @@
+package ring
+
+import (
+	"../data"
+	"context"
+	"fmt"
+	"net"
+)
+
+/*
+  Reads at a consistency level. The machine coordinating the read asks as many
+  of the key's replicas as the level needs, merges what they hold and returns
+  the latest versions. Any replica seen with missing or older versions is
+  brought up to date in the background (read repair).
+*/
+
+// What one replica held for a key
+type replicaRead struct {
+	member *data.GroupMember
+	item   data.DataStore
+	found  bool
+	err    error
+}
+
+// Number of the key's n copies that have to answer a read, or take a write, at the given consistency level
+func copiesNeeded(consistency int, n int) int {
+	switch consistency {
+	case One:
+		return 1
+	case Quorum:
+		return quorum(n)
+	}
+	return n
+}
+
+/*
+  Ask the key's replicas for their copy until needed of them have answered,
+  or the context is done. Returns the merged versions, whether any replica had
+  the key, and how many answered out of how many had to. A ring too small to
+  hold needed copies can't answer, however many of its machines do.
+*/
+func (self *Ring) readFromReplicas(ctx context.Context, key int, needed int) (merged data.DataStore, found bool, answered int, wanted int) {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	members := self.preferenceList(key, self.replicasFor(key))
+
+	reads := make([]replicaRead, 0, len(members))
+	remote := make([]*data.GroupMember, 0, len(members))
+	for _, member := range members {
+		if member.Address == myAddr {
+			item, exists := self.getLocal(key)
+			reads = append(reads, replicaRead{member, item, exists, nil})
+		} else {
+			remote = append(remote, member)
+		}
+	}
+
+	//Ask everyone at once, but only wait for as many as we need
+	results := make(chan replicaRead, len(remote))
+	for _, member := range remote {
+		go func(member *data.GroupMember) {
+			var result RpcResult
+			err := callMachineContext(ctx, member.Address, "Ring.ReadData", data.NewDataStore(key, nil), &result)
+			results <- replicaRead{member, result.Data, result.Success == 1, err}
+		}(member)
+	}
+Waiting:
+	for waiting := len(remote); waiting > 0 && len(reads) < needed; waiting-- {
+		select {
+		case read := <-results:
+			if read.err != nil {
+				fmt.Println("Could not read from replica", read.member.Address, read.err)
+				continue
+			}
+			reads = append(reads, read)
+		case <-ctx.Done():
+			break Waiting
+		}
+	}
+
+	merged, found = mergeReads(key, reads)
+	if found {
+		go self.readRepair(&merged, reads)
+	}
+	return merged, found, len(reads), needed
+}
+
+// Every version the replicas hold for the key, and whether any of them had it
+func mergeReads(key int, reads []replicaRead) (merged data.DataStore, found bool) {
+	merged = *data.NewDataStore(key, nil)
+	for _, read := range reads {
+		if !read.found {
+			continue
+		}
+		if !found {
+			merged = read.item
+			found = true
+		} else {
+			merged.Merge(&read.item)
+		}
+	}
+	return merged, found
+}
+
+/*
+  Send the merged versions to every replica that answered with something older.
+  Runs detached from the read, which has answered by then, every call bounded
+  by rpcTimeout instead.
+*/
+func (self *Ring) readRepair(merged *data.DataStore, reads []replicaRead) {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	for _, read := range reads {
+		if read.found && data.SameVersions(&read.item, merged) {
+			continue
+		}
+		fmt.Println("Repairing key", merged.Key, "on", read.member.Address)
+		if read.member.Address == myAddr {
+			self.mergeLocal(merged)
+			continue
+		}
+		var result RpcResult
+		if err := callMachine(read.member.Address, "Ring.WriteData", merged, &result); err != nil {
+			fmt.Println("Read repair failed:", err)
+		}
+	}
+}
+
+/*
+  Exposed over RPC: what this machine holds for the key, without asking anyone else
+*/
+func (self *Ring) ReadData(args *data.DataStore, response *RpcResult) error {
+	item, found := self.getLocal(args.Key)
+	response.Success = Btoi(found)
+	response.Data = item
+	return nil
+}
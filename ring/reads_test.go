@@ -0,0 +1,141 @@
+package ring
+
+import (
+	"../data"
+	"../rbtree"
+	"context"
+	"testing"
+)
+
+func TestCopiesNeeded(t *testing.T) {
+	tests := []struct {
+		consistency int
+		n           int
+		want        int
+	}{
+		{One, 3, 1},
+		{Quorum, 1, 1},
+		{Quorum, 2, 2},
+		{Quorum, 3, 2},
+		{Quorum, 4, 3},
+		{Quorum, 5, 3},
+		{All, 3, 3},
+		{All, 1, 1},
+	}
+	for _, test := range tests {
+		if got := copiesNeeded(test.consistency, test.n); got != test.want {
+			t.Errorf("consistency %d of %d copies: got %d, want %d", test.consistency, test.n, got, test.want)
+		}
+	}
+}
+
+func testVersion(key int, value string, clock data.VectorClock) data.DataStore {
+	return data.DataStore{Key: key, Version: data.Version{Value: []byte(value), Clock: clock}}
+}
+
+var (
+	older      = testVersion(1, "old", data.VectorClock{"a:1": 1})
+	newer      = testVersion(1, "new", data.VectorClock{"a:1": 2})
+	concurrent = testVersion(1, "other", data.VectorClock{"a:1": 1, "c:1": 1})
+)
+
+// What a read returns once the replicas' answers are merged
+var mergeCases = []struct {
+	name   string
+	reads  []replicaRead
+	found  bool
+	values []string
+}{
+	{"nobody has it", []replicaRead{{}, {}}, false, nil},
+	{"one has it", []replicaRead{{}, {item: older, found: true}}, true, []string{"old"}},
+	{"newest wins", []replicaRead{{item: older, found: true}, {item: newer, found: true}}, true, []string{"new"}},
+	{"whatever the order", []replicaRead{{item: newer, found: true}, {item: older, found: true}}, true, []string{"new"}},
+	{"concurrent writes are siblings", []replicaRead{{item: newer, found: true}, {item: concurrent, found: true}}, true, []string{"new", "other"}},
+}
+
+func TestMergeReads(t *testing.T) {
+	for _, c := range mergeCases {
+		merged, found := mergeReads(1, c.reads)
+		if found != c.found || merged.Key != 1 {
+			t.Errorf("%s: got key %d found %v, want key 1 found %v", c.name, merged.Key, found, c.found)
+			continue
+		}
+		if !found {
+			continue
+		}
+		values := make(map[string]bool)
+		for _, version := range merged.Versions() {
+			values[string(version.Value)] = true
+		}
+		if len(values) != len(c.values) {
+			t.Errorf("%s: got %v, want %v", c.name, merged.Versions(), c.values)
+			continue
+		}
+		for _, value := range c.values {
+			if !values[value] {
+				t.Errorf("%s: got %v, want %v", c.name, merged.Versions(), c.values)
+			}
+		}
+	}
+}
+
+// A ring of one machine, b:1, holding every copy there is
+func testReplicaRing(t *testing.T, replicas int) *Ring {
+	ring := testStorageRing()
+	ring.Usertable = make(map[string]*data.GroupMember)
+	ring.UserKeyTable = rbtree.NewTree(func(a, b rbtree.Item) int {
+		return data.CompareKeys(a.(data.LocationStore).Key, b.(data.LocationStore).Key)
+	})
+	ring.Address, ring.Port = "b", "1"
+	config := DefaultConfig()
+	config.Replicas = replicas
+	if err := ring.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	ring.updateMember(data.NewGroupMember(20, "b:1", 0, Stable))
+	return ring
+}
+
+// A read can't take more answers than there are machines to give them
+func TestReadFromReplicas(t *testing.T) {
+	ring := testReplicaRing(t, 1)
+	ring.mergeLocal(&newer)
+
+	merged, found, answered, wanted := ring.readFromReplicas(context.Background(), 1, 1)
+	if !found || string(merged.Value) != "new" || answered != 1 || wanted != 1 {
+		t.Errorf("got %v found %v, %d of %d answered", merged, found, answered, wanted)
+	}
+	if _, found, answered, wanted = ring.readFromReplicas(context.Background(), 2, 1); found || answered != 1 || wanted != 1 {
+		t.Errorf("missing key: found %v, %d of %d answered", found, answered, wanted)
+	}
+	if _, _, answered, wanted = ring.readFromReplicas(context.Background(), 1, 2); answered != 1 || wanted != 2 {
+		t.Errorf("more copies than machines: %d of %d answered", answered, wanted)
+	}
+}
+
+// Our own copy is brought up to the merged versions when it was older or missing
+func TestReadRepair(t *testing.T) {
+	tests := []struct {
+		name string
+		held *data.DataStore
+	}{
+		{"older copy", &older},
+		{"missing copy", nil},
+		{"same copy", &newer},
+	}
+	for _, test := range tests {
+		ring := testReplicaRing(t, 1)
+		read := replicaRead{member: ring.getMember("b:1")}
+		if test.held != nil {
+			ring.mergeLocal(test.held)
+			read.item, read.found = *test.held, true
+		}
+		merged := newer
+		ring.readRepair(&merged, []replicaRead{read})
+
+		item, found := ring.getLocal(1)
+		if !found || !data.SameVersions(&item, &newer) {
+			t.Errorf("%s: holds %v after the repair, want %v", test.name, item, newer)
+		}
+	}
+}
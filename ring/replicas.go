@@ -2,43 +2,34 @@ package ring
 
 import (
 	"../data"
+	"context"
 	"fmt"
-	"log"
-	"net/rpc"
 )
 
-const (
-	replicaNumber = 2
-)
-
-
-func (self *Ring) writeToNReplicas(sentData *data.DataStore, key, N int) int {
+//Writes the data to the first N machines after us in the key's preference list.
+//Writes for replicas that can't be reached are handed off to fallback machines, and count as written
+//once a fallback stored them. A hint only this machine holds doesn't count.
+//Stops when the context is done, without handing off what is left
+func (self *Ring) writeToNReplicas(ctx context.Context, sentData *data.DataStore, N int) int {
 	var result RpcResult
 	i := 0
-	j := 0
-
-	for i != N && j < self.UserKeyTable.Len() {
-		fmt.Println(i, j, self.UserKeyTable.Len())
-		j++
+	fallbacks := self.fallbacksForKey(sentData.Key, N)
 
-		item := self.getSuccessor(key)
-		key = item.Key
-		//Successor doesnt exist - return. Probably the only member
-		if key == -1 {
-			return i
+	//No other machines - return. Probably the only member
+	for _, member := range self.replicasForKey(sentData.Key, N) {
+		if ctx.Err() != nil {
+			break
 		}
-		value := item.Value
-		member := self.Usertable[value]
+		fmt.Println(i, member.Address)
 
-		client, err := rpc.DialHTTP("tcp", member.Address)
-		if err != nil {
-			log.Fatal("dialing:", err)
-		}
-		defer client.Close()
-		err = client.Call("Ring.WriteData", sentData, &result)
-
-		if err != nil {
+		err := callMachineContext(ctx, member.Address, "Ring.WriteData", sentData, &result)
+		if err != nil && ctx.Err() != nil {
+			fmt.Println("Gave up sending data:", err)
+		} else if err != nil {
 			fmt.Println("Error sending data:", err)
+			if self.handOff(ctx, member.Address, sentData, &fallbacks) {
+				i++
+			}
 		} else if result.Success != 1 {
 			fmt.Println("Error storing data")
 		} else {
@@ -56,25 +47,11 @@ func (self *Ring) writeToNReplicas(sentData *data.DataStore, key, N int) int {
   return i
 }
 
-func (self *Ring) writeToOneReplica(sentData *data.DataStore, key int) int {
-  self.writeToNReplicas(sentData, key, replicaNumber)
-  return 1
-}
-
 //Writes to all the replicas
-func (self *Ring) writeToReplicas(sentData *data.DataStore, key int) int {
-  i := self.writeToNReplicas(sentData, key, replicaNumber)
-  if i == replicaNumber {
-    return 1
-  }
-  return 0
-}
-
-//Writes to a majority of the replicas
-func (self *Ring) writeToQuorumReplicas(sentData *data.DataStore, key int) int {
-  quorum := (replicaNumber + 1) / 2
-  i := self.writeToNReplicas(sentData, key, replicaNumber)
-  if i >= quorum {
+func (self *Ring) writeToReplicas(sentData *data.DataStore) int {
+  others := self.replicasFor(sentData.Key) - 1
+  i := self.writeToNReplicas(context.Background(), sentData, others)
+  if i == others {
     return 1
   }
   return 0
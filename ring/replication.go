@@ -0,0 +1,286 @@
+package ring
+
+import (
+	"../data"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+/*
+  How many copies of a key the ring keeps. The first machine picks a
+  replication factor for the whole ring, and namespaces can ask for more or
+  fewer copies of their keys. Keys are positions on the ring, so a namespace is
+  a stretch of keys rather than a prefix of a name.
+
+  The settings can be changed on a live ring. The new settings get a higher
+  epoch and are flooded to every machine, which then walks its keys: replicas
+  that are new to a key get a copy from its owner (backfill), and machines no
+  longer in a key's preference list hand it to the ones that are before
+  dropping their copy (trim).
+*/
+
+// Keys in Range are kept on Replicas machines
+type Namespace struct {
+	Name     string
+	Range    data.KeyRange
+	Replicas int
+}
+
+func (self *Config) checkReplication() error {
+	if self.Replicas < 1 {
+		return errors.New("need at least one copy of every key")
+	}
+	names := make(map[string]bool)
+	for _, namespace := range self.Namespaces {
+		if namespace.Replicas < 1 {
+			return errors.New("namespace " + namespace.Name + " needs at least one copy of its keys")
+		}
+		if names[namespace.Name] {
+			return errors.New("namespace " + namespace.Name + " is defined twice")
+		}
+		names[namespace.Name] = true
+	}
+	return nil
+}
+
+// Number of copies of the key, the first namespace holding it wins
+func (self *Config) replicasFor(key int) int {
+	for i := range self.Namespaces {
+		if self.Namespaces[i].Range.Contains(key) {
+			return self.Namespaces[i].Replicas
+		}
+	}
+	return self.Replicas
+}
+
+// The most copies any key has
+func (self *Config) maxReplicas() int {
+	max := self.Replicas
+	for _, namespace := range self.Namespaces {
+		if namespace.Replicas > max {
+			max = namespace.Replicas
+		}
+	}
+	return max
+}
+
+/*
+  Cut the range where namespaces start or end, so every key in a piece has the
+  same number of copies
+*/
+func (self *Config) splitByNamespace(keyRange *data.KeyRange) []*data.KeyRange {
+	cuts := make([]int, 0, 2*len(self.Namespaces))
+	for _, namespace := range self.Namespaces {
+		for _, cut := range []int{namespace.Range.Start, namespace.Range.End} {
+			if cut != keyRange.End && keyRange.Contains(cut) {
+				cuts = append(cuts, cut)
+			}
+		}
+	}
+	if len(cuts) == 0 {
+		return []*data.KeyRange{keyRange}
+	}
+
+	//Clockwise from the start of the range, which may wrap around
+	distance := func(key int) uint64 {
+		return (uint64(key) - uint64(keyRange.Start) + uint64(self.KeySpace)) % uint64(self.KeySpace)
+	}
+	sort.Slice(cuts, func(i, j int) bool { return distance(cuts[i]) < distance(cuts[j]) })
+
+	pieces := make([]*data.KeyRange, 0, len(cuts)+1)
+	start := keyRange.Start
+	for _, cut := range cuts {
+		if cut != start {
+			pieces = append(pieces, data.NewKeyRange(start, cut))
+			start = cut
+		}
+	}
+	return append(pieces, data.NewKeyRange(start, keyRange.End))
+}
+
+func (self *Ring) replicasFor(key int) int {
+	return self.settings().replicasFor(key)
+}
+
+// The settings in use, ApplyReplication swaps them for new ones while others read them
+func (self *Ring) settings() *Config {
+	self.configLock.RLock()
+	defer self.configLock.RUnlock()
+	return self.Config
+}
+
+// Copies that make a majority of n
+func quorum(n int) int {
+	return n/2 + 1
+}
+
+/*
+  Changing the settings
+*/
+
+/*
+  Set the number of copies of every key outside a namespace. Called on any
+  machine, it takes care of telling the others.
+*/
+func (self *Ring) SetReplicas(replicas int) error {
+	config := *self.settings()
+	config.Replicas = replicas
+	return self.changeReplication(&config)
+}
+
+// Add a namespace, replace the one with the same name, or remove it when replicas is 0
+func (self *Ring) SetNamespace(name string, keyRange data.KeyRange, replicas int) error {
+	current := self.settings()
+	config := *current
+	config.Namespaces = make([]Namespace, 0, len(current.Namespaces)+1)
+	for _, namespace := range current.Namespaces {
+		if namespace.Name != name {
+			config.Namespaces = append(config.Namespaces, namespace)
+		}
+	}
+	if replicas != 0 {
+		config.Namespaces = append(config.Namespaces, Namespace{name, keyRange, replicas})
+	}
+	return self.changeReplication(&config)
+}
+
+func (self *Ring) changeReplication(config *Config) error {
+	if err := config.checkReplication(); err != nil {
+		return err
+	}
+	config.Epoch++
+	var applied int
+	return self.ApplyReplication(config, &applied)
+}
+
+/*
+  Exposed over RPC: use the replication settings if they are newer than ours,
+  pass them on to everyone we know and move our keys to where they now belong
+*/
+func (self *Ring) ApplyReplication(config *Config, applied *int) error {
+	self.configLock.Lock()
+	if config.Epoch <= self.Config.Epoch {
+		self.configLock.Unlock()
+		*applied = 0
+		return nil
+	}
+	if err := config.checkReplication(); err != nil {
+		self.configLock.Unlock()
+		return err
+	}
+	updated := *self.Config
+	updated.Replicas = config.Replicas
+	updated.Namespaces = config.Namespaces
+	updated.Epoch = config.Epoch
+	self.Config = &updated
+	if self.chord != nil {
+		self.chord.setSuccessorListSize(updated.maxReplicas() + 1)
+	}
+	self.configLock.Unlock()
+	*applied = 1
+	fmt.Println("Replication is now", updated.Replicas, "copies, namespaces", updated.Namespaces, "epoch", updated.Epoch)
+
+	go func() {
+		self.spreadReplication(&updated)
+		self.rebalanceReplicas()
+	}()
+	return nil
+}
+
+func (self *Ring) spreadReplication(config *Config) {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	for _, member := range self.members() {
+		if member.Address == myAddr || member.Id == -1 || member.State == data.Dead {
+			continue
+		}
+		var applied int
+		if err := callMachine(member.Address, "Ring.ApplyReplication", config, &applied); err != nil {
+			fmt.Println("Could not send replication settings to", member.Address, err)
+		}
+	}
+}
+
+// In case we were away when the settings last changed, ask somebody else for theirs
+func (self *Ring) catchUpReplication() {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	member := self.getRandomMember()
+	if member == nil || member.Address == myAddr {
+		return
+	}
+	var config Config
+	if err := callMachine(member.Address, "Ring.GetConfig", 0, &config); err != nil {
+		return
+	}
+	var applied int
+	if err := self.ApplyReplication(&config, &applied); err != nil {
+		fmt.Println("Could not use replication settings of", member.Address, err)
+	}
+}
+
+func (self *Ring) PrintReplication() {
+	config := self.settings()
+	fmt.Println("Replication:", config.Replicas, "copies, epoch", config.Epoch)
+	for _, namespace := range config.Namespaces {
+		fmt.Println("Namespace", namespace.Name, namespace.Range, namespace.Replicas, "copies")
+	}
+}
+
+/*
+  Make our keys match the preference lists under the current settings. The
+  owner of a key sends it to every replica, which backfills the new ones. A
+  copy we no longer should hold goes to the whole preference list first, and
+  is only dropped once they all have it, or a fallback holds it for one that
+  is down.
+*/
+func (self *Ring) rebalanceReplicas() {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+
+	backfilled, trimmed := 0, 0
+	for _, item := range self.localData() {
+		n := self.replicasFor(item.Key)
+		members := self.preferenceList(item.Key, n)
+		position := -1
+		for i, member := range members {
+			if member.Address == myAddr {
+				position = i
+			}
+		}
+		//Replicas other than the owner leave it to the owner
+		if position > 0 {
+			continue
+		}
+
+		//A replica that is down gets the key through a machine after the preference list, it needn't hold up the trim
+		sent := 0
+		fallbacks := make([]*data.GroupMember, 0, n)
+		for _, member := range self.preferenceList(item.Key, 2*n)[len(members):] {
+			if member.Address != myAddr {
+				fallbacks = append(fallbacks, member)
+			}
+		}
+		for _, member := range members {
+			if member.Address == myAddr {
+				continue
+			}
+			var result RpcResult
+			if err := callMachine(member.Address, "Ring.WriteData", &item, &result); err != nil || result.Success != 1 {
+				fmt.Println("Could not copy key", item.Key, "to", member.Address, err)
+				if position < 0 && self.handOff(context.Background(), member.Address, &item, &fallbacks) {
+					sent++
+				}
+				continue
+			}
+			sent++
+		}
+
+		if position == 0 {
+			backfilled++
+		} else if len(members) > 0 && sent == len(members) && self.purgeLocal(&item) {
+			trimmed++
+		}
+	}
+	fmt.Println("Rebalanced replicas:", backfilled, "keys sent to their replicas,", trimmed, "copies dropped")
+}
@@ -0,0 +1,89 @@
+package ring
+
+import (
+	"../data"
+	"testing"
+)
+
+// A ring of 100 keys where 11 to 20 have 5 copies and 51 to 60 only one
+func testReplicationConfig() *Config {
+	return &Config{
+		KeySpace: 100,
+		Replicas: 3,
+		Namespaces: []Namespace{
+			{"hot", data.KeyRange{Start: 10, End: 20}, 5},
+			{"cold", data.KeyRange{Start: 50, End: 60}, 1},
+			{"shadowed", data.KeyRange{Start: 15, End: 55}, 2},
+		},
+	}
+}
+
+var copiesOf = map[int]int{
+	10: 3,
+	11: 5,
+	20: 5,
+	21: 2,
+	50: 2,
+	55: 1,
+	60: 1,
+	61: 3,
+	99: 3,
+}
+
+func TestReplicasFor(t *testing.T) {
+	config := testReplicationConfig()
+	for key, want := range copiesOf {
+		if got := config.replicasFor(key); got != want {
+			t.Errorf("key %d: %d copies, want %d", key, got, want)
+		}
+	}
+	if max := config.maxReplicas(); max != 5 {
+		t.Errorf("most copies %d, want 5", max)
+	}
+}
+
+var splits = []struct {
+	keyRange data.KeyRange
+	want     []data.KeyRange
+}{
+	{data.KeyRange{Start: 0, End: 30}, []data.KeyRange{{Start: 0, End: 10}, {Start: 10, End: 15}, {Start: 15, End: 20}, {Start: 20, End: 30}}},
+	{data.KeyRange{Start: 70, End: 90}, []data.KeyRange{{Start: 70, End: 90}}},
+	{data.KeyRange{Start: 20, End: 50}, []data.KeyRange{{Start: 20, End: 50}}},
+	{data.KeyRange{Start: 90, End: 12}, []data.KeyRange{{Start: 90, End: 10}, {Start: 10, End: 12}}},
+	{data.KeyRange{Start: 58, End: 58}, []data.KeyRange{{Start: 58, End: 60}, {Start: 60, End: 10}, {Start: 10, End: 15}, {Start: 15, End: 20}, {Start: 20, End: 50}, {Start: 50, End: 55}, {Start: 55, End: 58}}},
+}
+
+// Every piece is cut where a namespace starts or ends, in order round from the start of the range
+func TestSplitByNamespace(t *testing.T) {
+	config := testReplicationConfig()
+	for _, split := range splits {
+		got := config.splitByNamespace(&split.keyRange)
+		if len(got) != len(split.want) {
+			t.Errorf("%v: got %v, want %v", split.keyRange, got, split.want)
+			continue
+		}
+		for i := range got {
+			if *got[i] != split.want[i] {
+				t.Errorf("%v: got %v, want %v", split.keyRange, got, split.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCheckReplication(t *testing.T) {
+	config := testReplicationConfig()
+	if err := config.checkReplication(); err != nil {
+		t.Errorf("good settings refused: %v", err)
+	}
+	bad := []*Config{
+		{KeySpace: 100, Replicas: 0},
+		{KeySpace: 100, Replicas: 1, Namespaces: []Namespace{{"none", data.KeyRange{Start: 1, End: 2}, 0}}},
+		{KeySpace: 100, Replicas: 1, Namespaces: []Namespace{{"twice", data.KeyRange{Start: 1, End: 2}, 1}, {"twice", data.KeyRange{Start: 3, End: 4}, 2}}},
+	}
+	for _, config := range bad {
+		if err := config.checkReplication(); err == nil {
+			t.Errorf("%+v taken", config)
+		}
+	}
+}
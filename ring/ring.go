@@ -9,11 +9,12 @@ import (
 	"../data"
 	"../logger"
 	"../rbtree"
+	"context"
 	"fmt"
 	"log"
 	"net"
-	"net/rpc"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,10 +26,17 @@ const (
 )
 
 const (
-	heartbeatThreshold = 100
+	//Gossip datagrams are packed up to this size unless told otherwise, small enough not to be fragmented
+	defaultMTU = 1400
+	//The largest payload a UDP datagram can carry
+	MaxDatagram = 65507
+
+	//Every this many gossip rounds we reconcile whole tables with a push-pull exchange
+	pushPullRounds = 10
 )
 
 type Ring struct {
+	*Session
 	Usertable    map[string]*data.GroupMember
 	UserKeyTable *rbtree.Tree
 	KeyValTable  *rbtree.Tree
@@ -36,10 +44,26 @@ type Ring struct {
 	Address      string
 	Heartbeats   int
 	ConnUDP      *net.UDPConn
+	MTU          int
 	Active       bool
 	isGossiping  bool
 	Successor    *data.GroupMember
-  CmdLog       *CommandLog
+	CmdLog       *CommandLog
+	Config       *Config
+	hasher       data.Hasher
+	chord        *Chord
+	dataLock     sync.Mutex
+	configLock   sync.RWMutex
+	membersLock  sync.RWMutex
+	Hints        *HintStore
+	Storage      *Storage
+	detector     *FailureDetector
+	Rejected     *PacketErrors
+	gossipRounds int
+	pushPulls    map[string]int
+	watches      *watchLog
+	txns         *txnState
+	merkleTrees  *merkleCache
 }
 
 /*
@@ -59,10 +83,14 @@ func NewMember(hostPort string, faultTolerance int) (ring *Ring, err error) {
 		return
 	}
 
-	userKeyVal := rbtree.NewTree(func(a, b rbtree.Item) int { return a.(data.LocationStore).Key - b.(data.LocationStore).Key })
-	keyVal := rbtree.NewTree(func(a, b rbtree.Item) int { return a.(data.DataStore).Key - b.(data.DataStore).Key })
+	userKeyVal := rbtree.NewTree(func(a, b rbtree.Item) int {
+		return data.CompareKeys(a.(data.LocationStore).Key, b.(data.LocationStore).Key)
+	})
+	keyVal := rbtree.NewTree(func(a, b rbtree.Item) int {
+		return data.CompareKeys(a.(data.DataStore).Key, b.(data.DataStore).Key)
+	})
 
-  cmdLog := NewCommandLog(10)
+	cmdLog := NewCommandLog(commandLogSize)
 
 	ring = &Ring{
 		Usertable:    make(map[string]*data.GroupMember),
@@ -72,119 +100,66 @@ func NewMember(hostPort string, faultTolerance int) (ring *Ring, err error) {
 		Address:      address,
 		Heartbeats:   faultTolerance,
 		ConnUDP:      connUDP,
+		MTU:          defaultMTU,
 		Active:       true,
 		isGossiping:  false,
 		Successor:    nil,
-    CmdLog:       cmdLog,
-	}
+		CmdLog:       cmdLog,
+		Hints:        NewHintStore(),
+		detector:     NewFailureDetector(),
+		Rejected:     NewPacketErrors(),
+		pushPulls:    make(map[string]int),
+		watches:      newWatchLog(),
+		txns:         newTxnState(),
+		merkleTrees:  newMerkleCache(),
+	}
+	ring.Session = NewSession(&ringRouter{ring})
+	ring.Configure(DefaultConfig())
 
 	log.Printf("Creating tcp listener at %s\n", hostPort)
-	ring.createTCPListener(hostPort)
+	if err = ring.createTCPListener(hostPort); err != nil {
+		connUDP.Close()
+		return nil, err
+	}
 	fmt.Print(ring.Usertable)
 
 	return
 }
 
-/* Returns an RPC client to the key's successor in the ring, allowing us to call functions on it */
-func (self *Ring) dialSuccessor(key int) *rpc.Client {
-	successorId := self.UserKeyTable.FindGE(data.LocationStore{key, ""})
-	if successorId == self.UserKeyTable.Limit() {
-		successorId = self.UserKeyTable.Min()
-	}
-	successorAddr := self.Usertable[successorId.Item().(data.LocationStore).Value].Address
-	fmt.Println(successorAddr)
-
-	client, err := rpc.DialHTTP("tcp", successorAddr)
-	if err != nil {
-		log.Fatal("dialing:", err)
-	}
-	return client
-}
-
 /* Format of all the RPC responses for consistency */
 type RpcResult struct {
 	Success int
 	Data    data.DataStore
 	Member  *data.GroupMember
-}
 
-/* Make an RPC call to the key's successor machine, using the given args */
-func (self *Ring) callSuccessorRPC(key int, function string, args *data.DataStore, consistency int) (result RpcResult) {
-	client := self.dialSuccessor(key)
-	defer client.Close()
-	var err error
-	if consistency == -1 {
-		err = client.Call(function, args, &result)
-	} else {
+	//A conditional write didn't hold, Data is what the key holds instead
+	ConditionFailed bool
 
-		function = function + "Consistent"
-		consistentStore := data.NewConsistentDataStore(args, consistency)
-		err = client.Call(function, consistentStore, &result)
-	}
-
-	if err != nil {
-		fmt.Println("Error sending data:", err)
-		result.Success = -2
-		return
-	}
-	if result.Success != 1 {
-		fmt.Println("Error storing data")
-	}
-	fmt.Printf("Data Size: %d \n", self.KeyValTable.Len())
-	return result
+	Error *RpcError
 }
 
-/* The actual Operations exposed over RPC */
-func (self *Ring) Insert(key int, val string, consistency int) {
-
-	args := data.NewDataStore(key, val)
-	result := self.callSuccessorRPC(key, "Ring.SendData", args, consistency)
-
-	if result.Member != nil && result.Success != 1 {
-		self.updateMember(result.Member)
-		self.Insert(key, val, consistency)
-	} else {
-		timeout := 3
-		i := 0
-		//Found New Member
-		fmt.Println(result.Success)
-		for result.Success == -2 && i < timeout {
-			i++
-			result = self.callSuccessorRPC(key, "Ring.SendData", args, consistency)
-
-		}
-	}
-
-}
-
-func (self *Ring) Update(key int, val string, consistency int) {
-	args := data.NewDataStore(key, val)
-	result := self.callSuccessorRPC(key, "Ring.UpdateData", args, consistency)
-	if result.Success != 1 && result.Member != nil {
-		self.updateMember(result.Member)
-		self.Update(key, val, consistency)
-	}
+func (self *RpcResult) replyError() error {
+	return self.Error.Unpack()
 }
 
-func (self *Ring) Remove(key int, consistency int) {
-	args := data.NewDataStore(key, "")
-	result := self.callSuccessorRPC(key, "Ring.RemoveData", args, consistency)
-	if result.Success != 1 && result.Member != nil {
-		self.updateMember(result.Member)
-		self.Remove(key, consistency)
-	}
+// Deferred by a handler with its named error, which goes in the reply instead
+func (self *RpcResult) carry(err *error) {
+	self.Error = NewRpcError(*err)
+	*err = nil
 }
 
-func (self *Ring) Lookup(key int, consistency int) {
-	args := data.NewDataStore(key, "")
-	result := self.callSuccessorRPC(key, "Ring.GetData", args, consistency)
-	if result.Success != 1 && result.Member != nil {
-		self.updateMember(result.Member)
-		self.Lookup(key, consistency)
-	} else {
-		fmt.Println(result.Data.Key, result.Data.Value)
+// Every live version of an item with its metadata, and the context to update it with
+func PrintItem(item data.DataStore) {
+	//Tombstones concurrent with a value stay hidden, the value is still there
+	for i, version := range item.Live() {
+		if i == 0 {
+			fmt.Println(item.Key, data.Printable(version.Value))
+		} else {
+			fmt.Println(item.Key, data.Printable(version.Value), "(concurrent version)")
+		}
+		fmt.Println(" ", version.Meta)
 	}
-
+	fmt.Println("Context:", item.Context())
 }
 
 func (self *Ring) updateMember(updatedMember *data.GroupMember) {
@@ -192,6 +167,8 @@ func (self *Ring) updateMember(updatedMember *data.GroupMember) {
 	if updatedMember == nil {
 		return
 	}
+	self.membersLock.Lock()
+	defer self.membersLock.Unlock()
 
 	key := updatedMember.Id
 	movement := updatedMember.Movement
@@ -202,31 +179,33 @@ func (self *Ring) updateMember(updatedMember *data.GroupMember) {
 		lastKey = member.Id
 	}
 
+	// A machine we took for dead came back, it starts over as a new member
+	if member != nil && member.State == data.Dead && updatedMember.Overrides(member) {
+		fmt.Println(updatedMember.Address, "came back with incarnation", updatedMember.Incarnation)
+		member = nil
+	}
+
 	// Add new member if one doesn't already exist
 	if member == nil {
 		self.Usertable[updatedMember.Address] = updatedMember
 		//We dont want to add to the server location table
-		if key == -204 {
+		if key == -1 {
 			return
 		}
-		if self.UserKeyTable.Get(data.LocationStore{key, ""}) == nil {
-			self.UserKeyTable.Insert(data.LocationStore{key, updatedMember.Address})
-		} else {
-			fmt.Println("ERROR: Two members with same key")
-		}
+		self.insertLocation(key, updatedMember.Address)
+		self.insertVirtualTokens(updatedMember)
 		return
 	}
 
+	// What the failure detector thinks is kept apart from where the member is on the ring
+	self.mergeMemberState(member, updatedMember)
+	updatedMember.State, updatedMember.Incarnation = member.State, member.Incarnation
+
 	// Update the existing member
 	if member.Heartbeat > updatedMember.Heartbeat {
 		member.SetHeartBeat(0)
 	}
 
-	//Client case - We dont want to do anything
-	if key == -204 {
-		return
-	}
-
 	// TODO Not sure what's going on here?
 	if member.Movement < movement {
 		//fmt.Println("You should not be able to join if you already exist or stay if you already started leaving")
@@ -239,32 +218,43 @@ func (self *Ring) updateMember(updatedMember *data.GroupMember) {
 		((movement == DataSentAndLeft || member.Movement == DataSentAndLeft) && (key < lastKey)) {
 
 		fmt.Printf("Deleting member with ID %d FROM %s", lastKey, updatedMember.Address)
-		self.UserKeyTable.DeleteWithKey(data.LocationStore{lastKey, ""})
+		self.deleteLocation(lastKey, updatedMember.Address)
 
 		if key != -1 {
 			fmt.Printf("Inserting member with ID %d FROM %s", key, updatedMember.Address)
-			self.UserKeyTable.Insert(data.LocationStore{key, updatedMember.Address})
+			self.insertLocation(key, updatedMember.Address)
+			if lastKey == -1 {
+				self.insertVirtualTokens(updatedMember)
+			}
+		} else {
+			self.deleteVirtualTokens(updatedMember)
 		}
 	}
 }
 
 func (self *Ring) FirstMember(portAddress string) {
-	key := data.Hasher(portAddress)
+	key := self.Hash(portAddress)
 	fmt.Println("Found")
 	fmt.Println(key)
 	newMember := data.NewGroupMember(key, portAddress, 0, Stable)
 	self.updateMember(newMember)
-}
 
-func (self *Ring) ClientMember(portAddress string) {
-	key := -204
-	fmt.Println("Found")
-	fmt.Println(key)
-	newMember := data.NewGroupMember(key, portAddress, 0, Stable)
-	self.updateMember(newMember)
+	if chord := self.getChord(); chord != nil {
+		chord.start(data.LocationStore{key, portAddress})
+	}
 }
 
 func (self *Ring) getMachineForKey(key int) data.LocationStore {
+	if self.getChord() != nil {
+		//Nobody we know of, callers find no member at an empty address
+		owner, err := self.chordOwner(key)
+		if err != nil {
+			fmt.Println("Chord lookup failed:", err)
+		}
+		return owner
+	}
+	self.membersLock.RLock()
+	defer self.membersLock.RUnlock()
 	successor := self.UserKeyTable.FindGE(data.LocationStore{key, ""})
 	if successor == self.UserKeyTable.Limit() {
 		successor = self.UserKeyTable.Min()
@@ -275,19 +265,20 @@ func (self *Ring) getMachineForKey(key int) data.LocationStore {
 func (self *Ring) Gossip() {
 	fmt.Println("Start Gossiping")
 	self.isGossiping = true
-	heartbeatInterval := 50 * time.Millisecond
 	userTableInterval := 500 * time.Millisecond
 
-	go self.HeartBeatGossip(heartbeatInterval)
-	go self.UserTableGossip(userTableInterval)
-}
-
-func (self *Ring) HeartBeatGossip(interval time.Duration) {
-	for {
-		//self.doHeartBeatGossip()
-		time.Sleep(interval)
+	go self.HintedHandoff(hintInterval)
+	go self.AntiEntropy(antiEntropyInterval)
+	go self.TombstoneCollection(tombstoneInterval)
+	go self.ExpirySweeper(expiryInterval)
+	go self.TransactionRecovery(txnRecoveryInterval)
+	if self.getChord() != nil {
+		//Chord keeps itself up to date, no need to gossip the whole table around
+		go self.ChordMaintenance(chordInterval)
+		return
 	}
-
+	go self.FailureDetection(probeInterval)
+	go self.UserTableGossip(userTableInterval)
 }
 
 func (self *Ring) UserTableGossip(interval time.Duration) {
@@ -302,8 +293,9 @@ func (self *Ring) ReceiveDatagrams(joinGroupOnConnection bool) {
 	if self.Active == false {
 		return
 	}
+	//Big enough for anything, the sender's MTU may be larger than ours
+	buffer := make([]byte, MaxDatagram)
 	for {
-		buffer := make([]byte, 1024)
 		c, addr, err := self.ConnUDP.ReadFromUDP(buffer)
 		if err != nil {
 			log.Printf("%d byte datagram from %s with error %s\n", c, addr.String(), err.Error())
@@ -311,41 +303,108 @@ func (self *Ring) ReceiveDatagrams(joinGroupOnConnection bool) {
 			return
 		}
 
-		portmsg := strings.SplitN(string(buffer[:c]), "<PORT>", 2)
-		port, msg := portmsg[0], portmsg[1]
-		senderAddr := net.JoinHostPort(addr.IP.String(), port)
+		msg, err := data.DecodeMessage(buffer[:c])
+		if err != nil {
+			self.Rejected.Count(err)
+			logger.Log("ERROR", "Rejected datagram from "+addr.String()+": "+err.Error())
+			continue
+		}
+		senderAddr := net.JoinHostPort(addr.IP.String(), msg.Port)
 
-		logger.Log("INFO", "Data received from "+senderAddr+" : "+msg)
+		logger.Log("INFO", "Data received from "+senderAddr)
 		self.handleMessage(msg, senderAddr, &joinGroupOnConnection)
 	}
 }
 
-func (self *Ring) handleMessage(msg, sender string, joinSenderGroup *bool) {
-	fields := strings.SplitN(msg, "|%|", 2)
-	switch fields[0] {
-	case "GOSSIP":
-		logger.Log("GOSSIP", "Gossiping "+sender+fields[1])
-		self.handleGossip(sender, fields[1])
+// Datagrams we threw away, by what was wrong with them
+type PacketErrors struct {
+	counts map[string]int
+	lock   sync.Mutex
+}
+
+func NewPacketErrors() *PacketErrors {
+	return &PacketErrors{counts: make(map[string]int)}
+}
+
+func (self *PacketErrors) Count(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.counts[err.Error()]++
+}
+
+func (self *PacketErrors) Total() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	total := 0
+	for _, count := range self.counts {
+		total += count
+	}
+	return total
+}
+
+func (self *PacketErrors) Print() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for reason, count := range self.counts {
+		fmt.Println("Rejected", count, "datagrams:", reason)
 	}
 }
 
-func (self *Ring) handleGossip(senderAddr, subject string) {
+func (self *Ring) handleMessage(msg *data.Message, sender string, joinSenderGroup *bool) {
+	switch msg.Type {
+	case data.MessageGossip:
+		logger.Log("GOSSIP", "Gossiping "+sender)
+		for _, member := range msg.Members {
+			self.handleGossip(sender, member)
+		}
+	case data.MessagePushPull:
+		for _, member := range msg.Members {
+			self.handleGossip(sender, member)
+		}
+		self.answerPushPull(sender, msg.Seq)
+	case data.MessagePing:
+		self.handlePing(sender, msg)
+	case data.MessagePingReq:
+		self.handlePingReq(sender, msg)
+	case data.MessageAck:
+		self.handleAck(msg)
+	}
+}
+
+func (self *Ring) handleGossip(senderAddr string, subjectMember *data.GroupMember) {
 	// Reset the counter for the sender
 	// TODO add sender if it doesn't exist yet
 
-	subjectMember := data.Unmarshal(subject)
-
 	if subjectMember == nil {
 		return
 	}
 
 	//fmt.Println(senderAddr)
+	self.membersLock.Lock()
 	sender := self.Usertable[senderAddr]
 	if sender != nil {
 		//fmt.Println("Updating")
-		self.Usertable[senderAddr].SetHeartBeat(0)
-	} else {
+		sender.SetHeartBeat(0)
+	}
+	self.membersLock.Unlock()
 
+	//Only we get to say how we are doing
+	if subjectMember.Address == net.JoinHostPort(self.Address, self.Port) {
+		if subjectMember.State != data.Alive {
+			self.refute(subjectMember.Incarnation)
+		}
+		return
+	}
+	if subjectMember.State == data.Dead {
+		//Not if it came back since whoever told us saw it die
+		self.membersLock.RLock()
+		member := self.Usertable[subjectMember.Address]
+		stale := member != nil && !subjectMember.Overrides(member)
+		self.membersLock.RUnlock()
+		if !stale {
+			self.declareDead(subjectMember.Address)
+		}
+		return
 	}
 	self.updateMember(subjectMember)
 	//fmt.Println("Updating Heartbeat to ", senderAddr, self.Usertable[senderAddr].Heartbeat)
@@ -375,45 +434,61 @@ func (self *Ring) handleGossip(senderAddr, subject string) {
 
 }*/
 
-//Join the group by finding successor and getting all the required data from it
+//Join the group by learning the ring from the given member and getting all the data we will hold from the
+//machines that currently hold it
 func (self *Ring) JoinGroup(address string) (err error) {
 
-	client, err := rpc.DialHTTP("tcp", address)
+	//Everyone has to hash the same way, so use the settings of the ring we are joining
+	err = self.AdoptConfig(address)
 	if err != nil {
-		log.Fatal("dialing:", err)
+		return fmt.Errorf("fetching config: %w", err)
 	}
 
-	//Get Successor
 	hostPort := net.JoinHostPort(self.Address, self.Port)
-	hashedKey := data.Hasher(hostPort + time.Now().String()) // TODO this is a hack
+	hashedKey := self.Hash(hostPort + time.Now().String()) // TODO this is a hack
 
-	successor := self.callForSuccessor(hashedKey, address)
-	argi := data.NewLocationStore(hashedKey, hostPort)
-	client, err = rpc.DialHTTP("tcp", successor.Address)
-	if err != nil {
-		log.Fatal("dialing:", err)
+	if self.getChord() != nil {
+		err = self.joinChord(address, hashedKey)
+		if err != nil {
+			return fmt.Errorf("joining chord: %w", err)
+		}
+		self.updateMember(data.NewGroupMember(hashedKey, hostPort, 0, Stable))
+		return
 	}
-	fmt.Println(successor)
-	//Get smallest key less then key and initiate data transfer
-	var data_t []*data.DataStore
-	err = client.Call("Ring.GetEntryData", argi, &data_t)
-
-	//TODO:: Iterate throught array and add items like below except all at once as shown.  Straightforward.
 
-	length := len(data_t)
+	//We need the whole ring to know which ranges our tokens take over
+	err = self.fetchMembers(address)
+	if err != nil {
+		return fmt.Errorf("fetching members: %w", err)
+	}
 
-	for i := 0; i < length; i++ {
+	//Find who holds the data for each of our tokens before we take a place on the ring
+	me := data.NewGroupMember(hashedKey, hostPort, 0, Joining)
+	me.Incarnation = self.rejoinIncarnation(hostPort)
+	holders := make(map[int]*data.GroupMember)
+	for _, token := range self.tokensOf(me) {
+		holders[token] = self.getMember(self.getMachineForKey(token).Value)
+	}
+	self.updateMember(me)
 
-		//Insert Key into my table
-		self.KeyValTable.Insert(*(data_t[i]))
+	for token, holder := range holders {
+		if holder == nil || holder.Address == hostPort {
+			continue
+		}
+		keyRange := self.replicatedRange(token)
 
-		//Insert Value of Key as my Id
-		newMember := data.NewGroupMember(data_t[i].Key, hostPort, 0, Joining)
-		self.updateMember(newMember)
+		var data_t []*data.DataStore
+		err := callMachine(holder.Address, "Ring.GetEntryData", keyRange, &data_t)
+		if err != nil {
+			fmt.Println("Error getting data from", holder.Address, err)
+			continue
+		}
 
-		//Start Gossiping
-		if self.isGossiping == false {
-			go self.Gossip()
+		for i := 0; i < len(data_t); i++ {
+			//The range covers the most replicated namespace, keep only what we replicate
+			if self.isReplicaFor(data_t[i].Key) {
+				self.mergeLocal(data_t[i])
+			}
 		}
 	}
 
@@ -421,197 +496,281 @@ func (self *Ring) JoinGroup(address string) (err error) {
 		go self.Gossip()
 		fmt.Println("Am i done")
 	}
-	//Make hashed key my id
+	//We hold our data, take our place on the ring
 	finalMember := data.NewGroupMember(hashedKey, hostPort, 0, Stable)
+	finalMember.Incarnation = me.Incarnation
 	self.updateMember(finalMember)
 	return
 }
 
-//Leave the group by transferring all data to successor
-func (self *Ring) LeaveGroup() {
+//Leave the group by handing each of our keys to whoever takes it over
+func (self *Ring) LeaveGroup() error {
+	return self.LeaveGroupContext(context.Background())
+}
+
+//Leave even if the data could not all be handed off in time, the error says how much was
+func (self *Ring) LeaveGroupContext(ctx context.Context) error {
 
-	//TODO: We have stored successor but he could change so lets find ask a random member
 	hostPort := net.JoinHostPort(self.Address, self.Port)
-	key := self.Usertable[hostPort].Id
-	fmt.Println(self.Usertable[hostPort].Id)
-	receiver := self.getRandomMember()
-	successor := self.callForSuccessor(key, receiver.Address)
-	fmt.Println(successor)
-	self.bulkDataDeleteAndSend("Ring.SendLeaveData", successor)
+	key := self.getMember(hostPort).Id
+	fmt.Println(key)
+	self.updateMember(data.NewGroupMember(key, hostPort, 0, Leaving))
+
+	if self.getChord() != nil {
+		err := self.leaveChord(ctx, "Ring.SendLeaveData")
+		fmt.Println("I a done here")
+		return err
+	}
+	err := self.bulkDataDeleteAndSend(ctx, "Ring.SendLeaveData")
 
 	self.updateMember(data.NewGroupMember(-1, hostPort, 0, DataSentAndLeft))
 
 	//One Last Gossip to make sure someone knows I have left
 	self.doUserTableGossip()
 	fmt.Println("I a done here")
+	return err
 }
 
-//Send all your data deleting them as you go to a receving member
-func (self *Ring) bulkDataDeleteAndSend(function string, receiver *data.GroupMember) {
+/*
+  Send all your data away, deleting it as you go. Keys we own go to the next
+  machine in their preference list, which replicates them. Keys we only
+  replicate go to the machine that becomes a replica once we are gone.
+*/
+func (self *Ring) bulkDataDeleteAndSend(ctx context.Context, function string) error {
 
 	hostPort := net.JoinHostPort(self.Address, self.Port)
-	key := self.Usertable[hostPort].Id
-
-	client, err := rpc.DialHTTP("tcp", receiver.Address)
-	if err != nil {
-		log.Fatal("dialing:", err)
-	}
-  length := self.KeyValTable.Len()
 
 	fmt.Println(self.KeyValTable.Len())
-  i := 0
-  NextLessThen := self.KeyValTable.FindLE(data.DataStore{key, ""})
-	for NextLessThen != self.KeyValTable.NegativeLimit() {
-    i++
-		sendingData := NextLessThen.Item().(data.DataStore)
-		fmt.Println(sendingData)
-		sendDataPtr := &sendingData
-		var result RpcResult
-		err = client.Call(function, sendDataPtr, &result)
-		if err != nil {
-			fmt.Println("Error sending data", err)
-			return
+	items := self.localData()
+	for sent, sendingData := range items {
+		if ctx.Err() != nil {
+			return &ProgressError{Err: contextError(ctx.Err()), Done: sent, Needed: len(items), What: "keys handed off"}
+		}
+
+		others := make([]*data.GroupMember, 0)
+		position := -1
+		replicas := self.replicasFor(sendingData.Key)
+		for i, member := range self.preferenceList(sendingData.Key, replicas+1) {
+			if member.Address == hostPort {
+				position = i
+			} else {
+				others = append(others, member)
+			}
 		}
-		fmt.Println(result)
-		if result.Success == 1 {
+
+		//If we are not in the preference list the copy is stale and nobody needs it
+		var receiver *data.GroupMember
+		call := function
+		if position == 0 && len(others) > 0 {
+			receiver = others[0]
+		} else if position > 0 && len(others) >= replicas {
+			receiver = others[replicas-1]
+			call = "Ring.WriteData"
+		}
+
+		if receiver != nil {
+			var result RpcResult
+			sendDataPtr := &sendingData
+			err := callMachineContext(ctx, receiver.Address, call, sendDataPtr, &result)
+			if err == nil && result.Success != 1 {
+				err = NewOpError("leave", sendingData.Key, receiver.Address, ErrInsufficientReplicas)
+			}
+			if err != nil {
+				fmt.Println("Error sending data", err)
+				return &ProgressError{Err: err, Done: sent, Needed: len(items), What: "keys handed off"}
+			}
 			fmt.Println("Data Succesfully sent")
-			self.KeyValTable.DeleteWithIterator(NextLessThen)
-			self.updateMember(data.NewGroupMember(sendingData.Key, hostPort, 0, Leaving))
-		} else {
-			fmt.Println("Error sending data", err)
-			break
 		}
-		NextLessThen = self.KeyValTable.FindLE(data.DataStore{sendingData.Key, ""})
-    if (i >= length){
-      break
-    }
-  }
+		self.deleteLocal(sendingData.Key)
+	}
+	return nil
 }
 
-//Send all your data to replicas
-func (self *Ring) bulkDataSendToReplicas(maxRingPos int) {
-
-	min := self.KeyValTable.Min()
-	key := self.getKey()
+//Send all the data we own to its replicas
+func (self *Ring) bulkDataSendToReplicas() {
 
-	//Tree is empty
-	if min.Equal(self.KeyValTable.Limit()) {
-		return
-	}
-	for min != self.KeyValTable.Limit() {
-		item := min.Item().(data.DataStore)
-    if item.Key > maxRingPos {
-      return
-    }
-		self.writeToReplicas(&item, key)
-		fmt.Println(min.Item().(data.DataStore))
-		min = min.Next()
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	for _, item := range self.localData() {
+		if self.getMachineForKey(item.Key).Value != myAddr {
+			continue
+		}
+		self.writeToReplicas(&item)
+		fmt.Println(item)
 	}
 
 }
 
-func (self *Ring) callForSuccessor(myKey int, address string) *data.GroupMember {
-	client, err := rpc.DialHTTP("tcp", address)
-	if err != nil {
-		log.Fatal("dialing:", err)
+//The ring may remember us from before we restarted, even as dead: come back with an incarnation newer than that
+func (self *Ring) rejoinIncarnation(hostPort string) int {
+	self.membersLock.Lock()
+	defer self.membersLock.Unlock()
+	if old := self.Usertable[hostPort]; old != nil {
+		return old.Incarnation + 1
 	}
+	return 0
+}
 
+//Learn all the members of the ring the given machine knows about
+func (self *Ring) fetchMembers(address string) error {
+	var members []*data.GroupMember
+	if err := callMachine(address, "Ring.GetMembers", 0, &members); err != nil {
+		return err
+	}
+	for _, member := range members {
+		member.SetHeartBeat(0)
+		self.updateMember(member)
+	}
+	return nil
+}
+
+func (self *Ring) callForSuccessor(myKey int, address string) (*data.GroupMember, error) {
 	//Get Successor
 	argi := &myKey
 	fmt.Printf("myKey : %d", myKey)
 	var response *data.GroupMember
-	err = client.Call("Ring.GetSuccessor", argi, &response)
+	if err := callMachine(address, "Ring.GetSuccessor", argi, &response); err != nil {
+		return nil, err
+	}
 	if response == nil {
 		fmt.Println("No successor : only member in group")
 	}
 	self.Successor = response
 	fmt.Println("Found Successor")
 	self.updateMember(self.Successor)
-	return response
+	return response, nil
 
 }
 
-// Gossip members from current table to a random member
+// Gossip members from current table to a random member, as few datagrams as they fit in
 func (self *Ring) doUserTableGossip() {
 	if self.Active == false {
 		return
 	}
 
+	self.membersLock.RLock()
 	tableLength := self.UserKeyTable.Len()
+	self.membersLock.RUnlock()
 
 	// Nobody in the list yet
 	if tableLength < 1 {
 		return
 	}
 
-	//Get predecessor
-	predecessorKey := self.getPredecessorKey(self.getKey())
 	receiver := self.getRandomMember()
-	//fmt.Println(receiver.Id)
-	//fmt.Println(receiver.Address)
-	for _, subject := range self.Usertable {
+	if receiver == nil {
+		return
+	}
+	self.membersLock.Lock()
+	self.gossipRounds++
+	round := self.gossipRounds
+	self.membersLock.Unlock()
+
+	//Now and then send everything and have the receiver send everything back
+	if round%pushPullRounds == 0 {
+		self.sendMembers(data.MessagePushPull, round, self.members(), receiver.Address)
+		return
+	}
 
-		if subject.Address != net.JoinHostPort(self.Address, self.Port) {
-			subject.IncrementHeartBeat()
+	//Failures are found by the failure detector, gossip spreads what it found along with the rest of the table.
+	//A suspect has to hear about it to refute it
+	subjects := make([]*data.GroupMember, 0)
+	for _, subject := range self.members() {
+		if subject.Id != receiver.Id || subject.State != data.Alive {
+			subjects = append(subjects, subject)
 		}
-    //fmt.Println("ID, Heartbeat:", subject.Id, subject.Heartbeat)
-		if subject.Heartbeat > heartbeatThreshold && subject.Id != -1 {
-			log.Println("MACHINE DEAD!", subject.Id, subject.Heartbeat)
-			if subject.Id == predecessorKey {
+	}
+	self.sendMembers(data.MessageGossip, round, subjects, receiver.Address)
+}
 
-				//TODO:: Update replicase
-				fmt.Println("Now you need to update your replicas")
-				self.bulkDataSendToReplicas(subject.Id)
+// Everybody in the table, copied so they can be sent while the failure detector changes the table
+func (self *Ring) members() []*data.GroupMember {
+	self.membersLock.RLock()
+	defer self.membersLock.RUnlock()
+	members := make([]*data.GroupMember, 0, len(self.Usertable))
+	for address := range self.Usertable {
+		members = append(members, self.memberCopy(address))
+	}
+	return members
+}
 
-			}
-			//Deletes the member in the userkeytable
-			self.updateMember(data.NewGroupMember(-1, subject.Address, subject.Heartbeat, Leaving))
-		}
-		if subject.Id != receiver.Id {
-			self.doGossip(subject, receiver)
-		}
+// A copy of the member at address, nil if we don't know of one
+func (self *Ring) getMember(address string) *data.GroupMember {
+	self.membersLock.RLock()
+	defer self.membersLock.RUnlock()
+	return self.memberCopy(address)
+}
+
+// Expects the members lock to be held
+func (self *Ring) memberCopy(address string) *data.GroupMember {
+	member := self.Usertable[address]
+	if member == nil {
+		return nil
 	}
+	copied := *member
+	return &copied
 }
 
-func (self *Ring) doGossip(subject, receiver *data.GroupMember) (err error) {
-	// The message we are sending over UDP, subject can be nil
-	//fmt.Println(subject.Id)
-	msg := "GOSSIP|%|" + data.Marshal(subject)
-	return self.sendMessageWithPort(msg, receiver.Address)
+/*
+  The other half of a push-pull: we merged what the sender knows, now it gets
+  what we know. A big table takes several datagrams to push, only the first of
+  them gets an answer.
+*/
+func (self *Ring) answerPushPull(sender string, seq int) {
+	if last, found := self.pushPulls[sender]; found && last == seq {
+		return
+	}
+	self.pushPulls[sender] = seq
+	self.sendMembers(data.MessageGossip, seq, self.members(), sender)
 }
 
-func (self *Ring) sendMessageWithPort(msg, address string) (err error) {
-	msg = self.Port + "<PORT>" + msg
-	return sendMessage(msg, address)
+func (self *Ring) sendMembers(msgType int, seq int, members []*data.GroupMember, address string) (err error) {
+	for _, packet := range data.PackMembers(msgType, self.Port, seq, members, self.MTU) {
+		if err = self.sendMessage(packet, address); err != nil {
+			return
+		}
+	}
+	return
 }
 
-func sendMessage(message, address string) (err error) {
+func (self *Ring) sendMessageWithPort(msg *data.Message, address string) (err error) {
+	msg.Port = self.Port
+	return self.sendMessage(data.EncodeMessage(msg), address)
+}
+
+// Send from the socket we listen on, the receiver answers to the port in the message anyway
+func (self *Ring) sendMessage(message []byte, address string) (err error) {
 	var raddr *net.UDPAddr
 	if raddr, err = net.ResolveUDPAddr("udp", address); err != nil {
-		log.Panic(err)
+		logger.Log("ERROR", "Resolving "+address+": "+err.Error())
+		return
 	}
 
-	var con *net.UDPConn
-	con, err = net.DialUDP("udp", nil, raddr)
-	//log.Printf("Sending '%s' to %s..", message, raddr)
-	logger.Log("INFO", "Sending "+message)
-	if _, err = con.Write([]byte(message)); err != nil {
-
-		log.Panic("Writing to UDP:", err)
-		logger.Log("ERROR", "Writing to UDP")
+	logger.Log("INFO", fmt.Sprintf("Sending %d bytes", len(message)))
+	if _, err = self.ConnUDP.WriteToUDP(message, raddr); err != nil {
+		logger.Log("ERROR", "Writing to UDP "+address+": "+err.Error())
 	}
 
 	return
 }
 
 func (self *Ring) PrintMembers() {
+	if self.getChord() != nil {
+		self.PrintChord()
+		return
+	}
 
 	fmt.Println("Printiing Members")
+	self.membersLock.RLock()
 	start := self.UserKeyTable.Min()
 	for i := 0; i < self.UserKeyTable.Len(); i++ {
 		fmt.Println(start.Item().(data.LocationStore))
 		start = start.Next()
 	}
+	for address, member := range self.Usertable {
+		fmt.Println(address, data.StateName(member.State), "incarnation", member.Incarnation)
+	}
+	self.membersLock.RUnlock()
+	self.Rejected.Print()
 
 }
 
@@ -634,7 +793,7 @@ func createUDPListener(hostPort string) (conn *net.UDPConn, err error) {
 
 	conn, err = net.ListenUDP("udp", udpaddr)
 	if err != nil {
-		log.Fatal("listen error:", err)
+		return
 	}
 	fmt.Println("UDP listener created")
 
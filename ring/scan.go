@@ -0,0 +1,406 @@
+package ring
+
+import (
+	"../data"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+/*
+  Range scans. Keys from Start up to but not including End come back in key
+  order, or from the top down for a reverse scan, a page of at most limit keys
+  at a time with a token to fetch the next page with.
+
+  The scan walks the ring from the owner of the first key: the owner reads the
+  part of the range it owns from its replicas, as many of them as the
+  consistency level needs, merges what they hold and says where the next owner
+  takes over. A replica only sends up to limit keys, so the merged page stops
+  where the first replica that ran out of room stopped, the keys after that
+  may be missing from its answer.
+*/
+
+const (
+	defaultScanLimit = 100
+)
+
+// Where a scan is and where it stops, what a pagination token holds
+type ScanCursor struct {
+	Start   int
+	End     int
+	Next    int
+	Reverse bool
+}
+
+func NewScanCursor(start, end int, reverse bool) ScanCursor {
+	cursor := ScanCursor{Start: start, End: end, Next: start, Reverse: reverse}
+	if reverse {
+		cursor.Next = end - 1
+	}
+	return cursor
+}
+
+// Whether the cursor went past the end of the range
+func (self ScanCursor) Done() bool {
+	if self.Reverse {
+		return self.Next < self.Start
+	}
+	return self.Next >= self.End
+}
+
+func (self ScanCursor) Token() string {
+	if self.Done() {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d:%d:%t", self.Start, self.End, self.Next, self.Reverse)))
+}
+
+func ParseScanToken(token string) (ScanCursor, error) {
+	var cursor ScanCursor
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, ErrInvalidToken
+	}
+	if _, err := fmt.Sscanf(string(decoded), "%d:%d:%d:%t", &cursor.Start, &cursor.End, &cursor.Next, &cursor.Reverse); err != nil {
+		return cursor, ErrInvalidToken
+	}
+	//Sscanf stops at whatever it doesn't need, a token is only good if it is exactly what Token makes
+	if cursor.Token() != token {
+		return cursor, ErrInvalidToken
+	}
+	return cursor, nil
+}
+
+// A page of a scan, Token is empty once there is nothing left
+type ScanPage struct {
+	Items []data.DataStore
+	Token string
+}
+
+type ScanRequest struct {
+	Cursor      ScanCursor
+	Limit       int
+	Consistency int
+	Caller      string
+	Timeout     time.Duration
+}
+
+type ScanResult struct {
+	Items []data.DataStore
+	Next  int
+
+	//Set when the machine doesn't own the cursor, ask this one instead
+	Member *data.GroupMember
+
+	Error *RpcError
+}
+
+func (self *ScanResult) replyError() error {
+	return self.Error.Unpack()
+}
+
+// Keys from Low to High the machine holds, at most Limit of them, from High down if Reverse
+type RangeRequest struct {
+	Low     int
+	High    int
+	Limit   int
+	Reverse bool
+}
+
+/*
+  Fetching pages
+*/
+
+/*
+  Collect a page, going from owner to owner until it has limit keys or the
+  range ends. send asks the owner of the request's cursor, following it to a
+  newer one if need be.
+*/
+func collectScan(ctx context.Context, cursor ScanCursor, limit int, consistency int, caller string,
+	send func(ctx context.Context, request *ScanRequest, result *ScanResult) error) (ScanPage, error) {
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	page := ScanPage{Items: make([]data.DataStore, 0)}
+	for !cursor.Done() && len(page.Items) < limit {
+		request := &ScanRequest{Cursor: cursor, Limit: limit - len(page.Items), Consistency: consistency, Caller: caller}
+		if deadline, ok := ctx.Deadline(); ok {
+			request.Timeout = time.Until(deadline)
+		}
+		var result ScanResult
+		if err := send(ctx, request, &result); err != nil {
+			page.Token = cursor.Token()
+			return page, err
+		}
+		page.Items = append(page.Items, result.Items...)
+
+		//Owners only ever send us onwards, anything else would go round forever
+		if cursor.Reverse && result.Next >= cursor.Next || !cursor.Reverse && result.Next <= cursor.Next {
+			page.Token = cursor.Token()
+			return page, NewOpError("scan", cursor.Next, "", ErrRedirectLoop)
+		}
+		cursor.Next = result.Next
+	}
+	page.Token = cursor.Token()
+	return page, nil
+}
+
+func (self *Session) Scan(start, end, limit, consistency int) (ScanPage, error) {
+	return self.ScanContext(context.Background(), NewScanCursor(start, end, false), limit, consistency)
+}
+
+func (self *Session) ScanReverse(start, end, limit, consistency int) (ScanPage, error) {
+	return self.ScanContext(context.Background(), NewScanCursor(start, end, true), limit, consistency)
+}
+
+// The page after the one the token came with
+func (self *Session) ScanNext(token string, limit, consistency int) (ScanPage, error) {
+	cursor, err := ParseScanToken(token)
+	if err != nil {
+		return ScanPage{}, err
+	}
+	return self.ScanContext(context.Background(), cursor, limit, consistency)
+}
+
+func (self *Session) ScanContext(ctx context.Context, cursor ScanCursor, limit, consistency int) (ScanPage, error) {
+	return collectScan(ctx, cursor, limit, consistency, self.router.Caller(), self.sendScan)
+}
+
+// Ask the owner of the cursor for its part of the range
+func (self *Session) sendScan(ctx context.Context, request *ScanRequest, result *ScanResult) error {
+	return self.send(ctx, "scan", request.Cursor.Next, "Ring.ScanRange", func(address string) (*data.GroupMember, error) {
+		*result = ScanResult{}
+		if err := CallContext(ctx, address, "Ring.ScanRange", request, result); err != nil {
+			return nil, err
+		}
+		return result.Member, nil
+	})
+}
+
+/*
+  Exposed over RPC: the page of our part of the range, read from as many
+  replicas as the consistency level needs
+*/
+func (self *Ring) ScanRange(request *ScanRequest, result *ScanResult) (err error) {
+	defer func() {
+		result.Error = NewRpcError(err)
+		err = nil
+	}()
+	ctx, cancel := requestContext(request.Timeout)
+	defer cancel()
+
+	cursor := request.Cursor
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	owner := self.getMachineForKey(cursor.Next)
+	if owner.Value != myAddr {
+		result.Member = self.getMember(owner.Value)
+		if result.Member == nil {
+			return ErrUnavailable
+		}
+		return nil
+	}
+	limit := request.Limit
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+
+	low, high := self.scanBounds(owner.Key, cursor)
+	n := self.replicasFor(cursor.Next)
+	reads, needed := self.readRangeFromReplicas(ctx, &RangeRequest{low, high, limit, cursor.Reverse}, copiesNeeded(request.Consistency, n), n)
+	if len(reads) < needed {
+		fmt.Println("Could not reach enough replicas")
+		return progressError(ctx, len(reads), needed, "replicas answered")
+	}
+
+	//Past the last key of a replica that ran out of room we don't know what it holds
+	result.Next = high + 1
+	if cursor.Reverse {
+		result.Next = low - 1
+	}
+	for _, read := range reads {
+		if len(read.items) < limit {
+			continue
+		}
+		last := read.items[len(read.items)-1].Key
+		if cursor.Reverse && last-1 > result.Next || !cursor.Reverse && last+1 < result.Next {
+			result.Next = last + 1
+			if cursor.Reverse {
+				result.Next = last - 1
+			}
+		}
+	}
+
+	result.Items = make([]data.DataStore, 0)
+	for _, item := range self.mergeRangeReads(reads, cursor.Reverse, result.Next) {
+		if len(result.Items) == limit {
+			result.Next = result.Items[limit-1].Key + 1
+			if cursor.Reverse {
+				result.Next = result.Items[limit-1].Key - 1
+			}
+			break
+		}
+		if !item.IsDeleted() {
+			result.Items = append(result.Items, item)
+		}
+	}
+	return nil
+}
+
+/*
+  The keys from the cursor on that the owner of token holds with the same
+  number of copies, as the lowest and highest of them
+*/
+func (self *Ring) scanBounds(token int, cursor ScanCursor) (low, high int) {
+	low, high = cursor.Next, cursor.End-1
+	if cursor.Reverse {
+		low, high = cursor.Start, cursor.Next
+	}
+	owned := self.ownedRange(token)
+	for _, piece := range self.settings().splitByNamespace(owned) {
+		if !piece.Contains(cursor.Next) {
+			continue
+		}
+		//The piece may wrap around the end of the key space, then it doesn't bound this side
+		if piece.Start != piece.End && piece.End >= cursor.Next && piece.End < high {
+			high = piece.End
+		}
+		if piece.Start != piece.End && piece.Start < cursor.Next && piece.Start+1 > low {
+			low = piece.Start + 1
+		}
+	}
+	return low, high
+}
+
+// The keys the machine at token owns, everything if it is the only one
+func (self *Ring) ownedRange(token int) *data.KeyRange {
+	chord := self.getChord()
+	var predecessor data.LocationStore
+	if chord != nil {
+		predecessor = chord.getPredecessor()
+	} else {
+		predecessor = self.getPredecessor(token)
+	}
+	if predecessor.Key == -1 {
+		return data.NewKeyRange(token, token)
+	}
+	return data.NewKeyRange(predecessor.Key, token)
+}
+
+// What one replica held in a range
+type rangeRead struct {
+	member *data.GroupMember
+	items  []data.DataStore
+}
+
+// Ask the replicas of the range for it until needed of its n copies have answered or the context is done
+func (self *Ring) readRangeFromReplicas(ctx context.Context, request *RangeRequest, needed int, n int) ([]rangeRead, int) {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	members := self.preferenceList(request.Low, n)
+
+	reads := make([]rangeRead, 0, len(members))
+	remote := make([]*data.GroupMember, 0, len(members))
+	for _, member := range members {
+		if member.Address == myAddr {
+			reads = append(reads, rangeRead{member, self.localRange(request)})
+		} else {
+			remote = append(remote, member)
+		}
+	}
+
+	type answer struct {
+		read rangeRead
+		err  error
+	}
+	answers := make(chan answer, len(remote))
+	for _, member := range remote {
+		go func(member *data.GroupMember) {
+			var items []data.DataStore
+			err := callMachineContext(ctx, member.Address, "Ring.ReadRange", request, &items)
+			answers <- answer{rangeRead{member, items}, err}
+		}(member)
+	}
+Waiting:
+	for waiting := len(remote); waiting > 0 && len(reads) < needed; waiting-- {
+		select {
+		case answer := <-answers:
+			if answer.err != nil {
+				fmt.Println("Could not read from replica", answer.read.member.Address, answer.err)
+				continue
+			}
+			reads = append(reads, answer.read)
+		case <-ctx.Done():
+			break Waiting
+		}
+	}
+	return reads, needed
+}
+
+// Every key the replicas sent before next, in scan order, with the replicas holding older versions repaired
+func (self *Ring) mergeRangeReads(reads []rangeRead, reverse bool, next int) []data.DataStore {
+	before := func(key int) bool {
+		if reverse {
+			return key > next
+		}
+		return key < next
+	}
+
+	merged := make(map[int]*data.DataStore)
+	held := make([]map[int]data.DataStore, len(reads))
+	for r, read := range reads {
+		held[r] = make(map[int]data.DataStore, len(read.items))
+		for i := range read.items {
+			item := read.items[i]
+			if !before(item.Key) {
+				continue
+			}
+			held[r][item.Key] = item
+			if existing, found := merged[item.Key]; found {
+				existing.Merge(&item)
+			} else {
+				merged[item.Key] = &item
+			}
+		}
+	}
+
+	keys := make([]int, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if reverse {
+			return keys[i] > keys[j]
+		}
+		return keys[i] < keys[j]
+	})
+
+	items := make([]data.DataStore, 0, len(keys))
+	repairs := make([][]replicaRead, 0)
+	for _, key := range keys {
+		items = append(items, *merged[key])
+
+		//Every replica answered for the whole stretch up to next, one without the key is missing it
+		copies := make([]replicaRead, 0, len(reads))
+		for r, read := range reads {
+			item, found := held[r][key]
+			copies = append(copies, replicaRead{member: read.member, item: item, found: found})
+		}
+		repairs = append(repairs, copies)
+	}
+	go func() {
+		for i := range items {
+			self.readRepair(&items[i], repairs[i])
+		}
+	}()
+	return items
+}
+
+/*
+  Exposed over RPC: what this machine holds in the range, without asking anyone else
+*/
+func (self *Ring) ReadRange(request *RangeRequest, items *[]data.DataStore) error {
+	*items = self.localRange(request)
+	return nil
+}
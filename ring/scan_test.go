@@ -0,0 +1,236 @@
+package ring
+
+import (
+	"../data"
+	"context"
+	"errors"
+	"testing"
+)
+
+var testScanCursors = []ScanCursor{
+	NewScanCursor(0, 100, false),
+	NewScanCursor(0, 100, true),
+	NewScanCursor(-50, 50, false),
+	{Start: 10, End: 20, Next: 15},
+	{Start: 10, End: 20, Next: 10, Reverse: true},
+}
+
+func TestScanTokenRoundTrip(t *testing.T) {
+	for _, cursor := range testScanCursors {
+		token := cursor.Token()
+		if token == "" {
+			t.Fatalf("%+v: no token before the scan is done", cursor)
+		}
+		parsed, err := ParseScanToken(token)
+		if err != nil {
+			t.Fatalf("%+v: %v", cursor, err)
+		}
+		if parsed != cursor {
+			t.Errorf("got %+v, want %+v", parsed, cursor)
+		}
+	}
+}
+
+// Whether the cursor ran past its end, going up or down
+var doneCursors = map[ScanCursor]bool{
+	NewScanCursor(0, 10, false):                  false,
+	NewScanCursor(0, 10, true):                   false,
+	NewScanCursor(5, 5, false):                   true,
+	NewScanCursor(5, 5, true):                    true,
+	{Start: 0, End: 10, Next: 10}:                true,
+	{Start: 0, End: 10, Next: 9}:                 false,
+	{Start: 0, End: 10, Next: -1, Reverse: true}: true,
+	{Start: 0, End: 10, Next: 0, Reverse: true}:  false,
+}
+
+func TestScanCursorDone(t *testing.T) {
+	for cursor, done := range doneCursors {
+		if cursor.Done() != done {
+			t.Errorf("%+v: done %t, want %t", cursor, cursor.Done(), done)
+		}
+		if done && cursor.Token() != "" {
+			t.Errorf("%+v: token %q once done", cursor, cursor.Token())
+		}
+	}
+}
+
+func TestParseScanTokenInvalid(t *testing.T) {
+	tokens := []string{
+		"",
+		"not base64!",
+		"MToyOjM",             //1:2:3
+		"YTpiOmM6dHJ1ZQ",      //a:b:c:true
+		"MToyOjM6bWF5YmU",     //1:2:3:maybe
+		"MToyOjM6dHJ1ZWp1bms", //1:2:3:truejunk
+		"MToyOjI6ZmFsc2U",     //1:2:2:false, done already
+	}
+	for _, token := range tokens {
+		if _, err := ParseScanToken(token); err != ErrInvalidToken {
+			t.Errorf("%q: %v", token, err)
+		}
+	}
+}
+
+/*
+  A ring of owners for collectScan, each owning ten keys: it answers with the
+  keys it holds from the cursor on, at most the request's limit, and says
+  where the next owner takes over
+*/
+type testScanRing struct {
+	keys     []int
+	requests int
+	failAt   int
+	stuck    bool
+}
+
+func (self *testScanRing) send(ctx context.Context, request *ScanRequest, result *ScanResult) error {
+	self.requests++
+	if self.requests == self.failAt {
+		return ErrUnavailable
+	}
+	cursor := request.Cursor
+	if self.stuck {
+		result.Next = cursor.Next
+		return nil
+	}
+	if cursor.Reverse {
+		bound := cursor.Next - (cursor.Next%10+10)%10
+		result.Next = bound - 1
+		for i := len(self.keys) - 1; i >= 0; i-- {
+			key := self.keys[i]
+			if key > cursor.Next || key < bound || key < cursor.Start {
+				continue
+			}
+			if len(result.Items) == request.Limit {
+				result.Next = key
+				break
+			}
+			result.Items = append(result.Items, *data.NewDataStore(key, nil))
+		}
+		return nil
+	}
+	bound := cursor.Next - (cursor.Next%10+10)%10 + 10
+	result.Next = bound
+	for _, key := range self.keys {
+		if key < cursor.Next || key >= bound || key >= cursor.End {
+			continue
+		}
+		if len(result.Items) == request.Limit {
+			result.Next = key
+			break
+		}
+		result.Items = append(result.Items, *data.NewDataStore(key, nil))
+	}
+	return nil
+}
+
+func itemKeys(items []data.DataStore) []int {
+	keys := make([]int, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	return keys
+}
+
+func sameKeys(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The keys the owners hold, and the pages scanning them comes back in
+var scanKeys = []int{1, 3, 12, 13, 14, 25, 38, 39, 41}
+
+var pageCases = []struct {
+	name   string
+	cursor ScanCursor
+	limit  int
+	pages  [][]int
+}{
+	{"one page", NewScanCursor(0, 50, false), 100, [][]int{{1, 3, 12, 13, 14, 25, 38, 39, 41}}},
+	{"pages", NewScanCursor(0, 50, false), 4, [][]int{{1, 3, 12, 13}, {14, 25, 38, 39}, {41}}},
+	{"page ends at the range", NewScanCursor(0, 50, false), 3, [][]int{{1, 3, 12}, {13, 14, 25}, {38, 39, 41}}},
+	{"part of the range", NewScanCursor(13, 39, false), 2, [][]int{{13, 14}, {25, 38}}},
+	{"reverse", NewScanCursor(0, 50, true), 4, [][]int{{41, 39, 38, 25}, {14, 13, 12, 3}, {1}}},
+	{"reverse part", NewScanCursor(12, 39, true), 10, [][]int{{38, 25, 14, 13, 12}}},
+	{"empty range", NewScanCursor(15, 25, false), 10, [][]int{{}}},
+}
+
+// Paging through a scan with the tokens gets every key once, in order
+func TestCollectScanPages(t *testing.T) {
+	for _, c := range pageCases {
+		ring := &testScanRing{keys: scanKeys}
+		cursor := c.cursor
+		for i, want := range c.pages {
+			page, err := collectScan(context.Background(), cursor, c.limit, One, "test", ring.send)
+			if err != nil {
+				t.Fatalf("%s: page %d: %v", c.name, i, err)
+			}
+			if got := itemKeys(page.Items); !sameKeys(got, want) {
+				t.Errorf("%s: page %d is %v, want %v", c.name, i, got, want)
+			}
+			last := i == len(c.pages)-1
+			if last != (page.Token == "") {
+				t.Fatalf("%s: page %d has token %q", c.name, i, page.Token)
+			}
+			if !last {
+				if cursor, err = ParseScanToken(page.Token); err != nil {
+					t.Fatalf("%s: page %d: %v", c.name, i, err)
+				}
+			}
+		}
+	}
+}
+
+// A failed owner leaves a token to carry on from, with what came before it
+func TestCollectScanFailure(t *testing.T) {
+	ring := &testScanRing{keys: []int{1, 12, 25}, failAt: 2}
+	page, err := collectScan(context.Background(), NewScanCursor(0, 30, false), 10, One, "test", ring.send)
+	if err != ErrUnavailable {
+		t.Fatalf("got %v", err)
+	}
+	if got := itemKeys(page.Items); !sameKeys(got, []int{1}) {
+		t.Errorf("page before the failure is %v", got)
+	}
+	cursor, err := ParseScanToken(page.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err = collectScan(context.Background(), cursor, 10, One, "test", ring.send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := itemKeys(page.Items); !sameKeys(got, []int{12, 25}) || page.Token != "" {
+		t.Errorf("resumed page is %v with token %q", got, page.Token)
+	}
+
+	//An owner that doesn't move the cursor on would have us ask it forever
+	ring = &testScanRing{stuck: true}
+	_, err = collectScan(context.Background(), NewScanCursor(0, 30, false), 10, One, "test", ring.send)
+	if !errors.Is(err, ErrRedirectLoop) {
+		t.Errorf("stuck owner: %v", err)
+	}
+}
+
+func FuzzParseScanToken(f *testing.F) {
+	for _, cursor := range testScanCursors {
+		f.Add(cursor.Token())
+	}
+	f.Add("MToyOjM6dHJ1ZWp1bms")
+	f.Fuzz(func(t *testing.T, token string) {
+		cursor, err := ParseScanToken(token)
+		if err != nil {
+			return
+		}
+		//Whatever we accept is a token we could have handed out
+		if cursor.Token() != token {
+			t.Errorf("%q parsed as %+v, which makes %q", token, cursor, cursor.Token())
+		}
+	})
+}
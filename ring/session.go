@@ -0,0 +1,239 @@
+package ring
+
+import (
+	"../data"
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+  The operations a program runs on the ring, whether it is one of its machines
+  or a client outside of it. Both send every request to the machine that
+  coordinates the key and follow it to a newer one when it knows better, they
+  only differ in how they know where keys live, which their Router says.
+
+  A session remembers the context of every key it read or wrote, so the next
+  Update replaces what it saw.
+*/
+
+type Router interface {
+	//The machine coordinating the key, as far as we know
+	Coordinator(key int) string
+
+	//A machine sent us on to member, it knows better than we do
+	Follow(ctx context.Context, member *data.GroupMember)
+
+	//A machine couldn't be reached, look again where keys live
+	Reload(ctx context.Context) error
+
+	//Who we are in the command logs of the machines we talk to
+	Caller() string
+}
+
+type Session struct {
+	router   Router
+	contexts map[int]data.VectorClock
+	lock     sync.Mutex
+}
+
+func NewSession(router Router) *Session {
+	return &Session{router: router, contexts: make(map[int]data.VectorClock)}
+}
+
+// A machine of the ring knows where keys live from gossip, or Chord lookups
+type ringRouter struct {
+	ring *Ring
+}
+
+func (self *ringRouter) Coordinator(key int) string {
+	return self.ring.getMachineForKey(key).Value
+}
+
+func (self *ringRouter) Follow(ctx context.Context, member *data.GroupMember) {
+	self.ring.updateMember(member)
+}
+
+func (self *ringRouter) Reload(ctx context.Context) error {
+	return nil
+}
+
+func (self *ringRouter) Caller() string {
+	return net.JoinHostPort(self.ring.Address, self.ring.Port)
+}
+
+/*
+  Have the machine coordinating the key answer call, going to the machine it
+  sends us on to until one does. A call that failed and can be sent again is,
+  after the router looked again where the key lives.
+*/
+func (self *Session) send(ctx context.Context, op string, key int, function string, call func(address string) (*data.GroupMember, error)) error {
+	address := self.router.Coordinator(key)
+	for redirects := 0; redirects <= maxRedirects; redirects++ {
+		newer, err := call(address)
+		for attempt := 1; attempt < coordinatorAttempts && Retryable(function, err) && ctx.Err() == nil; attempt++ {
+			if self.router.Reload(ctx) == nil {
+				address = self.router.Coordinator(key)
+			}
+			newer, err = call(address)
+		}
+		if err != nil {
+			return NewOpError(op, key, address, err)
+		}
+		if newer == nil {
+			return nil
+		}
+		//The machine knows better, ask the one it sent us to and learn what it knows
+		self.router.Follow(ctx, newer)
+		address = newer.Address
+	}
+	return NewOpError(op, key, "", ErrRedirectLoop)
+}
+
+/*
+  Have the machine that coordinates the key run function. A consistency of -1
+  asks every replica. The coordinator is told how long we wait, so it gives up
+  on replicas in time to say how many it reached.
+*/
+func (self *Session) coordinate(ctx context.Context, op string, key int, function string, args *data.DataStore, consistency int) (RpcResult, error) {
+	return self.coordinateIf(ctx, op, key, function, args, nil, consistency)
+}
+
+// coordinate, only writing if the key holds what condition asks for
+func (self *Session) coordinateIf(ctx context.Context, op string, key int, function string, args *data.DataStore, condition *data.Condition, consistency int) (RpcResult, error) {
+	if consistency == -1 {
+		consistency = All
+	}
+	request := data.NewConsistentDataStore(args, consistency)
+	request.Caller = self.router.Caller()
+	request.Condition = condition
+	function = function + "Consistent"
+
+	var result RpcResult
+	err := self.send(ctx, op, key, function, func(address string) (*data.GroupMember, error) {
+		result = RpcResult{}
+		if deadline, ok := ctx.Deadline(); ok {
+			request.Timeout = time.Until(deadline)
+		}
+		if err := CallContext(ctx, address, function, request, &result); err != nil {
+			return nil, err
+		}
+		if result.Success == 1 {
+			return nil, nil
+		}
+		if result.ConditionFailed {
+			return nil, ErrConditionFailed
+		}
+		if result.Member == nil {
+			return nil, ErrUnavailable
+		}
+		return result.Member, nil
+	})
+	return result, err
+}
+
+/*
+  The operations. The ...Context variants give up when the context is done,
+  the others wait as long as the machines take to answer.
+*/
+func (self *Session) Insert(key int, val []byte, meta data.Metadata, consistency int) error {
+	return self.InsertContext(context.Background(), key, val, meta, consistency)
+}
+
+func (self *Session) InsertContext(ctx context.Context, key int, val []byte, meta data.Metadata, consistency int) error {
+	args := data.NewDataStore(key, val)
+	args.Meta = meta
+	result, err := self.coordinate(ctx, "insert", key, "Ring.SendData", args, consistency)
+	if err != nil {
+		return err
+	}
+	self.rememberWrite(&result.Data, val, nil)
+	return nil
+}
+
+//Update replaces the versions seen by our last Lookup of the key
+func (self *Session) Update(key int, val []byte, meta data.Metadata, consistency int) error {
+	return self.UpdateContext(context.Background(), key, val, meta, consistency)
+}
+
+func (self *Session) UpdateContext(ctx context.Context, key int, val []byte, meta data.Metadata, consistency int) error {
+	return self.UpdateVersionContext(ctx, key, val, meta, self.Seen(key), consistency)
+}
+
+//Update replacing the versions described by the context returned from a Lookup
+func (self *Session) UpdateVersion(key int, val []byte, meta data.Metadata, seen data.VectorClock, consistency int) error {
+	return self.UpdateVersionContext(context.Background(), key, val, meta, seen, consistency)
+}
+
+func (self *Session) UpdateVersionContext(ctx context.Context, key int, val []byte, meta data.Metadata, seen data.VectorClock, consistency int) error {
+	args := data.NewDataStore(key, val)
+	args.Meta = meta
+	args.Clock = seen
+	result, err := self.coordinate(ctx, "update", key, "Ring.UpdateData", args, consistency)
+	if err != nil {
+		return err
+	}
+	self.rememberWrite(&result.Data, val, seen)
+	return nil
+}
+
+func (self *Session) Remove(key int, consistency int) error {
+	return self.RemoveContext(context.Background(), key, consistency)
+}
+
+func (self *Session) RemoveContext(ctx context.Context, key int, consistency int) error {
+	_, err := self.coordinate(ctx, "remove", key, "Ring.RemoveData", data.NewDataStore(key, nil), consistency)
+	return err
+}
+
+//Every version of the key, remembering their context for the next Update
+func (self *Session) Lookup(key int, consistency int) (data.DataStore, error) {
+	return self.LookupContext(context.Background(), key, consistency)
+}
+
+func (self *Session) LookupContext(ctx context.Context, key int, consistency int) (data.DataStore, error) {
+	result, err := self.coordinate(ctx, "lookup", key, "Ring.GetData", data.NewDataStore(key, nil), consistency)
+	if err != nil {
+		return result.Data, err
+	}
+	self.remember(key, result.Data.Context())
+	return result.Data, nil
+}
+
+/*
+  Remembered contexts
+*/
+
+//The context remembered from our last Lookup of the key or write to it, for Update, CompareAndSwap and DeleteIfVersion
+func (self *Session) Seen(key int) data.VectorClock {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.contexts[key]
+}
+
+func (self *Session) remember(key int, context data.VectorClock) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.contexts[key] = context
+}
+
+func (self *Session) forget(key int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.contexts, key)
+}
+
+//After a write the context is the clock of the version we wrote, concurrent versions we haven't seen stay unresolved
+func (self *Session) rememberWrite(stored *data.DataStore, val []byte, context data.VectorClock) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.contexts, stored.Key)
+	for _, version := range stored.Versions() {
+		if bytes.Equal(version.Value, val) && version.Clock.Descends(context) {
+			self.contexts[stored.Key] = version.Clock
+			return
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package ring
+
+import (
+	"../data"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+  Durable storage. Every change to the KeyValTable is appended to a write-ahead
+  log in the machine's data directory before anyone hears about it. Every so
+  often the whole table is written out as a snapshot and a new log is started,
+  so that on startup we only have to load the latest snapshot and replay the
+  logs written after it.
+
+  Files are numbered: snapshot.N holds the table as it was when wal.N was
+  started. A crash while writing a snapshot leaves the older snapshot and
+  every log since in place.
+
+  Each record is its length, a CRC of the payload and the gob encoded payload.
+  A record that was only partly written when we crashed fails its checksum,
+  and the log is cut off right before it.
+*/
+
+const (
+	SyncAlways = iota
+	SyncBatched
+	SyncNever
+)
+
+const (
+	walPut = iota
+	walDelete
+)
+
+const (
+	snapshotInterval = 1 * time.Minute
+	syncInterval     = 100 * time.Millisecond
+
+	//Snapshot early when the log grows past this many records
+	walSnapshotRecords = 100000
+)
+
+var errStorageClosed = errors.New("storage closed")
+
+var syncPolicies = map[string]int{
+	"always":  SyncAlways,
+	"batched": SyncBatched,
+	"never":   SyncNever,
+}
+
+func ParseSyncPolicy(name string) (int, error) {
+	policy, found := syncPolicies[name]
+	if !found {
+		return 0, errors.New("unknown fsync policy " + name + ", expected always, batched or never")
+	}
+	return policy, nil
+}
+
+type walRecord struct {
+	Op   int
+	Item data.DataStore
+}
+
+type Storage struct {
+	dir     string
+	policy  int
+	seq     int
+	wal     *os.File
+	writer  *bufio.Writer
+	records int
+	dirty   bool
+	closed  bool
+	lock    sync.Mutex
+}
+
+/*
+  Open the data directory, creating it if needed, and load what it holds into
+  the table. Has to happen before we join the ring.
+*/
+func (self *Ring) OpenStorage(dir string, policy int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	storage := &Storage{dir: dir, policy: policy}
+
+	self.dataLock.Lock()
+	recovered, err := storage.recover(self)
+	self.dataLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := storage.startLog(storage.seq); err != nil {
+		return err
+	}
+	fmt.Println("Recovered", recovered, "keys from", dir)
+	if err := self.openTransactions(filepath.Join(dir, "txn")); err != nil {
+		return err
+	}
+
+	self.Storage = storage
+	go self.SnapshotLoop(snapshotInterval)
+	if policy == SyncBatched {
+		go storage.SyncLoop(syncInterval)
+	}
+	return nil
+}
+
+// Load the latest snapshot and replay the logs written after it
+func (self *Storage) recover(ring *Ring) (int, error) {
+	snapshots, wals, err := self.files()
+	if err != nil {
+		return 0, err
+	}
+
+	//Only a snapshot that was completely written has been renamed into place
+	if len(snapshots) > 0 {
+		self.seq = snapshots[len(snapshots)-1]
+		if err := self.replay(ring, self.path("snapshot", self.seq)); err != nil {
+			return 0, err
+		}
+	}
+	for _, seq := range wals {
+		if seq < self.seq {
+			continue
+		}
+		if err := self.replay(ring, self.path("wal", seq)); err != nil {
+			return 0, err
+		}
+		self.seq = seq
+	}
+	return ring.KeyValTable.Len(), nil
+}
+
+// Apply every record of the file to the table, dropping a torn record at the end
+func (self *Storage) replay(ring *Ring, path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	for {
+		record, size, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			fmt.Println("Cutting", path, "short at offset", offset, err)
+			return file.Truncate(offset)
+		}
+		offset += size
+
+		switch record.Op {
+		case walPut:
+			ring.KeyValTable.DeleteWithKey(data.DataStore{Key: record.Item.Key})
+			ring.KeyValTable.Insert(record.Item)
+		case walDelete:
+			ring.KeyValTable.DeleteWithKey(data.DataStore{Key: record.Item.Key})
+		}
+	}
+}
+
+func readRecord(reader *bufio.Reader) (*walRecord, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errors.New("torn record header")
+		}
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	checksum := binary.BigEndian.Uint32(header[4:])
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, errors.New("torn record")
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, 0, errors.New("record checksum mismatch")
+	}
+
+	record := new(walRecord)
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(record); err != nil {
+		return nil, 0, err
+	}
+	return record, int64(len(header) + len(payload)), nil
+}
+
+func writeRecord(writer io.Writer, record *walRecord) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(record); err != nil {
+		return err
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	if _, err := writer.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := writer.Write(payload.Bytes())
+	return err
+}
+
+/*
+  Logging changes. The table's lock is held while we log, so records end up in
+  the same order the changes were made in.
+*/
+
+func (self *Storage) logPut(item data.DataStore) error {
+	return self.append(&walRecord{Op: walPut, Item: item})
+}
+
+func (self *Storage) logDelete(key int) error {
+	return self.append(&walRecord{Op: walDelete, Item: data.DataStore{Key: key}})
+}
+
+func (self *Storage) append(record *walRecord) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return errStorageClosed
+	}
+	if err := writeRecord(self.writer, record); err != nil {
+		return err
+	}
+	self.records++
+	switch self.policy {
+	case SyncAlways:
+		self.sync()
+	case SyncBatched:
+		self.dirty = true
+	case SyncNever:
+		//Still hand it to the OS, we only lose it if the machine goes down
+		self.writer.Flush()
+	}
+	return nil
+}
+
+// Expects the lock to be held
+func (self *Storage) sync() {
+	if err := self.writer.Flush(); err != nil {
+		fmt.Println("Could not write to the log:", err)
+		return
+	}
+	if err := self.wal.Sync(); err != nil {
+		fmt.Println("Could not sync the log:", err)
+	}
+	self.dirty = false
+}
+
+func (self *Storage) SyncLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		self.lock.Lock()
+		if self.closed {
+			self.lock.Unlock()
+			return
+		}
+		if self.dirty {
+			self.sync()
+		}
+		self.lock.Unlock()
+	}
+}
+
+// Switch to a new log numbered seq. Expects the lock to be held, or the storage not to be in use yet
+func (self *Storage) startLog(seq int) error {
+	wal, err := os.OpenFile(self.path("wal", seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if self.wal != nil {
+		self.sync()
+		self.wal.Close()
+	}
+	self.wal = wal
+	self.writer = bufio.NewWriter(wal)
+	self.seq = seq
+	self.records = 0
+	return nil
+}
+
+// Sync and close the log. Changes made after this aren't logged, and the loops stop
+func (self *Storage) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+	self.sync()
+	err := self.wal.Close()
+	self.wal = nil
+	return err
+}
+
+/*
+  Snapshots
+*/
+
+func (self *Ring) SnapshotLoop(interval time.Duration) {
+	storage := self.Storage
+	lastSnapshot := time.Now()
+	for {
+		time.Sleep(time.Second)
+		storage.lock.Lock()
+		closed, records := storage.closed, storage.records
+		storage.lock.Unlock()
+		if closed {
+			return
+		}
+
+		//Nothing changed since the last snapshot, it is still good
+		if records == 0 {
+			continue
+		}
+		if time.Since(lastSnapshot) >= interval || records >= walSnapshotRecords {
+			if err := self.Snapshot(); err != nil {
+				fmt.Println("Snapshot failed:", err)
+			}
+			lastSnapshot = time.Now()
+		}
+	}
+}
+
+// Write out the whole table and drop the logs it replaces
+func (self *Ring) Snapshot() error {
+	storage := self.Storage
+
+	//Copy the table and start the next log at the same moment, so the snapshot and the new log fit together
+	self.dataLock.Lock()
+	items := make([]data.DataStore, 0, self.KeyValTable.Len())
+	for iter := self.KeyValTable.Min(); !iter.Limit(); iter = iter.Next() {
+		items = append(items, iter.Item().(data.DataStore))
+	}
+	storage.lock.Lock()
+	seq := storage.seq + 1
+	err := errStorageClosed
+	if !storage.closed {
+		err = storage.startLog(seq)
+	}
+	storage.lock.Unlock()
+	self.dataLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := storage.path("snapshot", seq)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for i := range items {
+		if err = writeRecord(writer, &walRecord{Op: walPut, Item: items[i]}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	//The old files may only go once the rename, and the new log, can't be lost in a crash
+	if err = storage.syncDir(); err != nil {
+		return err
+	}
+
+	//Everything older is covered by the new snapshot
+	snapshots, wals, err := storage.files()
+	if err != nil {
+		return err
+	}
+	for _, old := range snapshots {
+		if old < seq {
+			os.Remove(storage.path("snapshot", old))
+		}
+	}
+	for _, old := range wals {
+		if old < seq {
+			os.Remove(storage.path("wal", old))
+		}
+	}
+	return nil
+}
+
+/*
+  Files in the data directory
+*/
+
+func (self *Storage) path(kind string, seq int) string {
+	return filepath.Join(self.dir, kind+"."+strconv.Itoa(seq))
+}
+
+// Make the files created and renamed in the directory stick
+func (self *Storage) syncDir() error {
+	dir, err := os.Open(self.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Numbers of the snapshots and logs we have, oldest first
+func (self *Storage) files() (snapshots []int, wals []int, err error) {
+	entries, err := os.ReadDir(self.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		fields := strings.SplitN(entry.Name(), ".", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		seq, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "snapshot":
+			snapshots = append(snapshots, seq)
+		case "wal":
+			wals = append(wals, seq)
+		}
+	}
+	sort.Ints(snapshots)
+	sort.Ints(wals)
+	return snapshots, wals, nil
+}
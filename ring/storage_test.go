@@ -0,0 +1,186 @@
+package ring
+
+import (
+	"../data"
+	"../rbtree"
+	"bytes"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// A ring with nothing but a table, storage and what writing to the table needs
+func testStorageRing() *Ring {
+	return &Ring{
+		KeyValTable: rbtree.NewTree(func(a, b rbtree.Item) int {
+			return data.CompareKeys(a.(data.DataStore).Key, b.(data.DataStore).Key)
+		}),
+		watches: newWatchLog(),
+		txns:    newTxnState(),
+	}
+}
+
+func openTestStorage(t *testing.T, dir string, policy int) *Ring {
+	ring := testStorageRing()
+	if err := ring.OpenStorage(dir, policy); err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+// What the table holds, key to value, tombstones left out
+func tableContents(ring *Ring) map[int]string {
+	contents := make(map[int]string)
+	for _, item := range ring.localData() {
+		if !item.IsDeleted() {
+			contents[item.Key] = string(item.Value)
+		}
+	}
+	return contents
+}
+
+func sameContents(got, want map[int]string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for key, value := range want {
+		if got[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// What is written before and after a snapshot, and what a restart finds
+var recoveryCases = []struct {
+	name     string
+	policy   int
+	snapshot bool
+	before   []int
+	after    []int
+	deletes  []int
+	want     map[int]string
+}{
+	{"empty", SyncAlways, false, nil, nil, nil, map[int]string{}},
+	{"log only", SyncAlways, false, []int{1, 2}, []int{3}, []int{2}, map[int]string{1: "1", 3: "3"}},
+	{"snapshot and log", SyncAlways, true, []int{1, 4}, []int{2, 3}, []int{1}, map[int]string{2: "2", 3: "3", 4: "4"}},
+	{"snapshot only", SyncAlways, true, []int{1, 2}, nil, nil, map[int]string{1: "1", 2: "2"}},
+	{"batched", SyncBatched, true, []int{4, -5}, []int{5}, []int{-5}, map[int]string{4: "4", 5: "5"}},
+	{"never", SyncNever, false, []int{4}, []int{7}, nil, map[int]string{4: "4", 7: "7"}},
+}
+
+func TestStorageRecovery(t *testing.T) {
+	for _, c := range recoveryCases {
+		dir := t.TempDir()
+		ring := openTestStorage(t, dir, c.policy)
+		for _, key := range c.before {
+			ring.mergeLocal(data.NewDataStore(key, []byte(strconv.Itoa(key))))
+		}
+		if c.snapshot {
+			if err := ring.Snapshot(); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+		for _, key := range c.after {
+			ring.mergeLocal(data.NewDataStore(key, []byte(strconv.Itoa(key))))
+		}
+		for _, key := range c.deletes {
+			ring.deleteLocal(key)
+		}
+		if err := ring.Storage.Close(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		restarted := openTestStorage(t, dir, c.policy)
+		if got := tableContents(restarted); !sameContents(got, c.want) {
+			t.Errorf("%s: recovered %v, want %v", c.name, got, c.want)
+		}
+		restarted.Storage.Close()
+	}
+}
+
+// Only the latest snapshot and the logs after it are kept
+func TestSnapshotDropsOldFiles(t *testing.T) {
+	ring := openTestStorage(t, t.TempDir(), SyncAlways)
+	defer ring.Storage.Close()
+	for i := 0; i < 3; i++ {
+		ring.mergeLocal(data.NewDataStore(i, []byte("value")))
+		if err := ring.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshots, wals, err := ring.Storage.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || len(wals) != 1 || snapshots[0] != wals[0] {
+		t.Errorf("snapshots %v and logs %v left", snapshots, wals)
+	}
+}
+
+// A record cut off by a crash is dropped, with everything written before it kept
+func TestStorageTornRecord(t *testing.T) {
+	var record bytes.Buffer
+	if err := writeRecord(&record, &walRecord{walPut, *data.NewDataStore(3, []byte("3"))}); err != nil {
+		t.Fatal(err)
+	}
+	good := record.Bytes()
+	flipped := append([]byte{}, good...)
+	flipped[len(flipped)-1] ^= 0x10
+
+	cases := []struct {
+		name string
+		tail []byte
+	}{
+		{"torn header", good[:3]},
+		{"torn payload", good[:len(good)-1]},
+		{"bad checksum", flipped},
+		{"garbage", []byte{0, 0, 0, 2, 0, 0, 0, 0, 7, 7}},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		ring := openTestStorage(t, dir, SyncAlways)
+		ring.mergeLocal(data.NewDataStore(1, []byte("1")))
+		ring.mergeLocal(data.NewDataStore(2, []byte("2")))
+		path := ring.Storage.path("wal", ring.Storage.seq)
+		ring.Storage.Close()
+
+		before, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, append(append([]byte{}, before...), c.tail...), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		restarted := openTestStorage(t, dir, SyncAlways)
+		if got := tableContents(restarted); !sameContents(got, map[int]string{1: "1", 2: "2"}) {
+			t.Errorf("%s: recovered %v", c.name, got)
+		}
+		restarted.Storage.Close()
+		after, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(after, before) {
+			t.Errorf("%s: log is %d bytes after recovery, want %d", c.name, len(after), len(before))
+		}
+	}
+}
+
+// Nothing is logged once the storage is closed, and no snapshot started
+func TestStorageClosed(t *testing.T) {
+	ring := openTestStorage(t, t.TempDir(), SyncBatched)
+	if err := ring.Storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Storage.logPut(*data.NewDataStore(1, []byte("1"))); err != errStorageClosed {
+		t.Errorf("write after close: %v", err)
+	}
+	if err := ring.Snapshot(); err != errStorageClosed {
+		t.Errorf("snapshot after close: %v", err)
+	}
+	if err := ring.Storage.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package ring
+
+import (
+	"../data"
+	"fmt"
+	"net"
+	"time"
+)
+
+/*
+  Local storage. Everything that reads or changes the KeyValTable goes through
+  here, so RPC handlers, replication and data transfers can run at the same
+  time without stepping on each other, and every change makes it to the
+  write-ahead log when the machine has a data directory.
+*/
+
+func (self *Ring) getLocal(key int) (data.DataStore, bool) {
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+	return self.get(key)
+}
+
+// Store the item if we don't have the key yet
+func (self *Ring) insertLocal(item data.DataStore) bool {
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+	if _, found := self.get(item.Key); found {
+		return false
+	}
+	self.put(item)
+	return true
+}
+
+// Store the item, combining it with the versions we already have
+func (self *Ring) mergeLocal(item *data.DataStore) data.DataStore {
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+
+	merged := *item
+	if existing, found := self.get(item.Key); found {
+		merged.Merge(&existing)
+	}
+	self.put(merged)
+	return merged
+}
+
+func (self *Ring) deleteLocal(key int) bool {
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+	return self.remove(key)
+}
+
+/*
+  Store a client's write, or its remove if sentData is a tombstone, as the coordinator of the key. The new clock descends
+  from the context the client sent, so every version the client saw is replaced,
+  while versions it hasn't seen stay around as siblings. Keys a transaction
+  locked can't be written until it is decided.
+*/
+func (self *Ring) coordinateWrite(sentData *data.DataStore) (data.DataStore, error) {
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+	if self.txns.lockedLocal(sentData.Key) {
+		return data.DataStore{}, ErrLocked
+	}
+	return self.writeCoordinated(sentData), nil
+}
+
+/*
+  coordinateWrite if the condition holds for our copy of the key, checked and
+  written without letting go of the lock. The write replaces every version we
+  hold. Returns what we stored, or what we hold if the condition didn't hold.
+*/
+func (self *Ring) coordinateConditionalWrite(sentData *data.DataStore, condition *data.Condition) (data.DataStore, bool, error) {
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+
+	if self.txns.lockedLocal(sentData.Key) {
+		return data.DataStore{}, false, ErrLocked
+	}
+	existing, found := self.get(sentData.Key)
+	if !condition.Holds(&existing, found) {
+		return existing, false, nil
+	}
+	return self.replaceLocal(sentData, &existing, found), true, nil
+}
+
+/*
+  coordinateWrite of an update, or of a remove, only if the key holds a live
+  version, checked and written without letting go of the lock. A remove writes
+  a tombstone over every version we hold as well as the ones the client saw.
+*/
+func (self *Ring) coordinateExisting(sentData *data.DataStore, remove bool) (data.DataStore, error) {
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+
+	if self.txns.lockedLocal(sentData.Key) {
+		return data.DataStore{}, ErrLocked
+	}
+	existing, found := self.get(sentData.Key)
+	if !found || existing.IsDeleted() {
+		return data.DataStore{}, ErrNotFound
+	}
+	if remove {
+		tombstone := data.DataStore{Key: sentData.Key, Version: data.NewTombstone(existing.Context().Merge(sentData.Clock))}
+		return self.writeCoordinated(&tombstone), nil
+	}
+	return self.writeCoordinated(sentData), nil
+}
+
+// Write over every version we hold of the key. Expects the lock to be held
+func (self *Ring) replaceLocal(sentData *data.DataStore, existing *data.DataStore, found bool) data.DataStore {
+	write := *sentData
+	if found {
+		write.Clock = existing.Context()
+	}
+	return self.writeCoordinated(&write)
+}
+
+// Expects the lock to be held
+func (self *Ring) writeCoordinated(sentData *data.DataStore) data.DataStore {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+
+	clock := sentData.Clock.Copy()
+	existing, found := self.get(sentData.Key)
+	if found {
+		//Our counter has to pass every version we coordinated, even ones the client hasn't seen
+		for _, version := range existing.Versions() {
+			if version.Clock[myAddr] > clock[myAddr] {
+				clock[myAddr] = version.Clock[myAddr]
+			}
+		}
+	}
+
+	meta := sentData.Meta
+	meta.Size = len(sentData.Value)
+	meta.Modified = time.Now()
+	meta.Created = meta.Modified
+	meta.Expires = time.Time{}
+	if meta.TTL > 0 {
+		meta.Expires = meta.Modified.Add(meta.TTL)
+	}
+	if found {
+		//A value keeps its creation time for as long as it isn't removed
+		for _, version := range existing.Live() {
+			if !version.Meta.Created.IsZero() && version.Meta.Created.Before(meta.Created) {
+				meta.Created = version.Meta.Created
+			}
+		}
+	}
+
+	item := data.DataStore{Key: sentData.Key, Version: data.Version{Value: sentData.Value, Meta: meta, Clock: clock.Increment(myAddr)}}
+	if sentData.Deleted {
+		item.Version = data.NewTombstone(clock.Increment(myAddr))
+	}
+	if found {
+		item.Merge(&existing)
+	}
+	self.put(item)
+	self.watches.publish(eventFor(sentData.Deleted, found && !existing.IsDeleted()), item)
+	return item
+}
+
+// Replace the key with a tombstone if every value it holds expired, unless it was written to since
+func (self *Ring) expireLocal(key int) (data.DataStore, bool) {
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+
+	existing, found := self.get(key)
+	if !found || !existing.Expired() || self.txns.lockedLocal(key) {
+		return existing, false
+	}
+	tombstone := data.DataStore{Key: key, Version: data.Version{Clock: existing.Context(), Deleted: true}}
+	return self.writeCoordinated(&tombstone), true
+}
+
+// Forget a tombstone, or a copy we no longer have to keep, unless something was written to the key since we looked at it
+func (self *Ring) purgeLocal(tombstone *data.DataStore) bool {
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+
+	existing, found := self.get(tombstone.Key)
+	if !found || !data.SameVersions(&existing, tombstone) {
+		return false
+	}
+	return self.remove(tombstone.Key)
+}
+
+//Copy of everything in our table, so it can be modified while we go through it
+func (self *Ring) localData() []data.DataStore {
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+
+	items := make([]data.DataStore, 0, self.KeyValTable.Len())
+	for iter := self.KeyValTable.Min(); !iter.Limit(); iter = iter.Next() {
+		items = append(items, iter.Item().(data.DataStore))
+	}
+	return items
+}
+
+// What we hold from request.Low to request.High, tombstones included, in scan order and at most request.Limit
+func (self *Ring) localRange(request *RangeRequest) []data.DataStore {
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+
+	items := make([]data.DataStore, 0)
+	if request.Reverse {
+		for iter := self.KeyValTable.FindLE(data.DataStore{Key: request.High}); !iter.NegativeLimit() && len(items) < request.Limit; iter = iter.Prev() {
+			item := iter.Item().(data.DataStore)
+			if item.Key < request.Low {
+				break
+			}
+			items = append(items, item)
+		}
+		return items
+	}
+	for iter := self.KeyValTable.FindGE(data.DataStore{Key: request.Low}); !iter.Limit() && len(items) < request.Limit; iter = iter.Next() {
+		item := iter.Item().(data.DataStore)
+		if item.Key > request.High {
+			break
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// The following expect dataLock to be held
+
+func (self *Ring) get(key int) (data.DataStore, bool) {
+	found := self.KeyValTable.Get(data.DataStore{Key: key})
+	if found == nil {
+		return data.NilDataStore(), false
+	}
+	return found.(data.DataStore), true
+}
+
+func (self *Ring) put(item data.DataStore) {
+	if self.Storage != nil {
+		if err := self.Storage.logPut(item); err != nil {
+			fmt.Println("Could not log the write of", item.Key, err)
+		}
+	}
+	self.KeyValTable.DeleteWithKey(data.DataStore{Key: item.Key})
+	self.KeyValTable.Insert(item)
+}
+
+func (self *Ring) remove(key int) bool {
+	if !self.KeyValTable.DeleteWithKey(data.DataStore{Key: key}) {
+		return false
+	}
+	if self.Storage != nil {
+		if err := self.Storage.logDelete(key); err != nil {
+			fmt.Println("Could not log the removal of", key, err)
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package ring
+
+import (
+	"../data"
+	"testing"
+)
+
+const (
+	testInsert = iota
+	testUpdate
+	testRemove
+)
+
+// Write to the key the way the SendData handlers do as its coordinator
+func testCoordinate(ring *Ring, op int, key int, value string) (data.DataStore, error) {
+	item := data.NewDataStore(key, []byte(value))
+	switch op {
+	case testInsert:
+		stored, ok, err := ring.coordinateConditionalWrite(item, data.NewAbsentCondition())
+		if err == nil && !ok {
+			err = ErrExists
+		}
+		return stored, err
+	case testUpdate:
+		return ring.coordinateExisting(item, false)
+	}
+	return ring.coordinateExisting(item, true)
+}
+
+// Where key 1 is before the write, what the write is, and what it leaves behind
+var coordinateCases = []struct {
+	name    string
+	setup   []int
+	locked  bool
+	op      int
+	want    error
+	value   string
+	deleted bool
+}{
+	{name: "insert", op: testInsert, value: "new"},
+	{name: "insert over a value", setup: []int{testInsert}, op: testInsert, want: ErrExists, value: "old"},
+	{name: "insert over a removed key", setup: []int{testInsert, testRemove}, op: testInsert, value: "new"},
+	{name: "update", setup: []int{testInsert}, op: testUpdate, value: "new"},
+	{name: "update a missing key", op: testUpdate, want: ErrNotFound},
+	{name: "update a removed key", setup: []int{testInsert, testRemove}, op: testUpdate, want: ErrNotFound, deleted: true},
+	{name: "remove", setup: []int{testInsert}, op: testRemove, deleted: true},
+	{name: "remove a missing key", op: testRemove, want: ErrNotFound},
+	{name: "remove twice", setup: []int{testInsert, testRemove}, op: testRemove, want: ErrNotFound, deleted: true},
+	{name: "update a locked key", setup: []int{testInsert}, locked: true, op: testUpdate, want: ErrLocked, value: "old"},
+	{name: "remove a locked key", setup: []int{testInsert}, locked: true, op: testRemove, want: ErrLocked, value: "old"},
+	{name: "insert a locked key", locked: true, op: testInsert, want: ErrLocked},
+}
+
+func TestCoordinateExisting(t *testing.T) {
+	for _, c := range coordinateCases {
+		ring := testStorageRing()
+		ring.Address, ring.Port = "127.0.0.1", "5555"
+		for _, op := range c.setup {
+			if _, err := testCoordinate(ring, op, 1, "old"); err != nil {
+				t.Fatalf("%s: setting up: %v", c.name, err)
+			}
+		}
+		if c.locked {
+			ring.txns.locks[1] = "txn"
+		}
+
+		_, err := testCoordinate(ring, c.op, 1, "new")
+		if err != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+		item, found := ring.getLocal(1)
+		switch {
+		case c.deleted:
+			if !found || !item.IsDeleted() {
+				t.Errorf("%s: key holds %v, want a tombstone", c.name, item)
+			}
+		case c.value == "":
+			if found {
+				t.Errorf("%s: key holds %v, want nothing", c.name, item)
+			}
+		default:
+			live := item.Live()
+			if len(live) != 1 || string(live[0].Value) != c.value {
+				t.Errorf("%s: key holds %v, want %q", c.name, item, c.value)
+			}
+		}
+	}
+}
+
+// Every write descends from what the coordinator held, so nothing it wrote before is left as a sibling
+func TestCoordinateReplacesVersions(t *testing.T) {
+	ring := testStorageRing()
+	ring.Address, ring.Port = "127.0.0.1", "5555"
+	for i, op := range []int{testInsert, testUpdate, testUpdate, testRemove, testInsert, testUpdate} {
+		stored, err := testCoordinate(ring, op, 1, "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.HasSiblings() {
+			t.Errorf("write %d left siblings: %v", i, stored)
+		}
+	}
+	if item, _ := ring.getLocal(1); item.Context()["127.0.0.1:5555"] != 6 {
+		t.Errorf("six writes ended up with context %v", item.Context())
+	}
+}
@@ -0,0 +1,301 @@
+package ring
+
+import (
+	"../data"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+  Failure detection, the SWIM way. Every protocol period we ping one member,
+  going round the members in a random order so each is probed within a bounded
+  number of periods. If it doesn't answer in time we ask a few others to ping
+  it for us, in case only the path between us is slow. If nobody gets an answer
+  the member becomes a suspect. Suspicion is gossiped with the rest of the
+  table, and the member can refute it by bumping its incarnation. Only when the
+  suspicion outlives its timeout is the member declared dead and taken off the
+  ring.
+*/
+
+const (
+	probeInterval  = 1 * time.Second
+	pingTimeout    = 300 * time.Millisecond
+	indirectProbes = 3
+
+	//Suspects get this many protocol periods per doubling of the group to refute before they are declared dead
+	suspectPeriods = 3
+)
+
+type FailureDetector struct {
+	lock     sync.Mutex
+	seq      int
+	waiting  map[int]chan bool
+	suspects map[string]time.Time
+	order    []string
+}
+
+func NewFailureDetector() *FailureDetector {
+	return &FailureDetector{
+		waiting:  make(map[int]chan bool),
+		suspects: make(map[string]time.Time),
+	}
+}
+
+// A new sequence number and the channel its ack will arrive on
+func (self *FailureDetector) expect() (int, chan bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.seq++
+	ack := make(chan bool, 1)
+	self.waiting[self.seq] = ack
+	return self.seq, ack
+}
+
+func (self *FailureDetector) forget(seq int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.waiting, seq)
+}
+
+func (self *FailureDetector) acked(seq int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if ack, found := self.waiting[seq]; found {
+		ack <- true
+		delete(self.waiting, seq)
+	}
+}
+
+// Start the suspicion timer of a machine, unless it is running already
+func (self *FailureDetector) suspect(address string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, found := self.suspects[address]; !found {
+		self.suspects[address] = time.Now()
+	}
+}
+
+func (self *FailureDetector) suspectedSince() map[string]time.Time {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	suspects := make(map[string]time.Time, len(self.suspects))
+	for address, since := range self.suspects {
+		suspects[address] = since
+	}
+	return suspects
+}
+
+func (self *FailureDetector) cleared(address string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.suspects, address)
+}
+
+/*
+  Probing
+*/
+
+func (self *Ring) FailureDetection(interval time.Duration) {
+	for self.Active {
+		start := time.Now()
+		if target := self.nextProbeTarget(); target != nil {
+			self.probe(target, interval)
+		}
+		self.expireSuspects()
+		time.Sleep(interval - time.Since(start))
+	}
+}
+
+// Members that can be probed: every other live machine
+func (self *Ring) probeCandidates() []string {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	self.membersLock.RLock()
+	defer self.membersLock.RUnlock()
+	candidates := make([]string, 0, len(self.Usertable))
+	for address, member := range self.Usertable {
+		if address != myAddr && member.Id != -1 && member.State != data.Dead {
+			candidates = append(candidates, address)
+		}
+	}
+	return candidates
+}
+
+// Round robin over the members, reshuffled every time we have gone round once
+func (self *Ring) nextProbeTarget() *data.GroupMember {
+	detector := self.detector
+	for {
+		if len(detector.order) == 0 {
+			detector.order = self.probeCandidates()
+			if len(detector.order) == 0 {
+				return nil
+			}
+			rand.Shuffle(len(detector.order), func(i, j int) {
+				detector.order[i], detector.order[j] = detector.order[j], detector.order[i]
+			})
+		}
+		address := detector.order[0]
+		detector.order = detector.order[1:]
+		self.membersLock.RLock()
+		member := self.memberCopy(address)
+		live := member != nil && member.Id != -1 && member.State != data.Dead
+		self.membersLock.RUnlock()
+		if live {
+			return member
+		}
+	}
+}
+
+// Ping the member directly, then through others, and suspect it if nobody hears back within the period
+func (self *Ring) probe(target *data.GroupMember, period time.Duration) {
+	seq, ack := self.detector.expect()
+	defer self.detector.forget(seq)
+
+	self.sendMessageWithPort(&data.Message{Type: data.MessagePing, Seq: seq}, target.Address)
+	select {
+	case <-ack:
+		return
+	case <-time.After(pingTimeout):
+	}
+
+	helpers := self.probeCandidates()
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	asked := 0
+	for _, helper := range helpers {
+		if asked == indirectProbes {
+			break
+		}
+		if helper != target.Address {
+			self.sendMessageWithPort(&data.Message{Type: data.MessagePingReq, Seq: seq, Target: target.Address}, helper)
+			asked++
+		}
+	}
+
+	select {
+	case <-ack:
+	case <-time.After(period - pingTimeout):
+		self.suspectMember(target.Address)
+	}
+}
+
+func (self *Ring) suspectMember(address string) {
+	//Gossip may have replaced the entry while we were probing
+	self.membersLock.Lock()
+	defer self.membersLock.Unlock()
+	member := self.Usertable[address]
+	if member == nil || member.State != data.Alive {
+		return
+	}
+	fmt.Println("Suspecting", member.Address, "incarnation", member.Incarnation)
+	member.State = data.Suspect
+	self.detector.suspect(member.Address)
+}
+
+// How long a suspect has to refute before we declare it dead, grows with the size of the group
+func (self *Ring) suspicionTimeout() time.Duration {
+	self.membersLock.RLock()
+	members := len(self.Usertable)
+	self.membersLock.RUnlock()
+	periods := suspectPeriods * math.Max(1, math.Log2(float64(members)))
+	return time.Duration(periods * float64(probeInterval))
+}
+
+func (self *Ring) expireSuspects() {
+	timeout := self.suspicionTimeout()
+	for address, since := range self.detector.suspectedSince() {
+		self.membersLock.RLock()
+		member := self.Usertable[address]
+		suspected := member != nil && member.State == data.Suspect
+		self.membersLock.RUnlock()
+		if !suspected {
+			self.detector.cleared(address)
+		} else if time.Since(since) > timeout {
+			self.declareDead(address)
+		}
+	}
+}
+
+// Take the machine off the ring, and make sure its keys still have enough replicas
+func (self *Ring) declareDead(address string) {
+	self.membersLock.Lock()
+	member := self.Usertable[address]
+	if member == nil || member.State == data.Dead {
+		self.membersLock.Unlock()
+		return
+	}
+	id, heartbeat, incarnation := member.Id, member.Heartbeat, member.Incarnation
+	self.membersLock.Unlock()
+	log.Println("MACHINE DEAD!", id, address)
+	self.detector.cleared(address)
+	connections.Drop(address)
+	wasPredecessor := self.isPredecessor(address)
+
+	//Deletes the member in the userkeytable
+	dead := data.NewGroupMember(-1, address, heartbeat, Leaving)
+	dead.State = data.Dead
+	dead.Incarnation = incarnation
+	self.updateMember(dead)
+
+	//We took over some of its keys
+	if wasPredecessor {
+		fmt.Println("Now you need to update your replicas")
+		self.bulkDataSendToReplicas()
+	}
+}
+
+// Somebody suspects us or thinks we're dead: tell everyone we're alive with an incarnation they haven't seen
+func (self *Ring) refute(incarnation int) {
+	self.membersLock.Lock()
+	defer self.membersLock.Unlock()
+	me := self.Usertable[net.JoinHostPort(self.Address, self.Port)]
+	if me == nil || incarnation < me.Incarnation {
+		return
+	}
+	me.Incarnation = incarnation + 1
+	me.State = data.Alive
+	fmt.Println("Refuting suspicion with incarnation", me.Incarnation)
+}
+
+// Apply the failure detector's view of a member that came with gossip, with the members lock held
+func (self *Ring) mergeMemberState(member, heard *data.GroupMember) {
+	if !heard.Overrides(member) {
+		return
+	}
+	if heard.State == data.Suspect && member.State != data.Suspect {
+		fmt.Println("Heard that", member.Address, "is suspected")
+		self.detector.suspect(member.Address)
+	}
+	member.State = heard.State
+	member.Incarnation = heard.Incarnation
+}
+
+/*
+  Messages, all over UDP next to the gossip
+*/
+
+// Answer right away
+func (self *Ring) handlePing(sender string, msg *data.Message) {
+	self.sendMessageWithPort(&data.Message{Type: data.MessageAck, Seq: msg.Seq}, sender)
+}
+
+// Ping the target for the sender and pass its ack on
+func (self *Ring) handlePingReq(sender string, msg *data.Message) {
+	go func() {
+		seq, ack := self.detector.expect()
+		defer self.detector.forget(seq)
+		self.sendMessageWithPort(&data.Message{Type: data.MessagePing, Seq: seq}, msg.Target)
+		select {
+		case <-ack:
+			self.sendMessageWithPort(&data.Message{Type: data.MessageAck, Seq: msg.Seq}, sender)
+		case <-time.After(pingTimeout):
+		}
+	}()
+}
+
+func (self *Ring) handleAck(msg *data.Message) {
+	self.detector.acked(msg.Seq)
+}
@@ -2,27 +2,31 @@ package ring
 
 import (
 	"../data"
+	"context"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/rpc"
+	"reflect"
 )
 
-func (self *Ring) createTCPListener(hostPort string) {
+func (self *Ring) createTCPListener(hostPort string) error {
 	var tcpaddr *net.TCPAddr
 	tcpaddr, err := net.ResolveTCPAddr("tcp", hostPort)
 	if err != nil {
-		return
+		return err
+	}
+	if err := rpc.Register(self); err != nil {
+		return err
 	}
-	rpc.Register(self)
 	rpc.HandleHTTP()
 
 	conn, err := net.ListenTCP("tcp", tcpaddr)
 	if err != nil {
-		log.Fatal("listen error:", err)
+		return err
 	}
 	go http.Serve(conn, nil)
+	return nil
 }
 
 /*
@@ -32,153 +36,62 @@ func (self *Ring) createTCPListener(hostPort string) {
 
 /* Insert */
 func (self *Ring) SendData(sentData *data.DataStore, response *RpcResult) error {
-
-	//Check if there is a newer machine for this
-	machineAddr := self.getMachineForKey(sentData.Key).Value
-	myAddr := net.JoinHostPort(self.Address, self.Port)
-
-	//newer machine exists
-	if machineAddr != myAddr {
-		response.Member = self.Usertable[machineAddr]
-		//i am the newest
-	} else {
-		inserted := self.KeyValTable.Insert(data.DataStore{(*sentData).Key, (*sentData).Value})
-		response.Success = Btoi(inserted)
-		if response.Success != 1 {
-			fmt.Println("Cannot store data: Should not happen unless machine gone")
-		} else {
-			response.Success = self.writeToReplicas(sentData, self.Usertable[myAddr].Id)
-		}
-	}
-
-	return nil
+	return self.SendDataConsistent(data.NewConsistentDataStore(sentData, All), response)
 }
 
-//Write data specifically to the given machine -- similar to insert except doesnt check for the latest machine
+//Write data specifically to the given machine -- similar to insert except doesnt check for the latest machine.
+//The versions sent are merged with the ones we have, so concurrent writes are kept as siblings
 func (self *Ring) WriteData(sentData *data.DataStore, response *RpcResult) error {
 
-	deleted := self.KeyValTable.DeleteWithKey(data.DataStore{(*sentData).Key, ""})
-	response.Success = Btoi(deleted)
-	fmt.Println("Deleting ", ((*sentData).Key))
-	//TODO:: Probaby a better way to ensure that we are not just deleting data
-	if ((*sentData).Value) != "##DELETE##" {
-		fmt.Println("Inserting ", ((*sentData).Key), (*sentData).Value)
-		inserted := self.KeyValTable.Insert(data.DataStore{(*sentData).Key, (*sentData).Value})
-		response.Success = Btoi(inserted)
-		if response.Success != 1 {
-			fmt.Println("Replica does not want to store data :(")
-		}
+	//Removes arrive as tombstones and are merged like any other version
+	if sentData.IsDeleted() {
+		fmt.Println("Deleting ", ((*sentData).Key))
+	} else {
+		fmt.Println("Inserting ", ((*sentData).Key), data.Printable(sentData.Value))
 	}
+	self.mergeLocal(sentData)
+	response.Success = 1
 	return nil
 }
 
 /* Remove */
 func (self *Ring) RemoveData(args *data.DataStore, response *RpcResult) error {
-
-	deleted := self.KeyValTable.DeleteWithKey(data.DataStore{(*args).Key, ""})
-	response.Success = Btoi(deleted)
-	response.Member = nil
-	myAddr := net.JoinHostPort(self.Address, self.Port)
-
-	if response.Success != 1 {
-		machineAddr := self.getMachineForKey(args.Key).Value
-		myAddr := net.JoinHostPort(self.Address, self.Port)
-		if machineAddr != myAddr {
-			response.Member = self.Usertable[machineAddr]
-		} else {
-			fmt.Println("Data doesnt exist")
-		}
-	} else {
-		(*args).Value = "##DELETE##"
-		response.Success = self.writeToReplicas(args, self.Usertable[myAddr].Id)
-	}
-	return nil
+	return self.RemoveDataConsistent(data.NewConsistentDataStore(args, All), response)
 }
 
 /* Lookup */
 func (self *Ring) GetData(args *data.DataStore, response *RpcResult) error {
-	found := self.KeyValTable.Get(data.DataStore{(*args).Key, ""})
-	response.Member = nil
-	if found == nil {
-		machineAddr := self.getMachineForKey(args.Key).Value
-		myAddr := net.JoinHostPort(self.Address, self.Port)
-		if machineAddr != myAddr {
-			response.Member = self.Usertable[machineAddr]
-		} else {
-			fmt.Println("Data doesnt exist")
-		}
-		response.Success = 0
-	} else {
-		response.Success = 1
-		response.Data = found.(data.DataStore)
-	}
-	return nil
+	return self.GetDataConsistent(data.NewConsistentDataStore(args, All), response)
 }
 
-/* Update : Delete the current data, then add the new */
+/* Update */
 func (self *Ring) UpdateData(sentData *data.DataStore, response *RpcResult) error {
-	deleted := self.KeyValTable.DeleteWithKey(data.DataStore{(*sentData).Key, ""})
-	myAddr := net.JoinHostPort(self.Address, self.Port)
-	if !deleted {
-		machineAddr := self.getMachineForKey(sentData.Key).Value
-		myAddr := net.JoinHostPort(self.Address, self.Port)
-		if machineAddr != myAddr {
-			response.Member = self.Usertable[machineAddr]
-		} else {
-			fmt.Println("Data doesnt exist")
-		}
-		response.Success = 0
-	} else {
-		inserted := self.KeyValTable.Insert(data.DataStore{(*sentData).Key, (*sentData).Value})
-		response.Success = Btoi(inserted)
-		if response.Success != 1 {
-			fmt.Println("Cannot update date: Should not happen unless machine gone")
-		} else {
-			response.Success = self.writeToReplicas(sentData, self.Usertable[myAddr].Id)
-		}
-	}
-
-	return nil
+	return self.UpdateDataConsistent(data.NewConsistentDataStore(sentData, All), response)
 }
 
-//Get data for when joining the group. We need to use the array as its impossible to track the location of next member
-//without deleting the current member. Which we dont want as we will store it as a replica
-func (self *Ring) GetEntryData(location *data.LocationStore, responseData *[]*data.DataStore) error {
+//Get data for when joining the group: everything we hold in the given range, tombstones included. We keep our
+//copies as the joining machine may only be another replica for them
+func (self *Ring) GetEntryData(keyRange *data.KeyRange, responseData *[]*data.DataStore) error {
 
 	data_t := make([]*data.DataStore, 0)
 
-	False := self.KeyValTable.Limit()
-	min := self.KeyValTable.Min()
-
-	for min != False {
-		response := min.Item().(data.DataStore)
-		data_t = append(data_t, &response)
-		member := data.NewGroupMember((response).Key, (*location).Value, 0, Joining)
-		self.updateMember(member)
-		fmt.Println(member)
-
-		//We are commenting this because our successors are our replicas
-		//self.KeyValTable.DeleteWithIterator(min)
-
-		min = min.Next()
-
+	for _, item := range self.localData() {
+		response := item
+		if keyRange.Contains(response.Key) {
+			data_t = append(data_t, &response)
+		}
 	}
-	fmt.Println(data_t)
+	fmt.Println(len(data_t), "keys requested by joining member")
 	*responseData = data_t
 	return nil
 }
 
 func (self *Ring) SendLeaveData(sentData *data.DataStore, response *RpcResult) error {
 
-	self.KeyValTable.DeleteWithKey(data.DataStore{(*sentData).Key, ""})
-	inserted := self.KeyValTable.Insert(data.DataStore{(*sentData).Key, (*sentData).Value})
-
-	response.Success = Btoi(inserted)
-	myAddr := net.JoinHostPort(self.Address, self.Port)
+	stored := self.mergeLocal(sentData)
+	response.Success = self.writeToReplicas(&stored)
 	if response.Success != 1 {
-		fmt.Println("Cannot store date: Should not happen unless machine gone")
-	} else {
-		response.Success = self.writeToReplicas(sentData, self.Usertable[myAddr].Id)
+		fmt.Println("Could not replicate data handed over by leaving machine")
 	}
 	return nil
 }
@@ -186,8 +99,49 @@ func (self *Ring) SendLeaveData(sentData *data.DataStore, response *RpcResult) e
 /*
   Some other utility functions that may be called over RPC
 */
+func (self *Ring) GetMembers(unused int, members *[]*data.GroupMember) error {
+	*members = self.members()
+	return nil
+}
+
+// Where keys live, enough for a client to send requests to the right machine
+type RingView struct {
+	Chord     bool
+	Locations []data.LocationStore
+}
+
+// Every position on the ring, or with Chord the positions around us we know of
+func (self *Ring) GetRingView(unused int, view *RingView) error {
+	chord := self.getChord()
+	if chord != nil {
+		view.Chord = true
+		view.Locations = append(chord.successorList(), chord.self)
+		if predecessor := chord.getPredecessor(); predecessor.Key != -1 {
+			view.Locations = append(view.Locations, predecessor)
+		}
+		return nil
+	}
+	self.membersLock.RLock()
+	defer self.membersLock.RUnlock()
+	view.Locations = make([]data.LocationStore, 0, self.UserKeyTable.Len())
+	for iter := self.UserKeyTable.Min(); !iter.Limit(); iter = iter.Next() {
+		view.Locations = append(view.Locations, iter.Item().(data.LocationStore))
+	}
+	return nil
+}
+
 func (self *Ring) GetSuccessor(key *int, currSuccessorMember **data.GroupMember) error {
+	if self.getChord() != nil {
+		successor, err := self.findSuccessor(*key + 1)
+		if err != nil {
+			return err
+		}
+		*currSuccessorMember = self.learnNode(successor)
+		return nil
+	}
 
+	self.membersLock.RLock()
+	defer self.membersLock.RUnlock()
 	successorItem := self.UserKeyTable.FindGE(data.LocationStore{*key + 1, ""})
 	overFlow := self.UserKeyTable.Limit()
 	fmt.Println(successorItem)
@@ -199,7 +153,7 @@ func (self *Ring) GetSuccessor(key *int, currSuccessorMember **data.GroupMember)
 		fmt.Println("IGetting")
 		item := successorItem.Item()
 		value := item.(data.LocationStore).Value
-		member := self.Usertable[value]
+		member := self.memberCopy(value)
 		fmt.Println(member.Id)
 		*currSuccessorMember = member
 		//We can add code to update member key here as well? Or we can wait for it to be gossiped to us
@@ -210,6 +164,50 @@ func (self *Ring) GetSuccessor(key *int, currSuccessorMember **data.GroupMember)
 	return nil
 }
 
+// Make a single RPC call on the machine at address, over a connection from the pool
+func callMachine(address, function string, args interface{}, reply interface{}) error {
+	return callMachineContext(context.Background(), address, function, args, reply)
+}
+
+// Make the call, giving up when the context is done. The error the handler put in the reply is returned
+func callMachineContext(ctx context.Context, address, function string, args interface{}, reply interface{}) error {
+	if err := callError(function, address, connections.Call(ctx, address, function, args, reply)); err != nil {
+		return err
+	}
+	if carrier, ok := reply.(errorReply); ok {
+		return carrier.replyError()
+	}
+	return nil
+}
+
+// For programs that talk to the ring without being part of it: errors come back as the ones in errors.go
+func Call(address, function string, args interface{}, reply interface{}) error {
+	return callMachine(address, function, args, reply)
+}
+
+func CallContext(ctx context.Context, address, function string, args interface{}, reply interface{}) error {
+	return callMachineContext(ctx, address, function, args, reply)
+}
+
+// Call and wait for the answer until the context is done, no longer than rpcTimeout if it has no deadline and isn't bulk
+func callTimeout(ctx context.Context, client *rpc.Client, function string, args interface{}, reply interface{}) error {
+	if _, ok := ctx.Deadline(); !ok && !bulkCalls[function] {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rpcTimeout)
+		defer cancel()
+	}
+	//The answer may still come after we stopped waiting, it is read into a reply of its own and dropped
+	answer := reflect.New(reflect.TypeOf(reply).Elem())
+	call := client.Go(function, args, answer.Interface(), make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		reflect.ValueOf(reply).Elem().Set(answer.Elem())
+		return call.Error
+	case <-ctx.Done():
+		return contextError(ctx.Err())
+	}
+}
+
 // Utility bool-to-int conversion
 func Btoi(b bool) int {
 	if b {
@@ -0,0 +1,71 @@
+package ring
+
+import (
+	"../data"
+	"fmt"
+	"net"
+	"time"
+)
+
+/*
+  Garbage collection of tombstones. A removed key keeps its tombstone for a
+  grace period so that late writes and replicas that missed the remove can't
+  bring it back. After that it is dropped, but only once every replica of the
+  key holds a tombstone too, or nothing at all. Replicas still holding a value
+  the remove replaced are sent the tombstone and asked again next round.
+*/
+
+const (
+	tombstoneInterval = 10 * time.Second
+
+	//Hints older than this are dropped, so no write from before the remove can show up after it
+	defaultTombstoneGrace = hintExpiry
+)
+
+func (self *Ring) TombstoneCollection(interval time.Duration) {
+	for self.Active {
+		time.Sleep(interval)
+		self.collectTombstones()
+	}
+}
+
+func (self *Ring) collectTombstones() {
+	purged := 0
+	grace := self.settings().TombstoneGrace
+	for _, item := range self.localData() {
+		if !item.IsDeleted() || time.Since(item.DeletedSince()) < grace {
+			continue
+		}
+		if self.tombstoneAcknowledged(&item) && self.purgeLocal(&item) {
+			purged++
+		}
+	}
+	if purged > 0 {
+		fmt.Println("Purged", purged, "tombstones")
+	}
+}
+
+/*
+  Whether every other replica of the key has the tombstone or has forgotten the
+  key already. Collection runs in the background for nobody in particular, so
+  there is no context, every call is bounded by rpcTimeout.
+*/
+func (self *Ring) tombstoneAcknowledged(tombstone *data.DataStore) bool {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	acknowledged := true
+	for _, member := range self.preferenceList(tombstone.Key, self.replicasFor(tombstone.Key)) {
+		if member.Address == myAddr {
+			continue
+		}
+		var result RpcResult
+		err := callMachine(member.Address, "Ring.ReadData", data.NewDataStore(tombstone.Key, nil), &result)
+		if err != nil {
+			return false
+		}
+		if result.Success == 1 && !result.Data.IsDeleted() {
+			callMachine(member.Address, "Ring.WriteData", tombstone, &result)
+			acknowledged = false
+		}
+	}
+	return acknowledged
+}
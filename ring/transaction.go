@@ -0,0 +1,664 @@
+package ring
+
+import (
+	"../data"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+  Transactions: writes to several keys that all take effect or none does,
+  whichever machines coordinate the keys. The machine running the commit is
+  the transaction's coordinator and uses two-phase commit.
+
+  First the coordinators of the keys, the participants, are asked to prepare
+  their part. A participant locks its keys, so nothing else writes them until
+  the transaction is decided, checks the writes' conditions and records that it
+  prepared. Once every participant prepared, the coordinator records the
+  decision to commit, and from then on the transaction commits: participants
+  apply the writes, replicate them and unlock the keys. If any participant
+  can't prepare, the others are told to abort instead.
+
+  Only commits are recorded. A transaction the coordinator has no record of
+  and isn't running aborted, and can't start any more once it was said to
+  have. Outcomes are kept a while after every participant heard of them, for
+  callers that lost the answer and ask. A participant that prepared and heard nothing
+  for a while, or came back from a crash with a prepared transaction, asks
+  the coordinator how it ended. A coordinator that comes back with a commit
+  not every participant heard of tells them again.
+*/
+
+const (
+	TxnPending = iota
+	TxnCommitted
+	TxnAborted
+)
+
+const (
+	//How often in-doubt transactions and undelivered commits are looked at
+	txnRecoveryInterval = 5 * time.Second
+
+	//How long a participant waits for the decision before asking for it
+	txnInDoubtAfter = 10 * time.Second
+
+	//How long the outcome of a transaction is kept once everyone heard of it
+	txnForgetAfter = 10 * time.Minute
+)
+
+type Transaction struct {
+	Id     string
+	Writes []TxnWrite
+}
+
+// One write of a transaction, only made if Condition holds when it is prepared
+type TxnWrite struct {
+	Item      data.DataStore
+	Condition *data.Condition
+}
+
+func NewTransaction() *Transaction {
+	var id [8]byte
+	rand.Read(id[:])
+	return &Transaction{Id: hex.EncodeToString(id[:])}
+}
+
+// Replace whatever the key holds
+func (self *Transaction) Put(key int, val []byte, meta data.Metadata) {
+	self.PutIf(key, val, meta, nil)
+}
+
+func (self *Transaction) PutIf(key int, val []byte, meta data.Metadata, condition *data.Condition) {
+	item := data.NewDataStore(key, val)
+	item.Meta = meta
+	self.Writes = append(self.Writes, TxnWrite{Item: *item, Condition: condition})
+}
+
+func (self *Transaction) Delete(key int) {
+	self.DeleteIf(key, nil)
+}
+
+func (self *Transaction) DeleteIf(key int, condition *data.Condition) {
+	item := data.NewDataStore(key, nil)
+	item.Deleted = true
+	self.Writes = append(self.Writes, TxnWrite{Item: *item, Condition: condition})
+}
+
+type TxnRequest struct {
+	Transaction Transaction
+	Consistency int
+	Caller      string
+	Timeout     time.Duration
+}
+
+// What a participant is asked to prepare, and what it records once it did
+type TxnPrepare struct {
+	Id          string
+	Coordinator string
+	Writes      []TxnWrite
+	Consistency int
+	Caller      string
+	Prepared    time.Time
+}
+
+type TxnVote struct {
+	//Set when the machine doesn't coordinate one of the keys, this one does
+	Member *data.GroupMember
+
+	Error *RpcError
+}
+
+func (self *TxnVote) replyError() error {
+	return self.Error.Unpack()
+}
+
+type TxnResult struct {
+	Committed bool
+	Error     *RpcError
+}
+
+func (self *TxnResult) replyError() error {
+	return self.Error.Unpack()
+}
+
+// What the coordinator records once it decided to commit
+type TxnDecision struct {
+	Id           string
+	Participants []string
+	Decided      time.Time
+
+	//Every participant committed, we only keep it for anyone asking
+	Delivered bool
+}
+
+/*
+  What the machine knows of transactions, as coordinator and as participant.
+  The key locks are guarded by the ring's dataLock, so a write can check them
+  and go ahead without anything in between.
+*/
+type txnState struct {
+	locks    map[int]string
+	prepared map[string]*TxnPrepare
+	running  map[string]bool
+	decided  map[string]*TxnDecision
+	aborted  map[string]time.Time
+	records  *txnRecords
+	lock     sync.Mutex
+}
+
+func newTxnState() *txnState {
+	return &txnState{
+		locks:    make(map[int]string),
+		prepared: make(map[string]*TxnPrepare),
+		running:  make(map[string]bool),
+		decided:  make(map[string]*TxnDecision),
+		aborted:  make(map[string]time.Time),
+		records:  &txnRecords{},
+	}
+}
+
+// Whether a transaction holds the key. Expects the ring's dataLock to be held
+func (self *txnState) lockedLocal(key int) bool {
+	_, locked := self.locks[key]
+	return locked
+}
+
+/*
+  Committing
+*/
+
+func (self *Ring) Commit(txn *Transaction, consistency int) error {
+	return self.CommitContext(context.Background(), txn, consistency)
+}
+
+/*
+  Run the transaction with us as its coordinator. Once it is decided to commit
+  it does, even if ctx is done before every participant heard of it.
+*/
+func (self *Ring) CommitContext(ctx context.Context, txn *Transaction, consistency int) error {
+	if err := self.runTransaction(ctx, txn, consistency, net.JoinHostPort(self.Address, self.Port)); err != nil {
+		return NewOpError("commit", txn.Writes[0].Item.Key, "", err)
+	}
+	return nil
+}
+
+/*
+  Exposed over RPC: run the transaction with this machine as its coordinator,
+  for clients that aren't part of the ring
+*/
+func (self *Ring) CommitTransaction(request *TxnRequest, result *TxnResult) error {
+	ctx, cancel := requestContext(request.Timeout)
+	defer cancel()
+	err := self.runTransaction(ctx, &request.Transaction, request.Consistency, request.Caller)
+	result.Committed = err == nil
+	result.Error = NewRpcError(err)
+	return nil
+}
+
+func (self *Ring) runTransaction(ctx context.Context, txn *Transaction, consistency int, caller string) (err error) {
+	if len(txn.Writes) == 0 {
+		return nil
+	}
+	if consistency == -1 {
+		consistency = All
+	}
+	//Without a record of the commit a restart would presume it aborted
+	if !self.txns.records.durable() {
+		fmt.Println("Refusing transaction", txn.Id, "without a data directory")
+		return &OpError{Err: ErrAborted, Cause: ErrNoStorage}
+	}
+	//A caller that lost our answer may send it again
+	self.txns.lock.Lock()
+	_, aborted := self.txns.aborted[txn.Id]
+	switch {
+	case self.txns.decided[txn.Id] != nil:
+		self.txns.lock.Unlock()
+		return nil
+	case aborted:
+		self.txns.lock.Unlock()
+		return &OpError{Err: ErrAborted}
+	case self.txns.running[txn.Id]:
+		self.txns.lock.Unlock()
+		return ErrUnknownOutcome
+	}
+	self.txns.running[txn.Id] = true
+	self.txns.lock.Unlock()
+	defer func() {
+		self.txns.lock.Lock()
+		delete(self.txns.running, txn.Id)
+		if err != nil {
+			self.txns.aborted[txn.Id] = time.Now()
+		}
+		self.txns.lock.Unlock()
+	}()
+
+	for redirects := 0; redirects <= maxRedirects; redirects++ {
+		participants := self.groupByCoordinator(txn.Writes)
+		addresses := make([]string, 0, len(participants))
+		for address := range participants {
+			addresses = append(addresses, address)
+		}
+		sort.Strings(addresses)
+
+		redirected, err := self.prepareAll(ctx, txn.Id, participants, consistency, caller)
+		if err == nil && !redirected {
+			decision := &TxnDecision{Id: txn.Id, Participants: addresses, Decided: time.Now()}
+			if err = self.decideCommit(decision); err == nil {
+				self.deliverCommit(ctx, decision)
+				return nil
+			}
+		}
+		self.abortAll(txn.Id, addresses)
+		if err != nil {
+			return &OpError{Err: ErrAborted, Cause: err}
+		}
+		//We sent some of the keys to the wrong machine and learned better, try again
+	}
+	return &OpError{Err: ErrAborted, Cause: ErrRedirectLoop}
+}
+
+// The writes each machine coordinates
+func (self *Ring) groupByCoordinator(writes []TxnWrite) map[string][]TxnWrite {
+	participants := make(map[string][]TxnWrite)
+	for _, write := range writes {
+		address := self.getMachineForKey(write.Item.Key).Value
+		participants[address] = append(participants[address], write)
+	}
+	return participants
+}
+
+/*
+  Ask every participant to prepare at once. Returns whether one of them
+  doesn't coordinate a key it was sent, or why one couldn't prepare.
+*/
+func (self *Ring) prepareAll(ctx context.Context, id string, participants map[string][]TxnWrite, consistency int, caller string) (bool, error) {
+	type vote struct {
+		address string
+		vote    TxnVote
+		err     error
+	}
+	votes := make(chan vote, len(participants))
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	for address, writes := range participants {
+		request := &TxnPrepare{Id: id, Coordinator: myAddr, Writes: writes, Consistency: consistency, Caller: caller}
+		go func(address string) {
+			var result TxnVote
+			err := callMachineContext(ctx, address, "Ring.TxnPrepare", request, &result)
+			votes <- vote{address, result, err}
+		}(address)
+	}
+
+	redirected := false
+	var failed error
+	for range participants {
+		vote := <-votes
+		if vote.err != nil && failed == nil {
+			//The participant says which key it couldn't prepare if it got that far
+			var opErr *OpError
+			if errors.As(vote.err, &opErr) && opErr.Op != "" {
+				if opErr.Address == "" {
+					opErr.Address = vote.address
+				}
+				failed = opErr
+			} else {
+				failed = NewOpError("prepare", participants[vote.address][0].Item.Key, vote.address, vote.err)
+			}
+		}
+		if vote.vote.Member != nil {
+			self.updateMember(vote.vote.Member)
+			redirected = true
+		}
+	}
+	return redirected, failed
+}
+
+// Record the commit before anyone hears of it, a crash afterwards can't undo it
+func (self *Ring) decideCommit(decision *TxnDecision) error {
+	self.txns.lock.Lock()
+	defer self.txns.lock.Unlock()
+	if err := self.txns.records.save(decision.Id+".committed", decision); err != nil {
+		fmt.Println("Could not record the commit of", decision.Id, err)
+		return err
+	}
+	self.txns.decided[decision.Id] = decision
+	return nil
+}
+
+/*
+  Tell the participants to commit, the decision is only kept for anyone asking
+  once all of them did. Participants we couldn't tell before the context was
+  done are told by the recovery.
+*/
+func (self *Ring) deliverCommit(ctx context.Context, decision *TxnDecision) {
+	delivered := true
+	for _, address := range decision.Participants {
+		var done bool
+		if err := callMachineContext(ctx, address, "Ring.TxnCommit", decision.Id, &done); err != nil {
+			fmt.Println("Could not tell", address, "to commit", decision.Id, err)
+			delivered = false
+		}
+	}
+	if !delivered {
+		return
+	}
+	self.txns.lock.Lock()
+	defer self.txns.lock.Unlock()
+	decision.Delivered = true
+}
+
+// Detached from the caller's context, the sooner the participants let go of the keys the better
+func (self *Ring) abortAll(id string, addresses []string) {
+	for _, address := range addresses {
+		var done bool
+		if err := callMachine(address, "Ring.TxnAbort", id, &done); err != nil {
+			//It finds out when it asks how the transaction ended
+			fmt.Println("Could not tell", address, "to abort", id, err)
+		}
+	}
+}
+
+/*
+  Exposed over RPC: how a transaction we coordinate ended. One we neither run
+  nor have a commit for aborted, and won't be run if it arrives after all.
+*/
+func (self *Ring) TxnStatus(id string, status *int) error {
+	self.txns.lock.Lock()
+	defer self.txns.lock.Unlock()
+	if self.txns.decided[id] != nil {
+		*status = TxnCommitted
+	} else if self.txns.running[id] {
+		*status = TxnPending
+	} else {
+		*status = TxnAborted
+		if _, found := self.txns.aborted[id]; !found {
+			self.txns.aborted[id] = time.Now()
+		}
+	}
+	return nil
+}
+
+/*
+  Participating
+*/
+
+/*
+  Exposed over RPC: lock the keys and check the conditions of our part of a
+  transaction, recording that we did before saying yes. Fails if another
+  transaction holds one of the keys or a condition doesn't hold.
+*/
+func (self *Ring) TxnPrepare(request *TxnPrepare, vote *TxnVote) (err error) {
+	defer func() {
+		vote.Error = NewRpcError(err)
+		err = nil
+	}()
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	for _, write := range request.Writes {
+		if machineAddr := self.getMachineForKey(write.Item.Key).Value; machineAddr != myAddr {
+			vote.Member = self.getMember(machineAddr)
+			if vote.Member == nil {
+				return ErrUnavailable
+			}
+			return nil
+		}
+	}
+
+	//Check conditions against what the replicas hold, not just our own copy
+	if request.Consistency != One {
+		ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+		defer cancel()
+		for _, write := range request.Writes {
+			if write.Condition == nil {
+				continue
+			}
+			merged, found, answered, needed := self.readFromReplicas(ctx, write.Item.Key, copiesNeeded(request.Consistency, self.replicasFor(write.Item.Key)))
+			if answered < needed {
+				return NewOpError("prepare", write.Item.Key, "", progressError(ctx, answered, needed, "replicas answered"))
+			}
+			if found {
+				self.mergeLocal(&merged)
+			}
+		}
+	}
+
+	self.dataLock.Lock()
+	for _, write := range request.Writes {
+		key := write.Item.Key
+		if holder, locked := self.txns.locks[key]; locked && holder != request.Id {
+			self.dataLock.Unlock()
+			return NewOpError("prepare", key, "", ErrLocked)
+		}
+		existing, found := self.get(key)
+		if write.Condition != nil && !write.Condition.Holds(&existing, found) {
+			self.dataLock.Unlock()
+			return NewOpError("prepare", key, "", ErrConditionFailed)
+		}
+	}
+	for _, write := range request.Writes {
+		self.txns.locks[write.Item.Key] = request.Id
+	}
+	self.dataLock.Unlock()
+
+	request.Prepared = time.Now()
+	self.txns.lock.Lock()
+	err = self.txns.records.save(request.Id+".prepared", request)
+	if err == nil {
+		self.txns.prepared[request.Id] = request
+	}
+	self.txns.lock.Unlock()
+	if err != nil {
+		fmt.Println("Could not record that", request.Id, "prepared", err)
+		self.unlockKeys(request)
+		return err
+	}
+	return nil
+}
+
+/*
+  Exposed over RPC: apply our part of a transaction and unlock its keys. We
+  say we did only once it no longer shows up as prepared after a crash.
+*/
+func (self *Ring) TxnCommit(id string, done *bool) error {
+	prepared := self.takePrepared(id)
+	if prepared == nil {
+		//Committed already
+		*done = true
+		return nil
+	}
+
+	stored := make([]data.DataStore, 0, len(prepared.Writes))
+	self.dataLock.Lock()
+	for i := range prepared.Writes {
+		existing, found := self.get(prepared.Writes[i].Item.Key)
+		stored = append(stored, self.replaceLocal(&prepared.Writes[i].Item, &existing, found))
+	}
+	for _, write := range prepared.Writes {
+		delete(self.txns.locks, write.Item.Key)
+	}
+	self.dataLock.Unlock()
+
+	self.txns.lock.Lock()
+	self.txns.records.remove(id + ".prepared")
+	self.txns.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	for i := range stored {
+		response := &RpcResult{Data: stored[i]}
+		var err error
+		if response.Success, err = self.replicate(ctx, &stored[i], prepared.Consistency); err != nil {
+			//Hinted handoff gets it there
+			fmt.Println("Transaction", id, "key", stored[i].Key, err)
+		}
+		op := UpdateOp
+		if prepared.Writes[i].Item.Deleted {
+			op = RemoveOp
+		}
+		self.logWrite(op, &prepared.Writes[i].Item, prepared.Consistency, prepared.Caller, response)
+	}
+	*done = true
+	return nil
+}
+
+/*
+  Exposed over RPC: forget our part of a transaction and unlock its keys
+*/
+func (self *Ring) TxnAbort(id string, done *bool) error {
+	if prepared := self.takePrepared(id); prepared != nil {
+		self.unlockKeys(prepared)
+		self.txns.lock.Lock()
+		self.txns.records.remove(id + ".prepared")
+		self.txns.lock.Unlock()
+	}
+	*done = true
+	return nil
+}
+
+// The prepared transaction, which nobody else gets to commit or abort now
+func (self *Ring) takePrepared(id string) *TxnPrepare {
+	self.txns.lock.Lock()
+	defer self.txns.lock.Unlock()
+	prepared := self.txns.prepared[id]
+	delete(self.txns.prepared, id)
+	return prepared
+}
+
+func (self *Ring) unlockKeys(prepared *TxnPrepare) {
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+	for _, write := range prepared.Writes {
+		if self.txns.locks[write.Item.Key] == prepared.Id {
+			delete(self.txns.locks, write.Item.Key)
+		}
+	}
+}
+
+/*
+  Recovery
+*/
+
+func (self *Ring) TransactionRecovery(interval time.Duration) {
+	for self.Active {
+		time.Sleep(interval)
+		self.resolveInDoubt()
+		self.redeliverCommits()
+		self.forgetEnded()
+	}
+}
+
+// Ask the coordinators of transactions we prepared a while ago how they ended
+func (self *Ring) resolveInDoubt() {
+	self.txns.lock.Lock()
+	inDoubt := make([]*TxnPrepare, 0)
+	for _, prepared := range self.txns.prepared {
+		if time.Since(prepared.Prepared) > txnInDoubtAfter {
+			inDoubt = append(inDoubt, prepared)
+		}
+	}
+	self.txns.lock.Unlock()
+
+	for _, prepared := range inDoubt {
+		var status int
+		if err := callMachine(prepared.Coordinator, "Ring.TxnStatus", prepared.Id, &status); err != nil {
+			fmt.Println("Transaction", prepared.Id, "in doubt, coordinator", prepared.Coordinator, "unreachable")
+			continue
+		}
+		var done bool
+		switch status {
+		case TxnCommitted:
+			fmt.Println("Transaction", prepared.Id, "committed while we waited")
+			self.TxnCommit(prepared.Id, &done)
+		case TxnAborted:
+			fmt.Println("Transaction", prepared.Id, "aborted while we waited")
+			self.TxnAbort(prepared.Id, &done)
+		}
+	}
+}
+
+// Commits some participants haven't heard of, because they were down or we crashed
+func (self *Ring) redeliverCommits() {
+	self.txns.lock.Lock()
+	undelivered := make([]*TxnDecision, 0)
+	for _, decision := range self.txns.decided {
+		if !decision.Delivered && time.Since(decision.Decided) > txnRecoveryInterval {
+			undelivered = append(undelivered, decision)
+		}
+	}
+	self.txns.lock.Unlock()
+
+	for _, decision := range undelivered {
+		self.deliverCommit(context.Background(), decision)
+	}
+}
+
+// Outcomes old enough that nobody asks for them any more
+func (self *Ring) forgetEnded() {
+	self.txns.lock.Lock()
+	defer self.txns.lock.Unlock()
+	for id, decision := range self.txns.decided {
+		if decision.Delivered && time.Since(decision.Decided) > txnForgetAfter {
+			delete(self.txns.decided, id)
+			self.txns.records.remove(id + ".committed")
+		}
+	}
+	for id, ended := range self.txns.aborted {
+		if time.Since(ended) > txnForgetAfter {
+			delete(self.txns.aborted, id)
+		}
+	}
+}
+
+// Take back the locks and decisions we had before a crash. Has to happen before we join the ring
+func (self *Ring) openTransactions(dir string) error {
+	records, err := openTxnRecords(dir)
+	if err != nil {
+		return err
+	}
+	prepared, decided, err := records.load()
+	if err != nil {
+		return err
+	}
+
+	self.txns.lock.Lock()
+	defer self.txns.lock.Unlock()
+	self.txns.records = records
+	for _, request := range prepared {
+		self.txns.prepared[request.Id] = request
+		for _, write := range request.Writes {
+			self.txns.locks[write.Item.Key] = request.Id
+		}
+	}
+	for _, decision := range decided {
+		self.txns.decided[decision.Id] = decision
+	}
+	if len(prepared) > 0 || len(decided) > 0 {
+		fmt.Println("Recovered", len(prepared), "in-doubt transactions and", len(decided), "undelivered commits")
+	}
+	return nil
+}
+
+func (self *Ring) PrintTransactions() {
+	self.txns.lock.Lock()
+	defer self.txns.lock.Unlock()
+	undelivered := make([]*TxnDecision, 0)
+	for _, decision := range self.txns.decided {
+		if !decision.Delivered {
+			undelivered = append(undelivered, decision)
+		}
+	}
+	if len(self.txns.prepared) == 0 && len(undelivered) == 0 {
+		return
+	}
+	fmt.Println("Transactions:")
+	for id, prepared := range self.txns.prepared {
+		fmt.Println(" ", id, "prepared", len(prepared.Writes), "keys for", prepared.Coordinator, "at", prepared.Prepared.Format(time.RFC3339))
+	}
+	for _, decision := range undelivered {
+		fmt.Println(" ", decision.Id, "committed, telling", decision.Participants)
+	}
+}
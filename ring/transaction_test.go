@@ -0,0 +1,177 @@
+package ring
+
+import (
+	"../data"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A ring with nothing but transaction state, its records kept in dir if there is one
+func testTxnRing(t *testing.T, dir string) *Ring {
+	ring := &Ring{txns: newTxnState()}
+	if dir != "" {
+		if err := ring.openTransactions(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ring
+}
+
+func testTxn(id string, keys ...int) *Transaction {
+	txn := &Transaction{Id: id}
+	for _, key := range keys {
+		txn.Put(key, []byte("value"), data.Metadata{})
+	}
+	return txn
+}
+
+func TestTxnRecordsRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	records, err := openTxnRecords(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepare := &TxnPrepare{Id: "a", Coordinator: "127.0.0.1:5555", Writes: testTxn("a", 1, 2).Writes, Consistency: Quorum, Caller: "client"}
+	decision := &TxnDecision{Id: "b", Participants: []string{"127.0.0.1:5556", "127.0.0.1:5557"}}
+	if err := records.save("a.prepared", prepare); err != nil {
+		t.Fatal(err)
+	}
+	if err := records.save("b.committed", decision); err != nil {
+		t.Fatal(err)
+	}
+	//Left behind by a crash before the rename
+	if err := os.WriteFile(filepath.Join(dir, "c.committed.tmp"), []byte("torn"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	prepared, decided, err := records.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prepared) != 1 || prepared[0].Id != "a" || !reflect.DeepEqual(prepared[0].Writes, prepare.Writes) {
+		t.Errorf("prepared came back as %+v", prepared)
+	}
+	if len(decided) != 1 || !reflect.DeepEqual(decided[0], decision) {
+		t.Errorf("decided came back as %+v", decided)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c.committed.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary record still there: %v", err)
+	}
+
+	records.remove("a.prepared")
+	if prepared, _, _ = records.load(); len(prepared) != 0 {
+		t.Errorf("removed record came back as %+v", prepared)
+	}
+}
+
+func TestTxnRecordsWithoutStorage(t *testing.T) {
+	records := &txnRecords{}
+	if records.durable() {
+		t.Error("records without a directory say they are durable")
+	}
+	if err := records.save("a.committed", &TxnDecision{Id: "a"}); err != ErrNoStorage {
+		t.Errorf("save without a directory: %v", err)
+	}
+}
+
+func TestOpenTransactions(t *testing.T) {
+	dir := t.TempDir()
+	ring := testTxnRing(t, dir)
+	prepare := &TxnPrepare{Id: "a", Writes: testTxn("a", 3, 7).Writes}
+	if err := ring.txns.records.save("a.prepared", prepare); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.decideCommit(&TxnDecision{Id: "b", Participants: []string{"127.0.0.1:5556"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	//What a restart finds
+	restarted := testTxnRing(t, dir)
+	if restarted.txns.prepared["a"] == nil {
+		t.Error("prepared transaction lost in the restart")
+	}
+	for _, key := range []int{3, 7} {
+		if restarted.txns.locks[key] != "a" {
+			t.Errorf("key %d is locked by %q after the restart", key, restarted.txns.locks[key])
+		}
+	}
+	if restarted.txns.decided["b"] == nil {
+		t.Error("commit decision lost in the restart")
+	}
+}
+
+var txnStatuses = map[string]int{
+	"committed": TxnCommitted,
+	"running":   TxnPending,
+	"aborted":   TxnAborted,
+	//Never heard of it, it can't commit anymore
+	"unknown": TxnAborted,
+}
+
+func TestTxnStatus(t *testing.T) {
+	ring := testTxnRing(t, t.TempDir())
+	if err := ring.decideCommit(&TxnDecision{Id: "committed"}); err != nil {
+		t.Fatal(err)
+	}
+	ring.txns.running["running"] = true
+	ring.txns.aborted["aborted"] = time.Now()
+
+	for id, want := range txnStatuses {
+		var status int
+		if err := ring.TxnStatus(id, &status); err != nil {
+			t.Fatal(err)
+		}
+		if status != want {
+			t.Errorf("%s: status %d, want %d", id, status, want)
+		}
+	}
+	if _, found := ring.txns.aborted["unknown"]; !found {
+		t.Error("a transaction we said aborted isn't remembered as aborted")
+	}
+}
+
+// Transactions decided before they get anywhere near the network
+var decidedCases = []struct {
+	name  string
+	dir   bool
+	setup func(ring *Ring)
+	txn   *Transaction
+	want  error
+}{
+	{name: "empty", txn: testTxn("a")},
+	{name: "no storage", txn: testTxn("a", 1), want: ErrAborted},
+	{name: "committed", dir: true, txn: testTxn("a", 1),
+		setup: func(ring *Ring) { ring.decideCommit(&TxnDecision{Id: "a"}) }},
+	{name: "aborted", dir: true, txn: testTxn("a", 1), want: ErrAborted,
+		setup: func(ring *Ring) { ring.txns.aborted["a"] = time.Now() }},
+	{name: "running", dir: true, txn: testTxn("a", 1), want: ErrUnknownOutcome,
+		setup: func(ring *Ring) { ring.txns.running["a"] = true }},
+}
+
+func TestRunTransactionDecided(t *testing.T) {
+	for _, c := range decidedCases {
+		dir := ""
+		if c.dir {
+			dir = t.TempDir()
+		}
+		ring := testTxnRing(t, dir)
+		if c.setup != nil {
+			c.setup(ring)
+		}
+		if err := ring.runTransaction(context.Background(), c.txn, All, "client"); !errors.Is(err, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+	}
+
+	//Refused for want of a record, and the caller is told why
+	var opErr *OpError
+	err := testTxnRing(t, "").runTransaction(context.Background(), testTxn("a", 1), All, "client")
+	if !errors.As(err, &opErr) || opErr.Cause != ErrNoStorage {
+		t.Errorf("without storage: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+  Durable records of transactions, one file each in the txn directory next to
+  the data: ID.prepared for what we prepared as a participant, ID.committed
+  for a commit we decided as coordinator. A record is written to a temporary
+  file, synced and renamed into place, so after a crash it is either all there
+  or not there at all. Without a data directory there is nowhere to keep them,
+  and a transaction can't be committed or prepared: a coordinator that forgot
+  its commit in a restart would tell the participants still waiting to abort.
+*/
+
+type txnRecords struct {
+	dir string
+}
+
+func openTxnRecords(dir string) (*txnRecords, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &txnRecords{dir: dir}, nil
+}
+
+func (self *txnRecords) save(name string, record interface{}) error {
+	if self.dir == "" {
+		return ErrNoStorage
+	}
+	var encoded bytes.Buffer
+	if err := gob.NewEncoder(&encoded).Encode(record); err != nil {
+		return err
+	}
+	temp := filepath.Join(self.dir, name+".tmp")
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(encoded.Bytes()); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	if err := os.Rename(temp, filepath.Join(self.dir, name)); err != nil {
+		return err
+	}
+	return self.syncDir()
+}
+
+// Whether the records outlive a restart
+func (self *txnRecords) durable() bool {
+	return self.dir != ""
+}
+
+func (self *txnRecords) remove(name string) {
+	if self.dir == "" {
+		return
+	}
+	os.Remove(filepath.Join(self.dir, name))
+	self.syncDir()
+}
+
+// Make the renames and removes in the directory stick
+func (self *txnRecords) syncDir() error {
+	dir, err := os.Open(self.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Every record there is. Temporary files were never renamed into place, the crash came first
+func (self *txnRecords) load() ([]*TxnPrepare, []*TxnDecision, error) {
+	prepared := make([]*TxnPrepare, 0)
+	decided := make([]*TxnDecision, 0)
+	files, err := os.ReadDir(self.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range files {
+		path := filepath.Join(self.dir, file.Name())
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		decoder := gob.NewDecoder(bytes.NewReader(contents))
+		switch {
+		case strings.HasSuffix(file.Name(), ".prepared"):
+			record := new(TxnPrepare)
+			if err := decoder.Decode(record); err != nil {
+				return nil, nil, err
+			}
+			prepared = append(prepared, record)
+		case strings.HasSuffix(file.Name(), ".committed"):
+			record := new(TxnDecision)
+			if err := decoder.Decode(record); err != nil {
+				return nil, nil, err
+			}
+			decided = append(decided, record)
+		case strings.HasSuffix(file.Name(), ".tmp"):
+			os.Remove(path)
+		}
+	}
+	return prepared, decided, nil
+}
@@ -0,0 +1,160 @@
+package ring
+
+import (
+	"../data"
+	"fmt"
+	"net"
+)
+
+/*
+  Every machine takes Config.VirtualNodes positions (tokens) on the ring so that
+  the key space is split evenly even with a handful of machines. The first token
+  is the member's Id, which is gossiped and moves while joining or leaving. The
+  others are derived from the member's address, so every machine can work them
+  out on its own.
+*/
+
+// The positions taken by the member besides its Id
+func (self *Ring) virtualTokens(member *data.GroupMember) []int {
+	virtualNodes := self.settings().VirtualNodes
+	tokens := make([]int, 0, virtualNodes)
+	for i := 1; i < virtualNodes; i++ {
+		tokens = append(tokens, self.Hash(fmt.Sprintf("%s#%d", member.Address, i)))
+	}
+	return tokens
+}
+
+// All the positions taken by the member
+func (self *Ring) tokensOf(member *data.GroupMember) []int {
+	if member == nil || member.Id < 0 {
+		return []int{}
+	}
+	return append([]int{member.Id}, self.virtualTokens(member)...)
+}
+
+func (self *Ring) myTokens() []int {
+	return self.tokensOf(self.getMember(net.JoinHostPort(self.Address, self.Port)))
+}
+
+// Take a position for the machine at address unless someone is already there
+func (self *Ring) insertLocation(key int, address string) bool {
+	if self.UserKeyTable.Get(data.LocationStore{key, ""}) != nil {
+		fmt.Println("ERROR: Two members with same key")
+		return false
+	}
+	return self.UserKeyTable.Insert(data.LocationStore{key, address})
+}
+
+// Give up a position, only if it is actually held by the machine at address
+func (self *Ring) deleteLocation(key int, address string) bool {
+	found := self.UserKeyTable.Get(data.LocationStore{key, ""})
+	if found == nil || found.(data.LocationStore).Value != address {
+		return false
+	}
+	return self.UserKeyTable.DeleteWithKey(data.LocationStore{key, ""})
+}
+
+func (self *Ring) insertVirtualTokens(member *data.GroupMember) {
+	for _, token := range self.virtualTokens(member) {
+		self.insertLocation(token, member.Address)
+	}
+}
+
+func (self *Ring) deleteVirtualTokens(member *data.GroupMember) {
+	for _, token := range self.virtualTokens(member) {
+		self.deleteLocation(token, member.Address)
+	}
+}
+
+/*
+  The first n distinct machines found walking clockwise from key. The first one
+  owns the key and the rest hold its replicas.
+*/
+func (self *Ring) preferenceList(key, n int) []*data.GroupMember {
+	if self.getChord() != nil {
+		return self.chordPreferenceList(key, n)
+	}
+	members := make([]*data.GroupMember, 0, n)
+	seen := make(map[string]bool)
+
+	self.membersLock.RLock()
+	defer self.membersLock.RUnlock()
+	iter := self.UserKeyTable.FindGE(data.LocationStore{key, ""})
+	for i := 0; i < self.UserKeyTable.Len() && len(members) < n; i++ {
+		if iter.Limit() {
+			iter = self.UserKeyTable.Min()
+		}
+		address := iter.Item().(data.LocationStore).Value
+		if !seen[address] && self.Usertable[address] != nil {
+			seen[address] = true
+			members = append(members, self.memberCopy(address))
+		}
+		iter = iter.Next()
+	}
+	return members
+}
+
+// The machines other than us that hold copies of the key, at most n of them
+func (self *Ring) replicasForKey(key, n int) []*data.GroupMember {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	replicas := make([]*data.GroupMember, 0, n)
+	for _, member := range self.preferenceList(key, n+1) {
+		if member.Address != myAddr && len(replicas) < n {
+			replicas = append(replicas, member)
+		}
+	}
+	return replicas
+}
+
+// Whether we are in the key's preference list
+func (self *Ring) isReplicaFor(key int) bool {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	for _, member := range self.preferenceList(key, self.replicasFor(key)) {
+		if member.Address == myAddr {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the machine at address sits right before one of our tokens
+func (self *Ring) isPredecessor(address string) bool {
+	for _, token := range self.myTokens() {
+		if self.getPredecessor(token).Value == address {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+  The keys that end up on this machine because of the given token: the ones it
+  owns up to the token, plus the ones before that it holds as one of the
+  replicas. We walk back from the token until we've passed as many other
+  machines as the most replicated namespace has copies besides ours, or reach
+  another of our own tokens.
+*/
+func (self *Ring) replicatedRange(token int) *data.KeyRange {
+	myAddr := net.JoinHostPort(self.Address, self.Port)
+	maxReplicas := self.settings().maxReplicas()
+	seen := make(map[string]bool)
+
+	self.membersLock.RLock()
+	defer self.membersLock.RUnlock()
+	iter := self.UserKeyTable.FindLE(data.LocationStore{token, ""})
+	for i := 0; i < self.UserKeyTable.Len(); i++ {
+		iter = iter.Prev()
+		if iter.NegativeLimit() {
+			iter = self.UserKeyTable.Max()
+		}
+		location := iter.Item().(data.LocationStore)
+		if location.Value == myAddr {
+			return data.NewKeyRange(location.Key, token)
+		}
+		seen[location.Value] = true
+		if len(seen) >= maxReplicas {
+			return data.NewKeyRange(location.Key, token)
+		}
+	}
+	return data.NewKeyRange(token, token)
+}
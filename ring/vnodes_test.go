@@ -0,0 +1,109 @@
+package ring
+
+import (
+	"../data"
+	"../rbtree"
+	"fmt"
+	"testing"
+)
+
+// A ring seen from b:1, with a:1, b:1 and c:1 at 10, 20 and 30
+func testMembersRing(t *testing.T, virtualNodes, replicas int) *Ring {
+	ring := &Ring{
+		Usertable: make(map[string]*data.GroupMember),
+		UserKeyTable: rbtree.NewTree(func(a, b rbtree.Item) int {
+			return data.CompareKeys(a.(data.LocationStore).Key, b.(data.LocationStore).Key)
+		}),
+		Address: "b",
+		Port:    "1",
+	}
+	config := DefaultConfig()
+	config.VirtualNodes = virtualNodes
+	config.Replicas = replicas
+	if err := ring.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	for i, address := range []string{"a:1", "b:1", "c:1"} {
+		ring.updateMember(data.NewGroupMember(10*(i+1), address, 0, Stable))
+	}
+	return ring
+}
+
+func addresses(members []*data.GroupMember) string {
+	addresses := ""
+	for _, member := range members {
+		addresses += member.Address + " "
+	}
+	return addresses
+}
+
+var preferenceLists = []struct {
+	key  int
+	n    int
+	want string
+}{
+	{15, 2, "b:1 c:1 "},
+	{20, 2, "b:1 c:1 "},
+	{30, 1, "c:1 "},
+	{35, 3, "a:1 b:1 c:1 "},
+	{-5, 2, "a:1 b:1 "},
+	{5, 5, "a:1 b:1 c:1 "},
+}
+
+func TestPreferenceList(t *testing.T) {
+	ring := testMembersRing(t, 1, 3)
+	for _, test := range preferenceLists {
+		if got := addresses(ring.preferenceList(test.key, test.n)); got != test.want {
+			t.Errorf("key %d, %d machines: got %q, want %q", test.key, test.n, got, test.want)
+		}
+	}
+}
+
+// b:1 holds its own keys and, with more copies, those of the machines before it
+func TestReplicatedRange(t *testing.T) {
+	tests := []struct {
+		replicas int
+		want     data.KeyRange
+	}{
+		{1, data.KeyRange{Start: 10, End: 20}},
+		{2, data.KeyRange{Start: 30, End: 20}},
+		{3, data.KeyRange{Start: 20, End: 20}},
+	}
+	for _, test := range tests {
+		got := testMembersRing(t, 1, test.replicas).replicatedRange(20)
+		if *got != test.want {
+			t.Errorf("%d copies: got %+v, want %+v", test.replicas, *got, test.want)
+		}
+	}
+}
+
+// Every token of a machine leads to it, and walking from any key meets each machine once
+func TestVirtualNodes(t *testing.T) {
+	ring := testMembersRing(t, 4, 3)
+	for _, address := range []string{"a:1", "b:1", "c:1"} {
+		tokens := ring.tokensOf(ring.getMember(address))
+		if len(tokens) != 4 {
+			t.Errorf("%s has tokens %v, want 4 of them", address, tokens)
+		}
+		for _, token := range tokens {
+			if owner := ring.getMachineForKey(token).Value; owner != address {
+				t.Errorf("token %d of %s belongs to %s", token, address, owner)
+			}
+		}
+	}
+	if len(ring.myTokens()) != 4 {
+		t.Errorf("b:1 has tokens %v, want 4 of them", ring.myTokens())
+	}
+
+	for i := 0; i < 20; i++ {
+		key := ring.Hash(fmt.Sprint("key", i))
+		members := ring.preferenceList(key, 3)
+		if len(members) != 3 || members[0].Address != ring.getMachineForKey(key).Value {
+			t.Errorf("key %d: got %q, owned by %s", key, addresses(members), ring.getMachineForKey(key).Value)
+			continue
+		}
+		if members[0].Address == members[1].Address || members[1].Address == members[2].Address || members[0].Address == members[2].Address {
+			t.Errorf("key %d: got %q, want three different machines", key, addresses(members))
+		}
+	}
+}
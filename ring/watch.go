@@ -0,0 +1,390 @@
+package ring
+
+import (
+	"../data"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+/*
+  Watching keys for changes. Every machine keeps the last changes it applied
+  as the coordinator of a key, numbered in the order it applied them. A
+  watcher long-polls each machine coordinating part of the range it watches
+  for the changes after the last one it got from that machine, and looks
+  again every few seconds who those machines are, so it follows the keys
+  when machines join or leave.
+
+  Each event comes with a cursor to resume from after it. A machine the cursor
+  knows nothing about sends the changes it applied since the watch started,
+  by its own clock. When a machine restarted or already dropped changes the
+  watcher hasn't seen, an EventMissed says so, the watcher should read the
+  range again.
+*/
+
+const (
+	EventInsert = iota
+	EventUpdate
+	EventDelete
+	EventMissed
+)
+
+const (
+	//Changes a machine keeps for watchers
+	maxWatchEvents = 4096
+
+	//How long a machine holds on to a poll with nothing to send
+	watchPollTimeout = 4 * time.Second
+
+	//How often the watcher looks who coordinates the range
+	watchRefreshInterval = 2 * time.Second
+
+	//How long to wait before asking a machine that didn't answer again
+	watchRetryInterval = 1 * time.Second
+
+	//More owners than this means the ring is broken, not large
+	maxRangeOwners = 4096
+)
+
+var eventNames = []string{"INSERT", "UPDATE", "DELETE", "MISSED"}
+
+type WatchEvent struct {
+	Type int
+	Key  int
+	Item data.DataStore
+	Time time.Time
+
+	//The machine that applied the change and where it is in its log
+	Member string
+	Seq    uint64
+
+	//Filled in by the watcher, resumes after this event
+	Cursor string
+}
+
+func (self WatchEvent) String() string {
+	if self.Type == EventMissed {
+		return eventNames[self.Type] + " changes on " + self.Member
+	}
+	return eventNames[self.Type] + " " + self.Item.String()
+}
+
+// Keys from Low up to but not including High, and what the watcher saw of each machine
+type WatchCursor struct {
+	Low       int
+	High      int
+	Since     time.Time
+	Positions map[string]WatchPosition
+}
+
+// The last change seen from a machine, Epoch tells its restarts apart
+type WatchPosition struct {
+	Epoch int64
+	Seq   uint64
+}
+
+func NewWatchCursor(low, high int) WatchCursor {
+	return WatchCursor{Low: low, High: high, Since: time.Now(), Positions: make(map[string]WatchPosition)}
+}
+
+func (self WatchCursor) Token() string {
+	encoded, _ := json.Marshal(self)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func ParseWatchToken(token string) (WatchCursor, error) {
+	var cursor WatchCursor
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, ErrInvalidToken
+	}
+	if err := json.Unmarshal(decoded, &cursor); err != nil {
+		return cursor, ErrInvalidToken
+	}
+	if cursor.Positions == nil {
+		cursor.Positions = make(map[string]WatchPosition)
+	}
+	return cursor, nil
+}
+
+type WatchRequest struct {
+	Low   int
+	High  int
+	Epoch int64
+	After uint64
+	Since time.Time
+
+	//How long to wait for a change
+	Timeout time.Duration
+}
+
+type WatchResult struct {
+	Events []WatchEvent
+	Epoch  int64
+	Next   uint64
+	Missed bool
+}
+
+/*
+  The changes a machine applied
+*/
+
+type watchLog struct {
+	epoch   int64
+	events  []WatchEvent
+	next    uint64
+	trimmed time.Time
+	changed chan struct{}
+	lock    sync.Mutex
+}
+
+func newWatchLog() *watchLog {
+	return &watchLog{epoch: time.Now().UnixNano(), next: 1, changed: make(chan struct{})}
+}
+
+func (self *watchLog) publish(eventType int, item data.DataStore) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.events = append(self.events, WatchEvent{Type: eventType, Key: item.Key, Item: item, Time: time.Now(), Seq: self.next})
+	self.next++
+	if len(self.events) > maxWatchEvents {
+		//Reslice past the oldest, append moves the rest to a new array once it runs out of room
+		self.trimmed = self.events[0].Time
+		self.events[0] = WatchEvent{}
+		self.events = self.events[1:]
+	}
+	//Wake every poll waiting for a change
+	close(self.changed)
+	self.changed = make(chan struct{})
+}
+
+// Fill in the changes the request hasn't seen, and return what to wait on if there are none
+func (self *watchLog) collect(request *WatchRequest, result *WatchResult) <-chan struct{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	result.Epoch = self.epoch
+	result.Next = self.next - 1
+	after := request.After
+	if request.Epoch != self.epoch {
+		//We restarted since the watcher last asked, or it never did
+		result.Missed = request.Epoch != 0 || !self.trimmed.Before(request.Since)
+		after = 0
+	} else if len(self.events) > 0 && after+1 < self.events[0].Seq {
+		result.Missed = true
+	}
+
+	for _, event := range self.events {
+		if event.Seq <= after || event.Key < request.Low || event.Key >= request.High {
+			continue
+		}
+		if request.Epoch != self.epoch && event.Time.Before(request.Since) {
+			continue
+		}
+		result.Events = append(result.Events, event)
+	}
+	return self.changed
+}
+
+// Which kind of change a write is, from whether the key was there before
+func eventFor(deleted bool, existed bool) int {
+	if deleted {
+		return EventDelete
+	}
+	if existed {
+		return EventUpdate
+	}
+	return EventInsert
+}
+
+/*
+  Exposed over RPC: the changes to the range after the request's position,
+  waiting for one if there are none yet
+*/
+func (self *Ring) WatchEvents(request *WatchRequest, result *WatchResult) error {
+	ctx, cancel := requestContext(request.Timeout)
+	defer cancel()
+	for {
+		*result = WatchResult{}
+		changed := self.watches.collect(request, result)
+		if len(result.Events) > 0 || result.Missed {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+/*
+  Exposed over RPC: the machines coordinating the range, for watchers that
+  aren't part of the ring
+*/
+func (self *Ring) WatchOwners(request *WatchRequest, owners *[]string) error {
+	*owners = self.rangeOwners(request.Low, request.High)
+	return nil
+}
+
+// The machines coordinating keys from low up to but not including high
+func (self *Ring) rangeOwners(low, high int) []string {
+	owners := make([]string, 0)
+	seen := make(map[string]bool)
+	key := low
+	for i := 0; i < maxRangeOwners && key < high; i++ {
+		owner := self.getMachineForKey(key)
+		if owner.Key == -1 {
+			break
+		}
+		if !seen[owner.Value] {
+			seen[owner.Value] = true
+			owners = append(owners, owner.Value)
+		}
+		//The owner covers every key up to its own, or to the end of the key space if it comes round
+		if owner.Key < key || owner.Key >= high-1 {
+			break
+		}
+		key = owner.Key + 1
+	}
+	return owners
+}
+
+/*
+  Watching
+*/
+
+// Changes to keys from low up to but not including high, from the token on if there is one. The channel is closed once ctx is done
+func (self *Ring) Watch(ctx context.Context, low, high int, token string) (<-chan WatchEvent, error) {
+	cursor := NewWatchCursor(low, high)
+	if token != "" {
+		var err error
+		if cursor, err = ParseWatchToken(token); err != nil {
+			return nil, err
+		}
+	}
+	owners := func(ctx context.Context) ([]string, error) {
+		return self.rangeOwners(cursor.Low, cursor.High), nil
+	}
+	return RunWatch(ctx, cursor, owners), nil
+}
+
+func (self *Ring) WatchKey(ctx context.Context, key int, token string) (<-chan WatchEvent, error) {
+	return self.Watch(ctx, key, key+1, token)
+}
+
+/*
+  Poll every machine owners says coordinates part of the cursor's range, and
+  send what they applied on the channel. Shared by the ring and the client,
+  which only differ in how they find the machines.
+*/
+func RunWatch(ctx context.Context, cursor WatchCursor, owners func(ctx context.Context) ([]string, error)) <-chan WatchEvent {
+	watcher := &watcher{cursor: cursor, events: make(chan WatchEvent), polling: make(map[string]context.CancelFunc)}
+	go watcher.run(ctx, owners)
+	return watcher.events
+}
+
+type watcher struct {
+	cursor  WatchCursor
+	events  chan WatchEvent
+	polling map[string]context.CancelFunc
+	pollers sync.WaitGroup
+	lock    sync.Mutex
+}
+
+// Keep a poll going to each machine coordinating the range, and only to those
+func (self *watcher) run(ctx context.Context, owners func(ctx context.Context) ([]string, error)) {
+	defer close(self.events)
+	for ctx.Err() == nil {
+		if addresses, err := owners(ctx); err == nil {
+			current := make(map[string]bool)
+			for _, address := range addresses {
+				current[address] = true
+				if _, found := self.polling[address]; !found {
+					pollCtx, cancel := context.WithCancel(ctx)
+					self.polling[address] = cancel
+					self.pollers.Add(1)
+					go self.poll(pollCtx, address)
+				}
+			}
+			//A machine that no longer coordinates any of it keeps its position, in case it takes keys back
+			for address, cancel := range self.polling {
+				if !current[address] {
+					cancel()
+					delete(self.polling, address)
+				}
+			}
+		}
+		sleepContext(ctx, watchRefreshInterval)
+	}
+	self.pollers.Wait()
+}
+
+func (self *watcher) poll(ctx context.Context, address string) {
+	defer self.pollers.Done()
+	for ctx.Err() == nil {
+		self.lock.Lock()
+		position := self.cursor.Positions[address]
+		request := &WatchRequest{Low: self.cursor.Low, High: self.cursor.High, Epoch: position.Epoch, After: position.Seq,
+			Since: self.cursor.Since, Timeout: watchPollTimeout}
+		self.lock.Unlock()
+
+		var result WatchResult
+		pollCtx, cancel := context.WithTimeout(ctx, watchPollTimeout+maxReplyMargin)
+		err := callMachineContext(pollCtx, address, "Ring.WatchEvents", request, &result)
+		cancel()
+		if err != nil {
+			sleepContext(ctx, watchRetryInterval)
+			continue
+		}
+		if !self.deliver(ctx, address, &result) {
+			return
+		}
+	}
+}
+
+// Send the events on, moving the cursor past each one. False if ctx was done first
+func (self *watcher) deliver(ctx context.Context, address string, result *WatchResult) bool {
+	//Resuming from before the events that follow misses the same changes again
+	if result.Missed {
+		self.lock.Lock()
+		position := self.cursor.Positions[address]
+		self.lock.Unlock()
+		missed := WatchEvent{Type: EventMissed, Member: address, Time: time.Now()}
+		if !self.send(ctx, address, position, missed) {
+			return false
+		}
+	}
+	for _, event := range result.Events {
+		event.Member = address
+		if !self.send(ctx, address, WatchPosition{result.Epoch, event.Seq}, event) {
+			return false
+		}
+	}
+	self.lock.Lock()
+	self.cursor.Positions[address] = WatchPosition{result.Epoch, result.Next}
+	self.lock.Unlock()
+	return true
+}
+
+func (self *watcher) send(ctx context.Context, address string, position WatchPosition, event WatchEvent) bool {
+	self.lock.Lock()
+	self.cursor.Positions[address] = position
+	event.Cursor = self.cursor.Token()
+	self.lock.Unlock()
+	select {
+	case self.events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func sleepContext(ctx context.Context, duration time.Duration) {
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+	}
+}